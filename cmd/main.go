@@ -1,14 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	"flag"
 
+	"github.com/juju/errors"
 	"github.com/ngaut/log"
 	"github.com/pingcap/mp/etc"
 	"github.com/pingcap/mp/server"
@@ -23,6 +27,55 @@ var (
 	storePath = flag.String("store_path", "/tmp/tidb", "tidb storage path")
 	logLevel  = flag.String("L", "debug", "log level: info, debug, warn, error, fatal")
 	port      = flag.String("P", "4000", "mp server port")
+	diffRules = flag.String("diff_rules", "", "known difference rules file(json or toml) for combo mode")
+	ndMode    = flag.String("nondeterministic", "", "handle non-deterministic sql in combo mode: \"\"(compare as usual)/bind(bind the same values)/skip(skip comparing the values)")
+	checksum  = flag.String("checksum", "", "verify the written tables after commit in combo mode: \"\"(never)/full/sample")
+	ckQuery   = flag.String("checksum_query", "", "query reading a table for checksum, %s is replaced by the table name")
+	ckSample  = flag.Int("checksum_sample", 1000, "rows of a random primary key range to compare in sample checksum mode")
+	ckIntvl   = flag.Duration("checksum_interval", 10*time.Second, "min interval between the checksums of a table")
+	resync    = flag.String("resync", "", "resync a desynced session in combo mode: \"\"(never)/rollback/replay(rollback and replay USE and SET)")
+	reproDir  = flag.String("repro_dir", "", "directory to write reproducers(mysql-test .test and .result) of divergent statements in combo mode")
+	reproMy   = flag.String("repro_myaddr", "", "dedicated mysql address to replay the reproducers on with an in-memory tidb, empty writes the .test files only")
+	reproMin  = flag.Bool("repro_minimize", false, "minimize the reproducers by replaying them on the dedicated backends")
+	latRatio  = flag.Float64("latency_ratio", 0, "report statement digests on which tidb is this times slower than mysql in combo mode, 0 disables")
+	latCount  = flag.Int64("latency_min_count", 10, "min executions of a digest to report its latency")
+	latFile   = flag.String("latency_file", "", "file to write the latency report to")
+	latIntvl  = flag.Duration("latency_interval", time.Minute, "interval to report the latency, 0 reports on exit only")
+	seedFile  = flag.String("seed", "", "seed config file(json or toml), copy the configured databases from mysql to tidb before serving")
+	serialize = flag.String("serialize", "", "order the statements of the sessions on the secondary backend in combo mode: \"\"(never)/global(all statements)/table(statements touching the same tables)")
+	rowDiffs  = flag.Int("row_diffs", 10, "max missing, extra and changed rows listed for a divergent statement in combo mode")
+	explain   = flag.Bool("explain", false, "capture the plans of the SELECTs which diverge or pass the latency threshold in combo mode")
+	shadow    = flag.Bool("shadow", false, "shadow mode of combo mode: answer with the primary backend only, replay the sampled statements on the other one in background")
+	shSession = flag.Float64("shadow_sessions", 1, "fraction of the sessions to shadow all statements of in shadow mode")
+	shReads   = flag.Float64("shadow_reads", 0, "fraction of the read-only statements of the other sessions to shadow in shadow mode")
+	shQueue   = flag.Int("shadow_queue", 1024, "max statements queued for a session in shadow mode, the overflowing ones are dropped")
+	capFile   = flag.String("capture", "", "session log file to capture the commands of the clients and the response summaries to")
+	capSize   = flag.Int64("capture_size", 0, "size in MB to rotate the session log at, 0 never rotates")
+	capFiles  = flag.Int("capture_files", 0, "rotated session log files to keep, 0 keeps all")
+	rpAddr    = flag.String("replay_addr", "", "address to replay the session logs to over the mysql protocol, empty replays to the driver of -mode")
+	rpSpeed   = flag.Float64("replay_speed", 0, "timing of the replay: 0(as fast as possible)/1(original timing)/n(n times faster)")
+	rpQueue   = flag.Int("replay_queue", 100000, "max records read ahead and queued by all the replayed connections")
+	pcapOut   = flag.String("pcap_out", "session.log", "session log file the pcap command writes to, appended if it exists")
+	pcapPort  = flag.Int("pcap_port", 3306, "mysql server port of the traffic in the pcap files")
+	trUsers   = flag.String("trace_users", "", "comma separated users whose packets are traced from the start, switched at runtime by SHOW MP TRACE")
+	trDump    = flag.Int("trace_dump", 256, "max bytes of a packet in the hexdump of the wire trace, 0 disables the hexdump")
+	genLog    = flag.String("general_log", "", "general log file, a json line per command of the clients")
+	slowLog   = flag.String("slow_log", "", "slow log file in the format of mysql")
+	longTime  = flag.Float64("long_query_time", 1, "seconds a statement takes to be logged to the slow log")
+	qlSize    = flag.Int64("query_log_size", 0, "size in MB to rotate the general and slow logs at, 0 never rotates")
+	qlFiles   = flag.Int("query_log_files", 0, "rotated general and slow log files to keep, 0 keeps all")
+	metrAddr  = flag.String("metrics_addr", "", "address of the http server of the prometheus metrics at /metrics, empty disables")
+	admAddr   = flag.String("admin_addr", "", "address of the admin http api, empty disables")
+	admUser   = flag.String("admin_user", "admin", "user of the basic authentication of the admin http api, and of the mysql clients running the admin statements")
+	admPass   = flag.String("admin_pass", "", "password of the admin user, required by the admin http api and the admin statements")
+	admCapDir = flag.String("admin_capdir", "", "directory the admin http api captures the session logs to, empty disables capturing by the api")
+	audFile   = flag.String("audit_log", "", "audit log file, a json line per login or audited statement")
+	audClass  = flag.String("audit_classes", "connect,use,ddl,dcl", "comma separated audited classes of connect, use, ddl, dcl and dml")
+	audUsers  = flag.String("audit_users", "", "comma separated audited users, empty audits all users")
+	audSkip   = flag.String("audit_exclude_users", "", "comma separated users never audited")
+	audSize   = flag.Int64("audit_size", 0, "size in MB to rotate the audit log at, 0 never rotates")
+	audFiles  = flag.Int("audit_files", 0, "rotated audit log files to keep, 0 keeps all")
+	maxDigest = flag.Int("max_digests", 10000, "max statement digests to keep the statistics of, the others are aggregated into one row, 0 disables")
 )
 
 //version infomation
@@ -42,9 +95,56 @@ func main() {
 		User:     "root",
 		Password: "",
 		LogLevel: *logLevel,
+		Capture: etc.Capture{
+			File:     *capFile,
+			MaxSize:  *capSize << 20,
+			MaxFiles: *capFiles,
+		},
+		Trace: etc.Trace{
+			MaxDump: *trDump,
+		},
+		QueryLog: etc.QueryLog{
+			General:       *genLog,
+			Slow:          *slowLog,
+			LongQueryTime: *longTime,
+			MaxSize:       *qlSize << 20,
+			MaxFiles:      *qlFiles,
+		},
+		MetricsAddr: *metrAddr,
+		Admin: etc.Admin{
+			Addr:       *admAddr,
+			User:       *admUser,
+			Password:   *admPass,
+			CaptureDir: *admCapDir,
+		},
+		Digests: etc.Digests{MaxDigests: *maxDigest},
+		Audit: etc.Audit{
+			File:     *audFile,
+			MaxSize:  *audSize << 20,
+			MaxFiles: *audFiles,
+		},
+	}
+	if *trUsers != "" {
+		cfg.Trace.Users = strings.Split(*trUsers, ",")
+	}
+	if *audClass != "" {
+		cfg.Audit.Classes = strings.Split(*audClass, ",")
+	}
+	if *audUsers != "" {
+		cfg.Audit.Users = strings.Split(*audUsers, ",")
+	}
+	if *audSkip != "" {
+		cfg.Audit.ExcludeUsers = strings.Split(*audSkip, ",")
 	}
 
 	log.SetLevelByString(cfg.LogLevel)
+	if flag.Arg(0) == "pcap" {
+		os.Exit(convertPcap(flag.Args()[1:]))
+	}
+	if err := checkModes(); err != nil {
+		log.Error(err.Error())
+		return
+	}
 	store, err := tidb.NewStore(fmt.Sprintf("%s://%s", *store, *storePath))
 	if err != nil {
 		log.Error(err.Error())
@@ -57,15 +157,80 @@ func main() {
 		Addr: *mysqlAddr,
 		Pass: *mysqlPass,
 	}
+	if flag.Arg(0) == "schemadiff" {
+		os.Exit(schemaDiff(server.NewComboDriver(false, myDriver, store), flag.Args()[1:]))
+	}
 	switch *runMode {
 	case "tidb":
 		driver = server.NewTidbDriver(store)
 	case "mysql":
 		driver = myDriver
-	case "combotidb":
-		driver = server.NewComboDriver(true, myDriver, store)
-	case "combo":
-		driver = server.NewComboDriver(false, myDriver, store)
+	case "combotidb", "combo":
+		comboDriver := server.NewComboDriver(*runMode == "combotidb", myDriver, store)
+		comboDriver.Resync = *resync
+		comboDriver.Nondeterministic = *ndMode
+		comboDriver.Serialize = *serialize
+		comboDriver.Explain = *explain
+		comboDriver.MaxRowDiffs = *rowDiffs
+		switch *checksum {
+		case server.ChecksumFull:
+			comboDriver.Checksum = &server.ChecksumConfig{Query: *ckQuery, Interval: *ckIntvl}
+		case server.ChecksumSample:
+			comboDriver.Checksum = &server.ChecksumConfig{Query: *ckQuery, SampleSize: *ckSample, Interval: *ckIntvl}
+		}
+		if *shadow {
+			comboDriver.Shadow = &server.ShadowConfig{
+				SessionRate:  *shSession,
+				ReadOnlyRate: *shReads,
+				QueueSize:    *shQueue,
+			}
+		}
+		if *latRatio > 0 {
+			comboDriver.Latency = server.NewLatencyStats(server.LatencyConfig{
+				Ratio:    *latRatio,
+				MinCount: *latCount,
+				File:     *latFile,
+				Interval: *latIntvl,
+			})
+			go comboDriver.Latency.Run()
+		}
+		if *reproDir != "" {
+			comboDriver.Repro = &server.ReproConfig{Dir: *reproDir, Minimize: *reproMin}
+			if *reproMy != "" {
+				reproStore, err := tidb.NewStore("memory://mp_repro")
+				if err != nil {
+					log.Error(err.Error())
+					return
+				}
+				comboDriver.Repro.Mysql = &server.MysqlDriver{Addr: *reproMy, Pass: *mysqlPass}
+				comboDriver.Repro.Tidb = server.NewTidbDriver(reproStore)
+			}
+		}
+		if *diffRules != "" {
+			comboDriver.Rules, err = server.LoadDiffRuleSet(*diffRules)
+			if err != nil {
+				log.Error(err.Error())
+				return
+			}
+		}
+		driver = comboDriver
+	}
+	if flag.Arg(0) == "replay" {
+		if *rpAddr != "" {
+			driver = &server.MysqlDriver{Addr: *rpAddr, Pass: *mysqlPass}
+		}
+		os.Exit(replay(driver, flag.Args()[1:]))
+	}
+	if *seedFile != "" {
+		seedCfg, err := etc.ParseSeedFile(*seedFile)
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		if err = server.Seed(myDriver, server.NewTidbDriver(store), seedCfg); err != nil {
+			log.Error(errors.ErrorStack(err))
+			return
+		}
 	}
 	svr, err = server.NewServer(cfg, driver)
 	if err != nil {
@@ -83,9 +248,98 @@ func main() {
 	go func() {
 		sig := <-sc
 		log.Infof("Got signal [%d] to exit.", sig)
+		if comboDriver, ok := driver.(*server.ComboDriver); ok {
+			comboDriver.Rules.LogStats()
+			comboDriver.Latency.LogReport()
+			comboDriver.Shadow.LogStats()
+		}
 		svr.Close()
 		os.Exit(0)
 	}()
 
 	log.Error(svr.Run())
 }
+
+// checkModes rejects the unknown values of the mode flags.
+func checkModes() error {
+	if err := server.CheckResync(*resync); err != nil {
+		return err
+	}
+	if err := server.CheckNondeterministic(*ndMode); err != nil {
+		return err
+	}
+	if err := server.CheckChecksum(*checksum); err != nil {
+		return err
+	}
+	return server.CheckSerialize(*serialize)
+}
+
+// schemaDiff prints the schema differences of the databases on mysql and
+// tidb as json, the exit code is 1 if there are differences.
+func schemaDiff(driver *server.ComboDriver, dbs []string) int {
+	report, err := driver.DiffSchemas(dbs)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		return 2
+	}
+	b, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		log.Error(err.Error())
+		return 2
+	}
+	fmt.Println(string(b))
+	if len(report.Diffs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replay replays the session logs to driver and prints the report as json,
+// the exit code is 1 if there are regressions.
+func replay(driver server.IDriver, logs []string) int {
+	var files []string
+	for _, l := range logs {
+		rotated, err := server.CaptureFiles(l)
+		if err != nil {
+			log.Error(errors.ErrorStack(err))
+			return 2
+		}
+		if len(rotated) == 0 {
+			log.Errorf("session log %s not found", l)
+			return 2
+		}
+		files = append(files, rotated...)
+	}
+	report, err := server.Replay(driver, files, server.ReplayConfig{Speed: *rpSpeed, MaxQueued: *rpQueue})
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		return 2
+	}
+	b, err := json.MarshalIndent(report, "", "\t")
+	if err != nil {
+		log.Error(err.Error())
+		return 2
+	}
+	fmt.Println(string(b))
+	if report.Regressions > 0 {
+		return 1
+	}
+	return 0
+}
+
+// convertPcap converts the mysql traffic of the pcap files to a session log.
+func convertPcap(files []string) int {
+	capture, err := server.OpenCapture(etc.Capture{File: *pcapOut})
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		return 2
+	}
+	defer capture.Close()
+	stats, err := server.ConvertPcap(files, *pcapPort, capture)
+	if err != nil {
+		log.Error(errors.ErrorStack(err))
+		return 2
+	}
+	log.Infof("%d connections, %d skipped, %d records written to %s", stats.Connections, stats.Skipped, stats.Records, *pcapOut)
+	return 0
+}
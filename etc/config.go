@@ -10,11 +10,94 @@ import (
 )
 
 type Config struct {
+	Addr     string   `json:"addr" toml:"addr"`
+	User     string   `json:"user" toml:"user"`
+	Password string   `json:"password" toml:"password"`
+	LogLevel string   `json:"log_level" toml:"log_level"`
+	SkipAuth bool     `json:"skip_auth" toml:"skip_auth"`
+	Capture  Capture  `json:"capture" toml:"capture"`
+	Trace    Trace    `json:"trace" toml:"trace"`
+	QueryLog QueryLog `json:"query_log" toml:"query_log"`
+	// MetricsAddr is the address of the http server of the prometheus
+	// metrics at /metrics, empty means disabled.
+	MetricsAddr string  `json:"metrics_addr" toml:"metrics_addr"`
+	Admin       Admin   `json:"admin" toml:"admin"`
+	Digests     Digests `json:"digests" toml:"digests"`
+	Audit       Audit   `json:"audit" toml:"audit"`
+}
+
+// Audit configures the audit log of the logins and the statements.
+type Audit struct {
+	// File is the audit log file, a json line per event, empty means disabled.
+	File string `json:"file" toml:"file"`
+	// Classes are the audited classes of connect, use, ddl, dcl and dml,
+	// empty means all but dml.
+	Classes []string `json:"classes" toml:"classes"`
+	// Users are the audited users, empty means all users.
+	Users []string `json:"users" toml:"users"`
+	// ExcludeUsers are the users never audited.
+	ExcludeUsers []string `json:"exclude_users" toml:"exclude_users"`
+	// MaxSize is the size in bytes a file is rotated at, zero means never rotating.
+	MaxSize int64 `json:"max_size" toml:"max_size"`
+	// MaxFiles is the number of rotated files kept, zero means keeping all.
+	MaxFiles int `json:"max_files" toml:"max_files"`
+	// BufferSize is the number of events queued for the writer, the events
+	// are dropped when it's full. Zero means 4096.
+	BufferSize int `json:"buffer_size" toml:"buffer_size"`
+}
+
+// Digests configures the statement statistics per schema and statement digest.
+type Digests struct {
+	// MaxDigests is the max number of digests kept, zero means disabled.
+	MaxDigests int `json:"max_digests" toml:"max_digests"`
+}
+
+// Admin configures the admin http api, it authenticates the requests by the
+// basic authentication of its own user. The mysql clients logged in with the
+// same user and password run the admin statements and read the mp schema.
+type Admin struct {
+	// Addr is the address of the admin http server, empty means disabled.
 	Addr     string `json:"addr" toml:"addr"`
 	User     string `json:"user" toml:"user"`
 	Password string `json:"password" toml:"password"`
-	LogLevel string `json:"log_level" toml:"log_level"`
-	SkipAuth bool   `json:"skip_auth" toml:"skip_auth"`
+	// CaptureDir is the directory the api captures to, the file of a capture
+	// request is a name in it. Empty means the api never starts capturing.
+	CaptureDir string `json:"capture_dir" toml:"capture_dir"`
+}
+
+// Capture configures the traffic capture of the server, every command of
+// the clients and the summary of its response are written to a session log.
+type Capture struct {
+	// File is the session log file, empty means capture is disabled.
+	File string `json:"file" toml:"file"`
+	// MaxSize is the size in bytes a file is rotated at, zero means never rotating.
+	MaxSize int64 `json:"max_size" toml:"max_size"`
+	// MaxFiles is the number of rotated files kept, zero means keeping all.
+	MaxFiles int `json:"max_files" toml:"max_files"`
+}
+
+// Trace configures the packet-level wire trace, it's switched at runtime by
+// "SHOW MP TRACE".
+type Trace struct {
+	// Users are the users whose connections are traced from the start.
+	Users []string `json:"users" toml:"users"`
+	// MaxDump is the max bytes of a packet in the hexdump, zero means no hexdump.
+	MaxDump int `json:"max_dump" toml:"max_dump"`
+}
+
+// QueryLog configures the general log and the slow log.
+type QueryLog struct {
+	// General is the general log file, a json line per command, empty means disabled.
+	General string `json:"general" toml:"general"`
+	// Slow is the slow log file in the format of mysql, empty means disabled.
+	Slow string `json:"slow" toml:"slow"`
+	// LongQueryTime is the seconds a statement takes to be logged to the
+	// slow log, zero logs every statement.
+	LongQueryTime float64 `json:"long_query_time" toml:"long_query_time"`
+	// MaxSize is the size in bytes the files are rotated at, zero means never rotating.
+	MaxSize int64 `json:"max_size" toml:"max_size"`
+	// MaxFiles is the number of rotated files kept of each log, zero means keeping all.
+	MaxFiles int `json:"max_files" toml:"max_files"`
 }
 
 func ParseConfigJsonData(data []byte) (*Config, error) {
@@ -45,3 +128,92 @@ func ParseConfigFile(fileName string) (*Config, error) {
 		return ParseConfigJsonData(data)
 	}
 }
+
+// DiffRule describes a known difference between the backends in combo mode.
+// All non-empty conditions must match for a diff to be hit by the rule.
+type DiffRule struct {
+	Name string `json:"name" toml:"name"`
+	// SQL is a regular expression matched against the statement text.
+	SQL string `json:"sql" toml:"sql"`
+	// Digest is the digest of the normalized statement.
+	Digest string `json:"digest" toml:"digest"`
+	// Column is the column name the diff is about.
+	Column string `json:"column" toml:"column"`
+	// Field is the kind of the diff, such as Flag, ColumnLength or Charset.
+	Field string `json:"field" toml:"field"`
+	// MysqlErrCode and TidbErrCode match the error code pair of an error diff.
+	MysqlErrCode uint16 `json:"mysql_err_code" toml:"mysql_err_code"`
+	TidbErrCode  uint16 `json:"tidb_err_code" toml:"tidb_err_code"`
+	// Action is "suppress" (default) or "downgrade".
+	Action string `json:"action" toml:"action"`
+}
+
+type DiffRules struct {
+	Rules []*DiffRule `json:"rules" toml:"rules"`
+}
+
+func ParseDiffRulesFile(fileName string) (*DiffRules, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var rules DiffRules
+	if strings.ToLower(filepath.Ext(fileName)) == ".toml" {
+		_, err = toml.Decode(string(data), &rules)
+	} else {
+		err = json.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// SeedTable configures copying a table when seeding tidb.
+type SeedTable struct {
+	Name string `json:"name" toml:"name"`
+	// Skip excludes the table.
+	Skip bool `json:"skip" toml:"skip"`
+	// SchemaOnly creates the table without copying its rows.
+	SchemaOnly bool `json:"schema_only" toml:"schema_only"`
+	// Where only copies the rows matching the condition.
+	Where     string `json:"where" toml:"where"`
+	BatchSize int    `json:"batch_size" toml:"batch_size"`
+}
+
+// SeedDatabase configures copying a database when seeding tidb, all its
+// tables are copied, Tables overrides the options of some of them.
+type SeedDatabase struct {
+	Name string `json:"name" toml:"name"`
+	// Only copies the listed tables only.
+	Only      bool         `json:"only" toml:"only"`
+	Tables    []*SeedTable `json:"tables" toml:"tables"`
+	BatchSize int          `json:"batch_size" toml:"batch_size"`
+}
+
+// Seed configures copying databases from mysql to tidb before serving.
+type Seed struct {
+	Databases []*SeedDatabase `json:"databases" toml:"databases"`
+	// BatchSize is the number of rows inserted by a statement.
+	BatchSize int `json:"batch_size" toml:"batch_size"`
+	// StateFile records the progress, so an interrupted seeding continues
+	// where it stopped. Empty means restarting from scratch.
+	StateFile string `json:"state_file" toml:"state_file"`
+}
+
+func ParseSeedFile(fileName string) (*Seed, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var seed Seed
+	if strings.ToLower(filepath.Ext(fileName)) == ".toml" {
+		_, err = toml.Decode(string(data), &seed)
+	} else {
+		err = json.Unmarshal(data, &seed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &seed, nil
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// ClientInfo is the state of a client connection listed by the admin API.
+type ClientInfo struct {
+	ID        uint32    `json:"id"`
+	User      string    `json:"user"`
+	Host      string    `json:"host"`
+	DB        string    `json:"db"`
+	Connected time.Time `json:"connected"`
+	// Command is the running command, "sleep" if the connection is idle.
+	Command string `json:"command"`
+	SQL     string `json:"sql,omitempty"`
+	// Since is the start of the running command, or the end of the last one.
+	Since    time.Time `json:"since"`
+	Commands int64     `json:"commands"`
+	Traced   bool      `json:"traced"`
+}
+
+// Info returns the state of the connection, it's safe to call from other goroutines.
+func (cc *ClientConn) Info() ClientInfo {
+	cc.infoMu.Lock()
+	info := cc.info
+	cc.infoMu.Unlock()
+	info.Traced = cc.server.tracer.Traced(info.ID, info.User)
+	return info
+}
+
+// setCommand records the running command, empty name means idle. The
+// passwords in sql are redacted.
+func (cc *ClientConn) setCommand(name, sql string) {
+	cc.infoMu.Lock()
+	if name == "" {
+		cc.info.Command, cc.info.SQL = "sleep", ""
+		cc.info.DB = cc.dbname
+	} else {
+		cc.info.Command, cc.info.SQL = name, redactPasswords(sql)
+		cc.info.Commands++
+	}
+	cc.info.Since = time.Now()
+	cc.infoMu.Unlock()
+}
+
+// Clients returns the state of the client connections ordered by id.
+func (s *Server) Clients() []ClientInfo {
+	s.rwlock.RLock()
+	clients := make([]ClientInfo, 0, len(s.clients))
+	for _, cc := range s.clients {
+		clients = append(clients, cc.Info())
+	}
+	s.rwlock.RUnlock()
+	sort.Sort(clientInfos(clients))
+	return clients
+}
+
+type clientInfos []ClientInfo
+
+func (ci clientInfos) Len() int           { return len(ci) }
+func (ci clientInfos) Less(i, j int) bool { return ci[i].ID < ci[j].ID }
+func (ci clientInfos) Swap(i, j int)      { ci[i], ci[j] = ci[j], ci[i] }
+
+// Kill closes a client connection, the running command finishes before the
+// connection is cleaned up.
+func (s *Server) Kill(id uint32) error {
+	s.rwlock.RLock()
+	cc, ok := s.clients[id]
+	s.rwlock.RUnlock()
+	if !ok {
+		return NewDefaultError(ErNoSuchThread, id)
+	}
+	log.Infof("kill connection %d", id)
+	return errors.Trace(cc.conn.Close())
+}
+
+// getCapture returns the capture of the server, nil if capture is disabled.
+func (s *Server) getCapture() *Capture {
+	s.captureMu.RLock()
+	defer s.captureMu.RUnlock()
+	return s.capture
+}
+
+// SetCapture starts capturing to cfg.File, or stops capturing if cfg.File is
+// empty. The previous session log is closed.
+func (s *Server) SetCapture(cfg etc.Capture) error {
+	var capture *Capture
+	if cfg.File != "" {
+		var err error
+		if capture, err = OpenCapture(cfg); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	s.captureMu.Lock()
+	old := s.capture
+	s.capture, s.captureCfg = capture, cfg
+	s.captureMu.Unlock()
+	return errors.Trace(old.Close())
+}
+
+// captureFile returns the path of the capture file name in the capture dir.
+// The name can not be a path, since the rotation removes the files named
+// like it.
+func (s *Server) captureFile(name string) (string, error) {
+	dir := s.cfg.Admin.CaptureDir
+	if dir == "" {
+		return "", badAdminRequest("capture dir is not configured")
+	}
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", badAdminRequest(fmt.Sprintf("capture file %q is not a file name", name))
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// readyChecker is implemented by the drivers which can tell whether their
+// backends are reachable.
+type readyChecker interface {
+	ready() error
+}
+
+func (md *MysqlDriver) ready() error {
+	conn, err := net.DialTimeout("tcp", md.Addr, time.Second)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return conn.Close()
+}
+
+func (cd *ComboDriver) ready() error {
+	if rc, ok := cd.mysqlDriver.(readyChecker); ok {
+		return errors.Trace(rc.ready())
+	}
+	return nil
+}
+
+// Ready returns nil if the server accepts connections and its backends are reachable.
+func (s *Server) Ready() error {
+	s.rwlock.RLock()
+	closed := s.listener == nil
+	s.rwlock.RUnlock()
+	if closed {
+		return errors.New("server is closed")
+	}
+	if rc, ok := s.driver.(readyChecker); ok {
+		return errors.Annotate(rc.ready(), "backend is unreachable")
+	}
+	return nil
+}
+
+// redacted replaces a non-empty secret.
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "******"
+}
+
+// redactedConfig returns a copy of the loaded config with the secrets redacted.
+func (s *Server) redactedConfig() *etc.Config {
+	cfg := *s.cfg
+	cfg.Password = redacted(cfg.Password)
+	cfg.Admin.Password = redacted(cfg.Admin.Password)
+	return &cfg
+}
+
+// adminHandler returns the handler of the admin http server:
+//
+//	GET    /healthz                  the process is alive
+//	GET    /readyz                   the server accepts connections and the backends are reachable
+//	GET    /metrics                  the prometheus metrics
+//	GET    /api/clients              list the client connections
+//	POST   /api/clients/<id>/kill    kill a client connection
+//	GET    /api/log_level            the log level
+//	PUT    /api/log_level            change the log level, {"level": "info"}
+//	GET    /api/config               the loaded config, the secrets are redacted
+//	GET    /api/capture              the capture config, empty file means disabled
+//	PUT    /api/capture              start capturing to a file in the capture dir, {"file": "session.log"}
+//	DELETE /api/capture              stop capturing
+//	GET    /api/trace                the traced targets
+//	PUT    /api/trace                switch the trace, {"target": "user", "name": "root", "on": true}
+//	GET    /api/digests              the statement statistics per digest
+//	DELETE /api/digests              reset the statement statistics
+//
+// The health checks are open, the others need the basic authentication of
+// the admin user.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Ready(); err != nil {
+			writeAdminJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	})
+	mux.Handle("/metrics", s.adminAuth(metrics))
+	mux.Handle("/api/", s.adminAuth(http.HandlerFunc(s.handleAdminAPI)))
+	return mux
+}
+
+func (s *Server) adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(s.cfg.Admin.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Admin.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mp admin"`)
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	b, _ := json.MarshalIndent(v, "", "  ")
+	w.Write(append(b, '\n'))
+}
+
+// adminError is an error of an admin request with its http status.
+type adminError struct {
+	status int
+	msg    string
+}
+
+func (e *adminError) Error() string {
+	return e.msg
+}
+
+func badAdminRequest(format string, args ...interface{}) error {
+	return &adminError{status: http.StatusBadRequest, msg: fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) handleAdminAPI(w http.ResponseWriter, r *http.Request) {
+	v, err := s.adminAPI(r, strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if e, ok := errors.Cause(err).(*adminError); ok {
+			status = e.status
+		} else if m, ok := errors.Cause(err).(*SQLError); ok && m.Code == ErNoSuchThread {
+			status = http.StatusNotFound
+		}
+		writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) adminAPI(r *http.Request, path []string) (interface{}, error) {
+	route := r.Method + " " + path[0]
+	switch {
+	case route == "GET clients" && len(path) == 1:
+		return s.Clients(), nil
+	case route == "POST clients" && len(path) == 3 && path[2] == "kill":
+		id, err := strconv.ParseUint(path[1], 10, 32)
+		if err != nil {
+			return nil, badAdminRequest("invalid connection id %s", path[1])
+		}
+		return map[string]uint32{"killed": uint32(id)}, errors.Trace(s.Kill(uint32(id)))
+	case route == "GET log_level":
+		return map[string]string{"level": s.getLogLevel()}, nil
+	case route == "PUT log_level":
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := decodeAdminRequest(r, &req); err != nil {
+			return nil, err
+		}
+		switch req.Level {
+		case "debug", "info", "warn", "error", "fatal":
+		default:
+			return nil, badAdminRequest("invalid log level %q", req.Level)
+		}
+		s.adminMu.Lock()
+		s.logLevel = req.Level
+		s.adminMu.Unlock()
+		log.SetLevelByString(req.Level)
+		return map[string]string{"level": req.Level}, nil
+	case route == "GET config":
+		return s.redactedConfig(), nil
+	case route == "GET capture":
+		s.captureMu.RLock()
+		defer s.captureMu.RUnlock()
+		return s.captureCfg, nil
+	case route == "PUT capture":
+		var cfg etc.Capture
+		if err := decodeAdminRequest(r, &cfg); err != nil {
+			return nil, err
+		}
+		file, err := s.captureFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		cfg.File = file
+		return cfg, errors.Trace(s.SetCapture(cfg))
+	case route == "DELETE capture":
+		return etc.Capture{}, errors.Trace(s.SetCapture(etc.Capture{}))
+	case route == "GET trace":
+		return s.tracer.targets(), nil
+	case route == "PUT trace":
+		var req struct {
+			Target string `json:"target"` // all, connection or user
+			Name   string `json:"name"`   // the connection id or the user name
+			On     bool   `json:"on"`
+		}
+		if err := decodeAdminRequest(r, &req); err != nil {
+			return nil, err
+		}
+		args := []string{"off", req.Target}
+		if req.On {
+			args[0] = "on"
+		}
+		if req.Target != "all" {
+			args = append(args, req.Name)
+		}
+		if _, err := s.tracer.admin(args); err != nil {
+			return nil, badAdminRequest("%v", err)
+		}
+		return s.tracer.targets(), nil
+	case route == "GET digests" || route == "DELETE digests":
+		if s.digests == nil {
+			return nil, &adminError{status: http.StatusNotFound, msg: "digest statistics are disabled"}
+		}
+		if r.Method == "DELETE" {
+			s.digests.Reset()
+		}
+		return s.digests.Summaries(), nil
+	}
+	return nil, &adminError{status: http.StatusNotFound, msg: fmt.Sprintf("no such api %s /api/%s", r.Method, strings.Join(path, "/"))}
+}
+
+func decodeAdminRequest(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badAdminRequest("invalid request body %v", err)
+	}
+	return nil
+}
+
+func (s *Server) getLogLevel() string {
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	return s.logLevel
+}
+
+// serveAdmin serves the admin api on l until l is closed.
+func (s *Server) serveAdmin(l net.Listener) {
+	if err := http.Serve(l, s.adminHandler()); err != nil {
+		log.Infof("admin server stopped %v", err)
+	}
+}
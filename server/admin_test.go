@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testAdminSuite{})
+
+type testAdminSuite struct {
+}
+
+func (s *testAdminSuite) TestAdminAPI(c *C) {
+	cfg := &etc.Config{Password: "secret", Admin: etc.Admin{User: "admin", Password: "pass"}}
+	fc := newFakeContext()
+	cc := newCaptureConn(nil, fc)
+	server := cc.server
+	server.cfg, server.tracer, server.logLevel = cfg, NewTracer(etc.Trace{}), "info"
+	server.clients = map[uint32]*ClientConn{7: cc}
+	cc.user, cc.dbname = "root", "test"
+	cc.info = ClientInfo{ID: 7, User: "root", Command: "sleep"}
+	c.Assert(cc.dispatch(append([]byte{ComInitDB}, "test"...)), IsNil)
+
+	handler := server.adminHandler()
+	do := func(method, path, body string, auth bool) (int, string) {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		c.Assert(err, IsNil)
+		if auth {
+			req.SetBasicAuth("admin", "pass")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	code, _ := do("GET", "/healthz", "", false)
+	c.Assert(code, Equals, http.StatusOK)
+	// the server is not listening.
+	code, _ = do("GET", "/readyz", "", false)
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	code, _ = do("GET", "/api/clients", "", false)
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	code, body := do("GET", "/api/clients", "", true)
+	c.Assert(code, Equals, http.StatusOK)
+	var clients []ClientInfo
+	c.Assert(json.Unmarshal([]byte(body), &clients), IsNil)
+	c.Assert(clients, HasLen, 1)
+	c.Assert(clients[0].DB, Equals, "test")
+	c.Assert(clients[0].Command, Equals, "sleep")
+	c.Assert(clients[0].Commands, Equals, int64(1))
+
+	code, body = do("GET", "/api/config", "", true)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(body, "secret"), Equals, false)
+	c.Assert(strings.Contains(body, `"pass"`), Equals, false)
+
+	code, _ = do("PUT", "/api/log_level", `{"level": "warn"}`, true)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(server.getLogLevel(), Equals, "warn")
+	code, _ = do("PUT", "/api/log_level", `{"level": "verbose"}`, true)
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	code, body = do("PUT", "/api/trace", `{"target": "connection", "name": "7", "on": true}`, true)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(cc.Info().Traced, Equals, true)
+	code, _ = do("PUT", "/api/trace", `{"target": "table", "on": true}`, true)
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	code, _ = do("PUT", "/api/capture", `{"file": "session.log"}`, true)
+	c.Assert(code, Equals, http.StatusBadRequest)
+	cfg.Admin.CaptureDir = c.MkDir()
+	file := filepath.Join(cfg.Admin.CaptureDir, "session.log")
+	// the files out of the capture dir are never written or rotated.
+	for _, name := range []string{file, "../session.log", "a/session.log", ".."} {
+		code, _ = do("PUT", "/api/capture", fmt.Sprintf(`{"file": %q}`, name), true)
+		c.Assert(code, Equals, http.StatusBadRequest, Commentf("file %s", name))
+	}
+	code, _ = do("PUT", "/api/capture", `{"file": "session.log"}`, true)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(cc.dispatch([]byte{ComPing}), IsNil)
+	code, _ = do("DELETE", "/api/capture", "", true)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(server.getCapture(), IsNil)
+	c.Assert(readCapture(c, file), HasLen, 1)
+
+	code, _ = do("POST", "/api/clients/8/kill", "", true)
+	c.Assert(code, Equals, http.StatusNotFound)
+	code, _ = do("GET", "/api/unknown", "", true)
+	c.Assert(code, Equals, http.StatusNotFound)
+}
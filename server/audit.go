@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// The classes of the audit events.
+const (
+	AuditConnect = "connect" // the logins
+	AuditUse     = "use"     // the changes of the current database
+	AuditDDL     = "ddl"
+	AuditDCL     = "dcl" // the accounts and the privileges
+	AuditDML     = "dml"
+)
+
+// defaultAuditClasses are audited if no class is configured.
+var defaultAuditClasses = []string{AuditConnect, AuditUse, AuditDDL, AuditDCL}
+
+const defaultAuditBufferSize = 4096
+
+// AuditEvent is a line of the audit log.
+type AuditEvent struct {
+	Time  time.Time `json:"time"`
+	Class string    `json:"class"`
+	// Event is login, or the command of the statement: init_db, query or execute.
+	Event   string `json:"event"`
+	Conn    uint32 `json:"conn"`
+	User    string `json:"user"`
+	Host    string `json:"host"`
+	DB      string `json:"db,omitempty"`
+	SQL     string `json:"sql,omitempty"` // the statement, or the database of init_db
+	Status  string `json:"status"`        // ok or failed
+	ErrCode uint16 `json:"err_code,omitempty"`
+	// Reason is why a login failed: access_denied, closed, timeout or protocol.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Audit writes the audit events of the configured classes and users as json
+// lines. The events are queued to a writer goroutine, they are dropped when
+// the queue is full so auditing never blocks the clients.
+type Audit struct {
+	file         *logFile
+	classes      map[string]bool
+	users        map[string]bool // empty means all users
+	excludeUsers map[string]bool
+
+	mu     sync.RWMutex
+	ch     chan *AuditEvent
+	closed bool
+	done   chan struct{}
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func newAudit(cfg etc.Audit) (*Audit, error) {
+	classes := cfg.Classes
+	if len(classes) == 0 {
+		classes = defaultAuditClasses
+	}
+	for _, class := range classes {
+		switch class {
+		case AuditConnect, AuditUse, AuditDDL, AuditDCL, AuditDML:
+		default:
+			return nil, errors.Errorf("unknown audit class %q", class)
+		}
+	}
+	size := cfg.BufferSize
+	if size <= 0 {
+		size = defaultAuditBufferSize
+	}
+	return &Audit{
+		classes:      stringSet(classes),
+		users:        stringSet(cfg.Users),
+		excludeUsers: stringSet(cfg.ExcludeUsers),
+		ch:           make(chan *AuditEvent, size),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// OpenAudit opens the audit log and starts its writer.
+func OpenAudit(cfg etc.Audit) (*Audit, error) {
+	a, err := newAudit(cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if a.file, err = openLogFile(cfg.File, cfg.MaxSize, cfg.MaxFiles, nil); err != nil {
+		return nil, errors.Trace(err)
+	}
+	go a.run()
+	return a, nil
+}
+
+// audited returns whether the events of the class of user are audited.
+func (a *Audit) audited(class, user string) bool {
+	if a == nil || !a.classes[class] || a.excludeUsers[user] {
+		return false
+	}
+	return len(a.users) == 0 || a.users[user]
+}
+
+// Write queues an event, it never blocks.
+func (a *Audit) Write(e *AuditEvent) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.ch <- e:
+	default:
+		metrics.AuditDropped.Inc()
+	}
+}
+
+func (a *Audit) run() {
+	defer close(a.done)
+	for e := range a.ch {
+		b, err := json.Marshal(e)
+		if err == nil {
+			err = a.file.Write(append(b, '\n'))
+		}
+		if err != nil {
+			log.Warningf("write audit log error %s", errors.ErrorStack(err))
+		}
+	}
+}
+
+// Close writes the queued events and closes the audit log.
+func (a *Audit) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.ch)
+	a.mu.Unlock()
+	<-a.done
+	return errors.Trace(a.file.Close())
+}
+
+// auditClass returns the audit class of a command, empty if it's never audited.
+func auditClass(cmd byte, sql string) string {
+	if cmd == ComInitDB {
+		return AuditUse
+	}
+	if cmd != ComQuery && cmd != ComStmtExecute {
+		return ""
+	}
+	switch sqlCommand(sql) {
+	case "use":
+		return AuditUse
+	case "grant", "revoke":
+		return AuditDCL
+	case "create", "alter", "drop", "rename":
+		switch auditObject(sql) {
+		case "user", "role":
+			return AuditDCL
+		}
+		return AuditDDL
+	case "truncate":
+		return AuditDDL
+	case "set":
+		if auditObject(sql) == "password" {
+			return AuditDCL
+		}
+	case "select", "insert", "update", "delete", "replace", "load", "call", "with":
+		return AuditDML
+	}
+	return ""
+}
+
+// auditObject returns the lower cased second keyword of sql, such as the
+// user of CREATE USER.
+func auditObject(sql string) string {
+	const maxPrefix = 256
+	if len(sql) > maxPrefix {
+		sql = sql[:maxPrefix]
+	}
+	toks := lexSQL(sql)
+	if len(toks) < 2 || toks[1].kind != tokIdent {
+		return ""
+	}
+	return toks[1].lower(sql)
+}
+
+// auditLogin audits the handshake of the client, err is the failure.
+func (cc *ClientConn) auditLogin(err error) {
+	a := cc.server.audit
+	if !a.audited(AuditConnect, cc.user) {
+		return
+	}
+	e := &AuditEvent{
+		Time:   time.Now(),
+		Class:  AuditConnect,
+		Event:  "login",
+		Conn:   cc.connectionId,
+		User:   cc.user,
+		Host:   cc.remoteHost(),
+		DB:     cc.dbname,
+		Status: "ok",
+	}
+	if err != nil {
+		e.Status, e.Reason = "failed", handshakeFailure(err)
+		if m, ok := errors.Cause(err).(*SQLError); ok {
+			e.ErrCode = m.Code
+		}
+	}
+	a.Write(e)
+}
+
+// auditCommand audits a command with its sql after it's executed, err is its
+// failure. The database is the one after the command, so a USE is audited
+// with the database it changed to.
+func (cc *ClientConn) auditCommand(class, name, sql string, err error) {
+	e := &AuditEvent{
+		Time:   time.Now(),
+		Class:  class,
+		Event:  name,
+		Conn:   cc.connectionId,
+		User:   cc.user,
+		Host:   cc.remoteHost(),
+		DB:     cc.dbname,
+		SQL:    redactPasswords(strings.TrimSpace(sql)),
+		Status: "ok",
+	}
+	if err != nil {
+		e.Status, e.ErrCode = "failed", toSQLError(err).Code
+	}
+	cc.server.audit.Write(e)
+}
+
+const redactedPassword = "'***'"
+
+// redactPasswords replaces the passwords of the account statements in sql,
+// the string after IDENTIFIED BY or AS and the strings of SET PASSWORD, with
+// a placeholder, so they are never written to the logs.
+func redactPasswords(sql string) string {
+	switch sqlCommand(sql) {
+	case "create", "alter", "grant", "set":
+	default:
+		return sql
+	}
+	lower := strings.ToLower(sql)
+	if !strings.Contains(lower, "identified") && !strings.Contains(lower, "password") {
+		return sql
+	}
+	toks := lexSQL(sql)
+	setPassword := len(toks) >= 2 && toks[0].is(sql, "set") && toks[1].is(sql, "password")
+	var buf bytes.Buffer
+	pos, identified, assigned := 0, false, false
+	for i, tok := range toks {
+		if tok.kind == tokIdent && tok.is(sql, "identified") {
+			identified = true
+			continue
+		}
+		if setPassword && tok.is(sql, "=") {
+			assigned = true
+		}
+		secret := assigned
+		if identified && tok.kind == tokString && i > 0 && (toks[i-1].is(sql, "by") || toks[i-1].is(sql, "as")) {
+			secret, identified = true, false
+		}
+		if secret && tok.kind == tokString {
+			buf.WriteString(sql[pos:tok.start])
+			buf.WriteString(redactedPassword)
+			pos = tok.end
+		}
+	}
+	if pos == 0 {
+		return sql
+	}
+	buf.WriteString(sql[pos:])
+	return buf.String()
+}
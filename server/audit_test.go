@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testAuditSuite{})
+
+type testAuditSuite struct {
+}
+
+func (s *testAuditSuite) TestAudit(c *C) {
+	file := filepath.Join(c.MkDir(), "audit.log")
+	_, err := OpenAudit(etc.Audit{File: file, Classes: []string{"ddl", "query"}})
+	c.Assert(err, NotNil)
+	audit, err := OpenAudit(etc.Audit{File: file, ExcludeUsers: []string{"monitor"}})
+	c.Assert(err, IsNil)
+
+	fc := newFakeContext()
+	cc := newCaptureConn(nil, fc)
+	cc.server.audit = audit
+	cc.user = "root"
+	cc.auditLogin(nil)
+	cc.auditLogin(NewDefaultError(ErAccessDeniedError, "127.0.0.1", "root", "Yes"))
+	c.Assert(cc.dispatch(append([]byte{ComInitDB}, "test"...)), IsNil)
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "use gotest"...)), IsNil)
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "create table t (a int)"...)), IsNil)
+	fc.err = errors.New("failed")
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "CREATE USER u"...)), NotNil)
+	fc.err = nil
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select * from t"...)), IsNil)
+	cc.user = "monitor"
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "drop table t"...)), IsNil)
+	c.Assert(audit.Close(), IsNil)
+	// the writes after closing are dropped.
+	cc.auditLogin(nil)
+
+	data, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(lines, HasLen, 6)
+	var events []*AuditEvent
+	for _, line := range lines {
+		var e AuditEvent
+		c.Assert(json.Unmarshal([]byte(line), &e), IsNil)
+		events = append(events, &e)
+	}
+	c.Assert(events[0].Class, Equals, AuditConnect)
+	c.Assert(events[0].Status, Equals, "ok")
+	c.Assert(events[1].Status, Equals, "failed")
+	c.Assert(events[1].Reason, Equals, "access_denied")
+	c.Assert(events[1].ErrCode, Equals, uint16(ErAccessDeniedError))
+	c.Assert(events[2].Class, Equals, AuditUse)
+	c.Assert(events[2].DB, Equals, "test")
+	// the ddl is audited in the database changed by USE.
+	c.Assert(events[3].Class, Equals, AuditUse)
+	c.Assert(events[3].DB, Equals, "gotest")
+	c.Assert(events[4].Class, Equals, AuditDDL)
+	c.Assert(events[4].SQL, Equals, "create table t (a int)")
+	c.Assert(events[4].DB, Equals, "gotest")
+	c.Assert(events[5].Class, Equals, AuditDCL)
+	c.Assert(events[5].Status, Equals, "failed")
+
+	for sql, class := range map[string]string{
+		"use test":                         AuditUse,
+		"grant all on *.* to u":            AuditDCL,
+		"set password = 'x'":               AuditDCL,
+		"set names utf8":                   "",
+		"alter table t add b int":          AuditDDL,
+		"truncate t":                       AuditDDL,
+		"/* c */ insert into t values (1)": AuditDML,
+		"begin":                            "",
+	} {
+		c.Assert(auditClass(ComQuery, sql), Equals, class, Commentf(sql))
+	}
+
+	// the events are dropped when the queue is full.
+	a, err := newAudit(etc.Audit{BufferSize: 1})
+	c.Assert(err, IsNil)
+	dropped := metrics.AuditDropped.Value()
+	a.Write(&AuditEvent{})
+	a.Write(&AuditEvent{})
+	c.Assert(metrics.AuditDropped.Value(), Equals, dropped+1)
+}
+
+func (s *testAuditSuite) TestRedactPasswords(c *C) {
+	for _, t := range []struct {
+		sql      string
+		redacted string
+	}{
+		{"CREATE USER 'bob'@'%' IDENTIFIED BY 'secret'", "CREATE USER 'bob'@'%' IDENTIFIED BY '***'"},
+		{"grant all on *.* to bob identified by \"it's\" with grant option", "grant all on *.* to bob identified by '***' with grant option"},
+		{"alter user bob identified with mysql_native_password as '*2470C0C06DEE'", "alter user bob identified with mysql_native_password as '***'"},
+		{"SET PASSWORD FOR 'bob'@'%' = PASSWORD('secret')", "SET PASSWORD FOR 'bob'@'%' = PASSWORD('***')"},
+		{"set password = 'secret'", "set password = '***'"},
+		{"select 'identified by' from t where password = 'x'", "select 'identified by' from t where password = 'x'"},
+		{"create table t (password varchar(10) default 'x')", "create table t (password varchar(10) default 'x')"},
+	} {
+		c.Assert(redactPasswords(t.sql), Equals, t.redacted, Commentf("sql %s", t.sql))
+	}
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+const (
+	// CaptureFormat is the format name in the header line of a session log.
+	CaptureFormat = "mp-session-log"
+	// CaptureVersion is the version of the session log format, readers
+	// reject the files of newer versions.
+	CaptureVersion = 1
+)
+
+// The commands of the session log, connect and disconnect are not protocol
+// commands, they mark the start and the end of a connection.
+const (
+	CaptureConnect    = "connect"
+	CaptureDisconnect = "disconnect"
+	CaptureQuit       = "quit"
+	CaptureQuery      = "query"
+	CaptureInitDB     = "init_db"
+	CapturePing       = "ping"
+	CaptureFieldList  = "field_list"
+	CapturePrepare    = "prepare"
+	CaptureExecute    = "execute"
+	CaptureCloseStmt  = "close_stmt"
+	CaptureLongData   = "send_long_data"
+	CaptureResetStmt  = "reset_stmt"
+)
+
+var captureCommands = map[byte]string{
+	ComQuit:             CaptureQuit,
+	ComQuery:            CaptureQuery,
+	ComInitDB:           CaptureInitDB,
+	ComPing:             CapturePing,
+	ComFieldList:        CaptureFieldList,
+	ComStmtPrepare:      CapturePrepare,
+	ComStmtExecute:      CaptureExecute,
+	ComStmtClose:        CaptureCloseStmt,
+	ComStmtSendLongData: CaptureLongData,
+	ComStmtReset:        CaptureResetStmt,
+}
+
+// CaptureHeader is the first line of every session log file.
+type CaptureHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Start   time.Time `json:"start"`
+}
+
+// CaptureRecord is a command of a connection and the summary of its response,
+// a line of the session log.
+type CaptureRecord struct {
+	Conn     uint32         `json:"conn"`
+	Time     time.Time      `json:"time"`
+	Cmd      string         `json:"cmd"`
+	SQL      string         `json:"sql,omitempty"`
+	StmtID   int            `json:"stmt_id,omitempty"`
+	Param    int            `json:"param,omitempty"` // the parameter of send_long_data
+	Args     []CaptureValue `json:"args,omitempty"`
+	Duration int64          `json:"duration_us"`
+	Result   *CaptureResult `json:"result,omitempty"`
+
+	// the fields of connect.
+	User       string `json:"user,omitempty"`
+	DB         string `json:"db,omitempty"`
+	Capability uint32 `json:"capability,omitempty"`
+	Collation  uint8  `json:"collation,omitempty"`
+}
+
+// CaptureResult is the summary of a response.
+type CaptureResult struct {
+	// Kind is ok, error, rows, or fields for field_list.
+	Kind         string `json:"kind"`
+	AffectedRows uint64 `json:"affected_rows,omitempty"`
+	LastInsertID uint64 `json:"last_insert_id,omitempty"`
+	Code         uint16 `json:"code,omitempty"`
+	Message      string `json:"message,omitempty"`
+	Rows         int    `json:"rows,omitempty"`
+	// Digest is the digest of the column names and the text values of the rows.
+	Digest string `json:"digest,omitempty"`
+}
+
+// CaptureValue is a typed execute argument, the json types can not tell
+// integers, floats, strings and bytes apart.
+type CaptureValue struct {
+	// Type is null, int, uint, float, string or bytes, bytes are base64 encoded.
+	Type  string `json:"t"`
+	Value string `json:"v,omitempty"`
+}
+
+func newCaptureValue(v interface{}) CaptureValue {
+	switch x := v.(type) {
+	case nil:
+		return CaptureValue{Type: "null"}
+	case int64:
+		return CaptureValue{Type: "int", Value: strconv.FormatInt(x, 10)}
+	case uint64:
+		return CaptureValue{Type: "uint", Value: strconv.FormatUint(x, 10)}
+	case float64:
+		return CaptureValue{Type: "float", Value: strconv.FormatFloat(x, 'g', -1, 64)}
+	case []byte:
+		return CaptureValue{Type: "bytes", Value: base64.StdEncoding.EncodeToString(x)}
+	case string:
+		return CaptureValue{Type: "string", Value: x}
+	default:
+		return CaptureValue{Type: "string", Value: fmt.Sprint(x)}
+	}
+}
+
+// Interface returns the value as the execute argument it was decoded to.
+func (cv CaptureValue) Interface() (interface{}, error) {
+	switch cv.Type {
+	case "null":
+		return nil, nil
+	case "int":
+		return strconv.ParseInt(cv.Value, 10, 64)
+	case "uint":
+		return strconv.ParseUint(cv.Value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(cv.Value, 64)
+	case "bytes":
+		return base64.StdEncoding.DecodeString(cv.Value)
+	case "string":
+		return cv.Value, nil
+	}
+	return nil, errors.Errorf("unknown value type %s", cv.Type)
+}
+
+func captureArgs(args []interface{}) []CaptureValue {
+	values := make([]CaptureValue, len(args))
+	for i, arg := range args {
+		values[i] = newCaptureValue(arg)
+	}
+	return values
+}
+
+// newCaptureRecord decodes a command packet, the arguments of execute are
+// added by handleStmtExecute after they are parsed.
+func newCaptureRecord(conn uint32, cmd byte, data []byte) *CaptureRecord {
+	rec := &CaptureRecord{Conn: conn, Time: time.Now(), Cmd: commandName(cmd)}
+	switch cmd {
+	case ComQuery, ComStmtPrepare:
+		rec.SQL = redactPasswords(string(data))
+	case ComInitDB, ComFieldList:
+		rec.SQL = string(data)
+	case ComStmtExecute, ComStmtClose, ComStmtReset, ComStmtSendLongData:
+		if len(data) >= 4 {
+			rec.StmtID = int(binary.LittleEndian.Uint32(data[0:4]))
+		}
+		if cmd == ComStmtSendLongData && len(data) >= 6 {
+			rec.Param = int(binary.LittleEndian.Uint16(data[4:6]))
+			rec.Args = []CaptureValue{newCaptureValue(append([]byte(nil), data[6:]...))}
+		}
+	}
+	return rec
+}
+
+// commandName returns the name of a command in the session log, the
+// unsupported commands are named by the number.
+func commandName(cmd byte) string {
+	if name, ok := captureCommands[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("cmd_%d", cmd)
+}
+
+func okResult(ctx IContext) *CaptureResult {
+	return &CaptureResult{Kind: "ok", AffectedRows: ctx.AffectedRows(), LastInsertID: ctx.LastInsertID()}
+}
+
+func errorResult(err error) *CaptureResult {
+	m := toSQLError(err)
+	return &CaptureResult{Kind: "error", Code: m.Code, Message: m.Message}
+}
+
+func rowsResult(rs *ResultSet) *CaptureResult {
+	return &CaptureResult{Kind: "rows", Rows: len(rs.Rows), Digest: resultDigest(rs)}
+}
+
+// resultDigest returns the digest of the column names and the text values of
+// the rows, the results of the text and binary protocols get the same digest.
+func resultDigest(rs *ResultSet) string {
+	h := sha1.New()
+	for _, col := range rs.Columns {
+		io.WriteString(h, col.Name)
+		h.Write([]byte{0})
+	}
+	for _, row := range rs.Rows {
+		h.Write([]byte{'\n'})
+		for i, value := range row {
+			if i < len(rs.Columns) {
+				io.WriteString(h, checksumValue(rs.Columns[i], value))
+			}
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Capture writes the session log, a header line and a json line per record.
+// The file is opened for appending, and is rotated to a file suffixed by the
+// rotation time when it reaches the max size.
+type Capture struct {
+	file *logFile
+}
+
+func OpenCapture(cfg etc.Capture) (*Capture, error) {
+	header := func() []byte {
+		b, _ := json.Marshal(&CaptureHeader{Format: CaptureFormat, Version: CaptureVersion, Start: time.Now()})
+		return append(b, '\n')
+	}
+	file, err := openLogFile(cfg.File, cfg.MaxSize, cfg.MaxFiles, header)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Capture{file: file}, nil
+}
+
+// Write appends a record, the errors are logged, capture never fails the client.
+func (c *Capture) Write(rec *CaptureRecord) {
+	if c == nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Warningf("marshal capture record error %v", err)
+		return
+	}
+	if err = c.file.Write(append(b, '\n')); err != nil {
+		log.Warningf("write capture file error %s", errors.ErrorStack(err))
+	}
+}
+
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	return errors.Trace(c.file.Close())
+}
+
+// CaptureFiles returns the rotated files of a session log followed by the
+// file itself if it exists, the oldest first.
+func CaptureFiles(file string) ([]string, error) {
+	return logFiles(file)
+}
+
+// CaptureReader reads the records of a session log.
+type CaptureReader struct {
+	r      *bufio.Reader
+	Header CaptureHeader
+}
+
+// NewCaptureReader reads the header, the files of newer versions are rejected.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	cr := &CaptureReader{r: bufio.NewReader(r)}
+	line, err := cr.r.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.Errorf("read session log header error %v", err)
+	}
+	if err = json.Unmarshal(line, &cr.Header); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if cr.Header.Format != CaptureFormat {
+		return nil, errors.Errorf("not a session log, format %q", cr.Header.Format)
+	}
+	if cr.Header.Version > CaptureVersion {
+		return nil, errors.Errorf("session log version %d is newer than %d", cr.Header.Version, CaptureVersion)
+	}
+	return cr, nil
+}
+
+// Next returns the next record, io.EOF at the end. A truncated last line,
+// left by a crash while writing, is treated as the end.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	line, err := cr.r.ReadBytes('\n')
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rec := new(CaptureRecord)
+	if err = json.Unmarshal(line, rec); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return rec, nil
+}
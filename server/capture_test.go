@@ -0,0 +1,146 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/arena"
+	"github.com/ngaut/tokenlimiter"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testCaptureSuite{})
+
+type testCaptureSuite struct {
+}
+
+// discardConn is a connection dropping everything written to it.
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func newCaptureConn(capture *Capture, ctx IContext) *ClientConn {
+	return &ClientConn{
+		pkg:          NewPacketIO(discardConn{}),
+		server:       &Server{concurrentLimiter: tokenlimiter.NewTokenLimiter(1), rwlock: &sync.RWMutex{}, capture: capture},
+		capability:   DefaultCapability,
+		connectionId: 7,
+		alloc:        arena.NewArenaAllocator(1024),
+		ctx:          ctx,
+	}
+}
+
+func readCapture(c *C, file string) []*CaptureRecord {
+	f, err := os.Open(file)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	cr, err := NewCaptureReader(f)
+	c.Assert(err, IsNil)
+	c.Assert(cr.Header.Version, Equals, CaptureVersion)
+	var records []*CaptureRecord
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return records
+		}
+		c.Assert(err, IsNil)
+		records = append(records, rec)
+	}
+}
+
+func (s *testCaptureSuite) TestCapture(c *C) {
+	file := filepath.Join(c.MkDir(), "session.log")
+	capture, err := OpenCapture(etc.Capture{File: file})
+	c.Assert(err, IsNil)
+	fc := newFakeContext()
+	cc := newCaptureConn(capture, fc)
+
+	fc.rs = &ResultSet{Columns: []*ColumnInfo{{Name: "a", Type: TypeLonglong}}, Rows: [][]interface{}{{int64(1)}}}
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select 1"...)), IsNil)
+	fc.rs, fc.err = nil, errors.Trace(NewError(ErNoSuchTable, "no such table"))
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select * from t"...)), NotNil)
+	fc.err = nil
+	c.Assert(cc.dispatch(append([]byte{ComStmtPrepare}, "insert into t values (?)"...)), IsNil)
+	c.Assert(cc.dispatch([]byte{ComStmtExecute, 1, 0, 0, 0, 0, 1, 0, 0, 0}), IsNil)
+	c.Assert(cc.dispatch([]byte{ComStmtClose, 1, 0, 0, 0}), IsNil)
+	c.Assert(cc.record, IsNil)
+	c.Assert(capture.Close(), IsNil)
+
+	records := readCapture(c, file)
+	c.Assert(records, HasLen, 5)
+	c.Assert(records[0].Conn, Equals, uint32(7))
+	c.Assert(records[0].Cmd, Equals, CaptureQuery)
+	c.Assert(records[0].SQL, Equals, "select 1")
+	c.Assert(records[0].Result.Kind, Equals, "rows")
+	c.Assert(records[0].Result.Rows, Equals, 1)
+	c.Assert(records[0].Result.Digest, Equals, resultDigest(&ResultSet{Columns: []*ColumnInfo{{Name: "a", Type: TypeLonglong}}, Rows: [][]interface{}{{[]byte("1")}}}))
+	c.Assert(records[1].Result.Kind, Equals, "error")
+	c.Assert(records[1].Result.Code, Equals, uint16(ErNoSuchTable))
+	c.Assert(records[2].Cmd, Equals, CapturePrepare)
+	c.Assert(records[2].StmtID, Equals, 1)
+	c.Assert(records[3].Cmd, Equals, CaptureExecute)
+	c.Assert(records[3].StmtID, Equals, 1)
+	c.Assert(records[3].Result.Kind, Equals, "ok")
+	c.Assert(records[4].Cmd, Equals, CaptureCloseStmt)
+	c.Assert(records[4].Result, IsNil)
+
+	// appending to an existing file keeps a single header.
+	capture, err = OpenCapture(etc.Capture{File: file})
+	c.Assert(err, IsNil)
+	capture.Write(&CaptureRecord{Conn: 8, Cmd: CapturePing})
+	capture.Close()
+	c.Assert(readCapture(c, file), HasLen, 6)
+}
+
+func (s *testCaptureSuite) TestCaptureValues(c *C) {
+	args := []interface{}{nil, int64(-1), uint64(1 << 63), 1.5, "a", []byte{0, 0xff}}
+	for i, v := range captureArgs(args) {
+		arg, err := v.Interface()
+		c.Assert(err, IsNil)
+		c.Assert(arg, DeepEquals, args[i])
+	}
+	_, err := CaptureValue{Type: "time"}.Interface()
+	c.Assert(err, NotNil)
+
+	rec := newCaptureRecord(1, ComStmtSendLongData, []byte{2, 0, 0, 0, 1, 0, 'x'})
+	c.Assert(rec.Cmd, Equals, CaptureLongData)
+	c.Assert(rec.StmtID, Equals, 2)
+	c.Assert(rec.Param, Equals, 1)
+	c.Assert(rec.Args, DeepEquals, []CaptureValue{newCaptureValue([]byte("x"))})
+	c.Assert(newCaptureRecord(1, ComSleep, nil).Cmd, Equals, "cmd_0")
+}
+
+func (s *testCaptureSuite) TestCaptureRotate(c *C) {
+	file := filepath.Join(c.MkDir(), "session.log")
+	capture, err := OpenCapture(etc.Capture{File: file, MaxSize: 1, MaxFiles: 2})
+	c.Assert(err, IsNil)
+	for i := 0; i < 5; i++ {
+		capture.Write(&CaptureRecord{Conn: uint32(i), Cmd: CapturePing})
+	}
+	capture.Close()
+	files, err := CaptureFiles(file)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 3)
+	c.Assert(files[2], Equals, file)
+	// every file starts with a header.
+	for _, f := range files {
+		c.Assert(readCapture(c, f), HasLen, 1)
+	}
+
+	f, err := os.Create(file)
+	c.Assert(err, IsNil)
+	f.WriteString(`{"format":"mp-session-log","version":2}` + "\n")
+	f.Close()
+	f, _ = os.Open(file)
+	defer f.Close()
+	_, err = NewCaptureReader(f)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// parseAdminStatement parses the admin statements of combo mode,
+// "SHOW MP <name> [args...]", they are answered by mp and never sent to the
+// backends:
+//
+//	SHOW MP LATENCY                  the latency report
+//	SHOW MP SHADOW                   the counters of shadow mode
+//	SHOW MP SCHEMADIFF [db, ...]     the schema differences of the backends
+//
+// "SHOW MP TRACE" is answered by the client connection in every mode, see Tracer.admin.
+func parseAdminStatement(sql string) (name string, args []string, ok bool) {
+	toks := lexSQL(sql)
+	if len(toks) < 3 || !toks[0].is(sql, "show") || !toks[1].is(sql, "mp") || toks[2].kind != tokIdent {
+		return "", nil, false
+	}
+	for _, tok := range toks[3:] {
+		if tok.is(sql, ";") {
+			break
+		}
+		args = append(args, tok.text(sql))
+	}
+	return toks[2].lower(sql), args, true
+}
+
+// handleAdmin returns the result of sql if it is an admin statement.
+func (cd *ComboDriver) handleAdmin(sql string) (*ResultSet, bool, error) {
+	name, args, ok := parseAdminStatement(sql)
+	if !ok {
+		return nil, false, nil
+	}
+	if cd == nil {
+		cd = &ComboDriver{}
+	}
+	switch name {
+	case "latency":
+		if cd.Latency == nil {
+			return nil, true, errors.New("latency comparison is not enabled")
+		}
+		return cd.Latency.resultSet(), true, nil
+	case "shadow":
+		if cd.Shadow == nil {
+			return nil, true, errors.New("shadow mode is not enabled")
+		}
+		return cd.Shadow.resultSet(), true, nil
+	case "schemadiff":
+		if cd.mysqlDriver == nil || cd.tidbDriver == nil {
+			return nil, true, errors.New("schema diff needs both backends")
+		}
+		var dbs []string
+		for _, arg := range args {
+			if arg != "," {
+				dbs = append(dbs, unquoteIdent(arg))
+			}
+		}
+		report, err := cd.DiffSchemas(dbs)
+		if err != nil {
+			return nil, true, errors.Trace(err)
+		}
+		return report.resultSet(), true, nil
+	}
+	return nil, true, errors.Errorf("unknown admin statement SHOW MP %s", strings.ToUpper(name))
+}
+
+// newAdminResultSet returns an empty result set with text columns.
+func newAdminResultSet(names ...string) *ResultSet {
+	rs := &ResultSet{}
+	for _, name := range names {
+		rs.Columns = append(rs.Columns, &ColumnInfo{
+			Schema:       "mp",
+			Name:         name,
+			OrgName:      name,
+			ColumnLength: 255,
+			Charset:      uint16(CharsetIDs["utf8"]),
+			Type:         TypeVarString,
+		})
+	}
+	return rs
+}
@@ -0,0 +1,555 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+const (
+	// ChecksumNone never verifies the written tables.
+	ChecksumNone = ""
+	// ChecksumFull compares all the rows of the written tables.
+	ChecksumFull = "full"
+	// ChecksumSample compares the rows of a random primary key range.
+	ChecksumSample = "sample"
+)
+
+// CheckChecksum returns an error if mode is not a checksum mode.
+func CheckChecksum(mode string) error {
+	switch mode {
+	case ChecksumNone, ChecksumFull, ChecksumSample:
+		return nil
+	}
+	return errors.Errorf("unknown checksum mode %q", mode)
+}
+
+// ChecksumConfig configures the verification of table contents in combo mode.
+// After a write commits, the tables written in the transaction are queued to
+// a worker of the session, which reads them from both backends and compares
+// them row by row, off the request path. The tables are dropped when the
+// queue is full, or when they were verified less than Interval ago.
+//
+// The rows are read in pages by primary key ranges, so neither the backends
+// nor mp ever scan or hold a whole table at once. The tables without a
+// primary key are compared by row count only.
+//
+// The tables are read on dedicated connections, so the session state seen by
+// the client is not changed, but concurrent writes of other clients, or of
+// the session itself while the worker reads, may cause false alarms.
+type ChecksumConfig struct {
+	// Query reads the rows of a table, %s is replaced by the quoted table name.
+	// The rows should be ordered, they are read at once, so it should bound
+	// them. The rows are keyed by the primary key columns it returns, or by all
+	// its columns if it doesn't return them all.
+	Query string
+	// SampleSize is the number of rows in a random primary key range to
+	// compare, zero means comparing all rows. It is ignored if Query is set.
+	SampleSize int
+	// MaxKeys is the max number of differing primary keys to report.
+	MaxKeys int
+	// Interval is the min interval between the verifications of a table,
+	// zero means the default.
+	Interval time.Duration
+
+	mu      sync.Mutex
+	checked map[string]time.Time // table : last queued time
+}
+
+const (
+	defaultChecksumMaxKeys   = 5
+	defaultChecksumQueueSize = 64
+	defaultChecksumInterval  = 10 * time.Second
+	checksumPageSize         = 1000
+)
+
+// due reports whether table should be verified now, and marks it as verified if so.
+func (cfg *ChecksumConfig) due(table string) bool {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultChecksumInterval
+	}
+	now := time.Now()
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if cfg.checked == nil {
+		cfg.checked = make(map[string]time.Time)
+	}
+	if last, ok := cfg.checked[table]; ok && now.Sub(last) < interval {
+		return false
+	}
+	cfg.checked[table] = now
+	return true
+}
+
+// tableChecksum is the digest of the rows read from a table.
+type tableChecksum struct {
+	digest string
+	count  int
+	keys   []string          // primary keys in the read order
+	rows   map[string]string // primary key : row digest
+}
+
+// newTableChecksum digests the rows of rs keyed by the columns named keyNames.
+func newTableChecksum(rs *ResultSet, keyNames []string) *tableChecksum {
+	keyColumns := checksumKeyColumns(rs.Columns, keyNames)
+	sum := &tableChecksum{rows: make(map[string]string)}
+	total := sha1.New()
+	for _, row := range rs.Rows {
+		var rowBuf, keyBuf bytes.Buffer
+		for i, value := range row {
+			v := checksumValue(rs.Columns[i], value)
+			rowBuf.WriteString(v)
+			rowBuf.WriteByte(0)
+			for _, k := range keyColumns {
+				if k == i {
+					if keyBuf.Len() > 0 {
+						keyBuf.WriteString(", ")
+					}
+					keyBuf.WriteString(v)
+				}
+			}
+		}
+		rowDigest := sha1.Sum(rowBuf.Bytes())
+		total.Write(rowDigest[:])
+		key := keyBuf.String()
+		if _, ok := sum.rows[key]; !ok {
+			sum.keys = append(sum.keys, key)
+		}
+		sum.rows[key] = hex.EncodeToString(rowDigest[:])
+	}
+	sum.digest = hex.EncodeToString(total.Sum(nil))
+	sum.count = len(rs.Rows)
+	return sum
+}
+
+// checksumKeyColumns returns the indexes of the columns named keyNames, all
+// the columns are the key if one of them is missing.
+func checksumKeyColumns(columns []*ColumnInfo, keyNames []string) []int {
+	var keyColumns []int
+	for _, name := range keyNames {
+		found := false
+		for i, col := range columns {
+			if strings.EqualFold(col.Name, name) {
+				keyColumns, found = append(keyColumns, i), true
+				break
+			}
+		}
+		if !found {
+			keyColumns = nil
+			break
+		}
+	}
+	if len(keyColumns) == 0 {
+		for i := range columns {
+			keyColumns = append(keyColumns, i)
+		}
+	}
+	return keyColumns
+}
+
+// checksumValue formats value as the text protocol does, so values of
+// different go types returned by the backends are compared as the client sees them.
+func checksumValue(col *ColumnInfo, value interface{}) string {
+	if value == nil {
+		return "NULL"
+	}
+	b, err := dumpTextValue(col.Type, value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
+
+// diffKeys returns at most max primary keys whose rows differ.
+func (sum *tableChecksum) diffKeys(other *tableChecksum, max int) (keys []string) {
+	for _, key := range sum.keys {
+		if len(keys) >= max {
+			return
+		}
+		if sum.rows[key] != other.rows[key] {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range other.keys {
+		if len(keys) >= max {
+			return
+		}
+		if _, ok := sum.rows[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// trackWrite collects the tables written by sql, and queues them to be
+// verified once the transaction is committed.
+func (cc *ComboContext) trackWrite(sql string, errs [2]error) {
+	if cc.checksum == nil {
+		return
+	}
+	if sqlCommand(sql) == "rollback" {
+		cc.pendingTables = nil
+		return
+	}
+	if errs[0] == nil && errs[1] == nil {
+		if table := writeTable(sql); table != "" {
+			if !strings.Contains(table, ".") {
+				if cc.db == "" {
+					return
+				}
+				table = cc.db + "." + table
+			}
+			if cc.pendingTables == nil {
+				cc.pendingTables = make(map[string]bool)
+			}
+			cc.pendingTables[table] = true
+		}
+	}
+	if len(cc.pendingTables) > 0 && cc.Status()&ServerStatusInTrans == 0 {
+		if cc.checksumWorker == nil {
+			cc.checksumWorker = newChecksumWorker(cc)
+		}
+		for table := range cc.pendingTables {
+			if cc.checksum.due(table) {
+				cc.checksumWorker.enqueue(&checksumTask{sql: sql, table: table})
+			}
+		}
+		cc.pendingTables = nil
+	}
+}
+
+type checksumTask struct {
+	sql   string // the statement committing the write
+	table string
+}
+
+// checksumWorker verifies the tables written by a session on its own connections.
+type checksumWorker struct {
+	cfg        *ChecksumConfig
+	driver     *ComboDriver
+	rules      *DiffRuleSet
+	capability uint32
+	collation  uint8
+	ctx        [2]IContext
+
+	mu     sync.Mutex
+	queue  chan *checksumTask
+	closed bool
+}
+
+func newChecksumWorker(cc *ComboContext) *checksumWorker {
+	w := &checksumWorker{
+		cfg:        cc.checksum,
+		driver:     cc.driver,
+		rules:      cc.rules,
+		capability: cc.capability,
+		collation:  cc.collation,
+		queue:      make(chan *checksumTask, defaultChecksumQueueSize),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues the task without blocking, the task is dropped if the queue
+// is full or the worker is closed.
+func (w *checksumWorker) enqueue(task *checksumTask) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- task:
+	default:
+		log.Warningf("checksum queue full, skip verifying table %s", task.table)
+	}
+}
+
+// close stops the worker after the queued tables are verified.
+func (w *checksumWorker) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+}
+
+func (w *checksumWorker) run() {
+	for task := range w.queue {
+		w.verifyTable(task.sql, task.table)
+	}
+	for _, ctx := range w.ctx {
+		if ctx != nil {
+			ctx.Close()
+		}
+	}
+}
+
+// contexts opens the connections used to read the tables.
+func (w *checksumWorker) contexts() (mc, tc IContext, err error) {
+	for i, driver := range []IDriver{w.driver.mysqlDriver, w.driver.tidbDriver} {
+		if w.ctx[i] == nil {
+			if w.ctx[i], err = driver.OpenCtx(w.capability, w.collation, ""); err != nil {
+				return
+			}
+		}
+	}
+	return w.ctx[0], w.ctx[1], nil
+}
+
+func (w *checksumWorker) verifyTable(sql, table string) {
+	mc, tc, err := w.contexts()
+	if err != nil {
+		log.Warningf("open checksum connection error %v", err)
+		return
+	}
+	quoted := quoteTableName(table)
+	keys, columns, err := checksumColumns(mc, quoted)
+	if err != nil {
+		log.Warningf("checksum table %s error %v", table, err)
+		return
+	}
+	var msg string
+	switch {
+	case w.cfg.Query != "":
+		keyNames := columnNames(keys)
+		if len(keyNames) == 0 {
+			keyNames = columnNames(columns)
+		}
+		msg, err = w.verifyQuery(mc, tc, fmt.Sprintf(w.cfg.Query, quoted), keyNames)
+	case len(keys) == 0:
+		msg, err = verifyCount(mc, tc, quoted)
+	default:
+		msg, err = w.verifyPages(mc, tc, quoted, keys)
+	}
+	if err != nil {
+		log.Warningf("checksum table %s error %v", table, err)
+		return
+	}
+	if msg == "" {
+		return
+	}
+	diff := &Diff{
+		Field:  "Checksum",
+		Column: table,
+		Msg:    fmt.Sprintf("table %s content differs, %s", table, msg),
+	}
+	w.rules.report("checksum after "+sql, sql, []*Diff{diff}, [2]error{})
+}
+
+func (w *checksumWorker) maxKeys() int {
+	if w.cfg.MaxKeys <= 0 {
+		return defaultChecksumMaxKeys
+	}
+	return w.cfg.MaxKeys
+}
+
+// verifyQuery compares the rows read by query, it returns the difference, or
+// empty if they match.
+func (w *checksumWorker) verifyQuery(mc, tc IContext, query string, keyNames []string) (string, error) {
+	mrs, trs, err := executeChecksum(mc, tc, query, query)
+	if err != nil {
+		return "", err
+	}
+	mSum, tSum := newTableChecksum(mrs, keyNames), newTableChecksum(trs, keyNames)
+	if mSum.digest == tSum.digest {
+		return "", nil
+	}
+	return fmt.Sprintf("expect %d rows digest %s, got %d rows digest %s, first differing keys [%s]",
+		mSum.count, mSum.digest, tSum.count, tSum.digest, strings.Join(mSum.diffKeys(tSum, w.maxKeys()), "] [")), nil
+}
+
+// verifyPages compares the rows of table page by page in primary key order.
+// A page of mysql is read after the last key of the previous one, the page
+// of tidb is read in the same key range, so both backends only read an index
+// range. In sample mode, a single page after a random key is compared.
+func (w *checksumWorker) verifyPages(mc, tc IContext, table string, keys []*ColumnInfo) (string, error) {
+	keyNames := columnNames(keys)
+	pageSize := checksumPageSize
+	var after []interface{}
+	if w.cfg.SampleSize > 0 {
+		pageSize = w.cfg.SampleSize
+		after = sampleKey(mc, table, keys)
+	}
+	var diffKeys []string
+	var mCount, tCount int
+	for {
+		var cond []string
+		if after != nil {
+			cond = append(cond, keyCondition(keyNames, after, ">", ">"))
+		}
+		mQuery := pageQuery(table, keyNames, cond, pageSize)
+		mrs, err := mc.Execute(mQuery)
+		if err != nil || mrs == nil {
+			return "", fmt.Errorf("checksum query %s error %v", mQuery, err)
+		}
+		full := len(mrs.Rows) == pageSize
+		var last []interface{}
+		if full {
+			last = rowKey(mrs, keyNames, len(mrs.Rows)-1)
+			cond = append(cond, keyCondition(keyNames, last, "<", "<="))
+		}
+		// one more row than a page, so extra rows of tidb are always seen.
+		tQuery := pageQuery(table, keyNames, cond, pageSize+1)
+		trs, err := tc.Execute(tQuery)
+		if err != nil || trs == nil {
+			return "", fmt.Errorf("checksum query %s error %v", tQuery, err)
+		}
+		mSum, tSum := newTableChecksum(mrs, keyNames), newTableChecksum(trs, keyNames)
+		mCount, tCount = mCount+mSum.count, tCount+tSum.count
+		if mSum.digest != tSum.digest {
+			diffKeys = append(diffKeys, mSum.diffKeys(tSum, w.maxKeys()-len(diffKeys))...)
+		}
+		if !full || len(diffKeys) >= w.maxKeys() || w.cfg.SampleSize > 0 {
+			break
+		}
+		after = last
+	}
+	if len(diffKeys) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("expect %d rows, got %d rows in the compared key range, first differing keys [%s]",
+		mCount, tCount, strings.Join(diffKeys, "] [")), nil
+}
+
+// verifyCount compares the row counts of a table without a primary key.
+func verifyCount(mc, tc IContext, table string) (string, error) {
+	query := "SELECT COUNT(*) FROM " + table
+	mrs, trs, err := executeChecksum(mc, tc, query, query)
+	if err != nil {
+		return "", err
+	}
+	mCount, tCount := firstValue(mrs), firstValue(trs)
+	if mCount == tCount {
+		return "", nil
+	}
+	return fmt.Sprintf("expect %s rows, got %s rows", mCount, tCount), nil
+}
+
+func executeChecksum(mc, tc IContext, mQuery, tQuery string) (mrs, trs *ResultSet, err error) {
+	mrs, merr := mc.Execute(mQuery)
+	trs, terr := tc.Execute(tQuery)
+	if merr != nil || terr != nil || mrs == nil || trs == nil {
+		return nil, nil, fmt.Errorf("checksum query %s error, mysql %v, tidb %v", mQuery, merr, terr)
+	}
+	return mrs, trs, nil
+}
+
+// firstValue returns the first value of rs as a string.
+func firstValue(rs *ResultSet) string {
+	if len(rs.Rows) == 0 || len(rs.Rows[0]) == 0 {
+		return ""
+	}
+	return fmt.Sprint(valueString(rs.Rows[0][0]))
+}
+
+// checksumColumns returns the primary key columns and all the columns of table.
+func checksumColumns(ctx IContext, table string) (keys, columns []*ColumnInfo, err error) {
+	rs, err := ctx.Execute(fmt.Sprintf("SELECT * FROM %s LIMIT 0", table))
+	if err != nil {
+		return nil, nil, err
+	}
+	if rs == nil {
+		return nil, nil, fmt.Errorf("no columns")
+	}
+	for _, col := range rs.Columns {
+		if col.Flag&PriKeyFlag > 0 {
+			keys = append(keys, col)
+		}
+	}
+	return keys, rs.Columns, nil
+}
+
+func columnNames(columns []*ColumnInfo) []string {
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// pageQuery returns the query reading at most limit rows of table matching
+// cond in the order of keyNames.
+func pageQuery(table string, keyNames []string, cond []string, limit int) string {
+	quoted := make([]string, len(keyNames))
+	for i, name := range keyNames {
+		quoted[i] = quoteIdent(name)
+	}
+	query := "SELECT * FROM " + table
+	if len(cond) > 0 {
+		query += " WHERE " + strings.Join(cond, " AND ")
+	}
+	return fmt.Sprintf("%s ORDER BY %s LIMIT %d", query, strings.Join(quoted, ", "), limit)
+}
+
+// keyCondition returns the condition comparing the keys with values in the
+// order of keyNames, op compares the leading columns and lastOp the last one.
+// With ">" and ">" it matches the keys after values, with "<" and "<=" the
+// keys up to values.
+func keyCondition(keyNames []string, values []interface{}, op, lastOp string) string {
+	last := len(keyNames) - 1
+	cond := fmt.Sprintf("%s %s %s", quoteIdent(keyNames[last]), lastOp, sqlLiteral(values[last]))
+	for i := last - 1; i >= 0; i-- {
+		name, value := quoteIdent(keyNames[i]), sqlLiteral(values[i])
+		cond = fmt.Sprintf("(%s %s %s OR (%s = %s AND %s))", name, op, value, name, value, cond)
+	}
+	return cond
+}
+
+// rowKey returns the values of the key columns of the i-th row of rs.
+func rowKey(rs *ResultSet, keyNames []string, i int) []interface{} {
+	var values []interface{}
+	for _, k := range checksumKeyColumns(rs.Columns, keyNames) {
+		values = append(values, rs.Rows[i][k])
+	}
+	return values
+}
+
+// sampleKey returns a random key to start sampling after, nil to start from
+// the first row. Only a single integer key is sampled at random.
+func sampleKey(ctx IContext, table string, keys []*ColumnInfo) []interface{} {
+	if len(keys) != 1 {
+		return nil
+	}
+	switch keys[0].Type {
+	case TypeTiny, TypeShort, TypeInt24, TypeLong, TypeLonglong:
+	default:
+		return nil
+	}
+	name := quoteIdent(keys[0].Name)
+	rs, err := ctx.Execute(fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", name, name, table))
+	if err != nil || rs == nil || len(rs.Rows) == 0 || len(rs.Rows[0]) < 2 {
+		return nil
+	}
+	min, err1 := strconv.ParseInt(fmt.Sprint(valueString(rs.Rows[0][0])), 10, 64)
+	max, err2 := strconv.ParseInt(fmt.Sprint(valueString(rs.Rows[0][1])), 10, 64)
+	if err1 != nil || err2 != nil || max <= min || max-min+1 <= 0 {
+		return nil
+	}
+	return []interface{}{min - 1 + rand.Int63n(max-min+1)}
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// quoteTableName quotes every part of a qualified table name.
+func quoteTableName(table string) string {
+	parts := strings.SplitN(table, ".", 2)
+	for i := range parts {
+		parts[i] = quoteIdent(parts[i])
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"time"
+
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testChecksumSuite{})
+
+type testChecksumSuite struct {
+}
+
+func (s *testChecksumSuite) TestTableChecksum(c *C) {
+	c.Assert(writeTable("insert ignore into `test`.`t` values (1)"), Equals, "test.t")
+	c.Assert(writeTable("REPLACE t1 (a) values (1)"), Equals, "t1")
+	c.Assert(writeTable("update low_priority t set a = 1"), Equals, "t")
+	c.Assert(writeTable("delete from t where a = 1"), Equals, "t")
+	c.Assert(writeTable("select * from t"), Equals, "")
+	c.Assert(useDB("use `gotest`"), Equals, "gotest")
+	c.Assert(quoteTableName("test.t"), Equals, "`test`.`t`")
+
+	columns := []*ColumnInfo{{Name: "id", Type: TypeLonglong, Flag: PriKeyFlag}, {Name: "v", Type: TypeVarchar}}
+	mSum := newTableChecksum(&ResultSet{Columns: columns, Rows: [][]interface{}{
+		{int64(1), "a"}, {int64(2), "b"}, {int64(3), "c"},
+	}}, []string{"id"})
+	tSum := newTableChecksum(&ResultSet{Columns: columns, Rows: [][]interface{}{
+		{int64(1), []byte("a")}, {int64(2), "x"}, {int64(4), "d"},
+	}}, []string{"id"})
+	c.Assert(mSum.digest, Not(Equals), tSum.digest)
+	c.Assert(mSum.diffKeys(tSum, 5), DeepEquals, []string{"2", "3", "4"})
+	c.Assert(mSum.diffKeys(tSum, 1), DeepEquals, []string{"2"})
+
+	// the key columns are found by name in the rows read by a custom query.
+	reordered := []*ColumnInfo{columns[1], columns[0]}
+	query := "SELECT v, id FROM `test`.`t` ORDER BY id"
+	mc := &scriptedContext{fakeContext: newFakeContext(), results: map[string]*ResultSet{
+		query: {Columns: reordered, Rows: [][]interface{}{{"a", int64(1)}, {"b", int64(2)}}},
+	}}
+	tc := &scriptedContext{fakeContext: newFakeContext(), results: map[string]*ResultSet{
+		query: {Columns: reordered, Rows: [][]interface{}{{"a", int64(1)}, {"x", int64(2)}}},
+	}}
+	w := &checksumWorker{cfg: &ChecksumConfig{}}
+	msg, err := w.verifyQuery(mc, tc, query, []string{"id"})
+	c.Assert(err, IsNil)
+	c.Assert(msg, Matches, `expect 2 rows digest .*, got 2 rows digest .*, first differing keys \[2\]`)
+	// all columns are the key if the query doesn't return the key.
+	c.Assert(checksumKeyColumns(columns[1:], []string{"id"}), DeepEquals, []int{0})
+}
+
+func (s *testChecksumSuite) TestChecksumPages(c *C) {
+	c.Assert(keyCondition([]string{"a", "b"}, []interface{}{int64(1), "x"}, ">", ">"), Equals, "(`a` > 1 OR (`a` = 1 AND `b` > 'x'))")
+	c.Assert(keyCondition([]string{"a"}, []interface{}{int64(1)}, "<", "<="), Equals, "`a` <= 1")
+
+	// the page of tidb is read up to the last key of the page of mysql.
+	keys := []*ColumnInfo{{Name: "id", Type: TypeVarchar, Flag: PriKeyFlag}}
+	columns := []*ColumnInfo{keys[0], {Name: "v", Type: TypeVarchar}}
+	mc := &scriptedContext{fakeContext: newFakeContext(), results: map[string]*ResultSet{
+		"SELECT * FROM `test`.`t` ORDER BY `id` LIMIT 2": {Columns: columns, Rows: [][]interface{}{{"a", "1"}, {"b", "2"}}},
+	}}
+	tc := &scriptedContext{fakeContext: newFakeContext(), results: map[string]*ResultSet{
+		"SELECT * FROM `test`.`t` WHERE `id` <= 'b' ORDER BY `id` LIMIT 3": {Columns: columns, Rows: [][]interface{}{{"a", "1"}, {"b", "x"}}},
+	}}
+	w := &checksumWorker{cfg: &ChecksumConfig{SampleSize: 2}}
+	msg, err := w.verifyPages(mc, tc, "`test`.`t`", keys)
+	c.Assert(err, IsNil)
+	c.Assert(msg, Equals, "expect 2 rows, got 2 rows in the compared key range, first differing keys [b]")
+
+	// the last page of mysql isn't full, the rest of tidb is read.
+	w.cfg.SampleSize = 0
+	mc.results = map[string]*ResultSet{
+		"SELECT * FROM `test`.`t` ORDER BY `id` LIMIT 1000": {Columns: columns, Rows: [][]interface{}{{"a", "1"}}},
+	}
+	tc.results = map[string]*ResultSet{
+		"SELECT * FROM `test`.`t` ORDER BY `id` LIMIT 1001": {Columns: columns, Rows: [][]interface{}{{"a", "1"}}},
+	}
+	msg, err = w.verifyPages(mc, tc, "`test`.`t`", keys)
+	c.Assert(err, IsNil)
+	c.Assert(msg, Equals, "")
+
+	// the tables without a primary key are compared by count.
+	mc.results = map[string]*ResultSet{"SELECT COUNT(*) FROM `t`": {Rows: [][]interface{}{{[]byte("3")}}}}
+	tc.results = map[string]*ResultSet{"SELECT COUNT(*) FROM `t`": {Rows: [][]interface{}{{int64(2)}}}}
+	msg, err = verifyCount(mc, tc, "`t`")
+	c.Assert(err, IsNil)
+	c.Assert(msg, Equals, "expect 3 rows, got 2 rows")
+
+	cfg := &ChecksumConfig{Interval: time.Hour}
+	c.Assert(cfg.due("test.t"), Equals, true)
+	c.Assert(cfg.due("test.t"), Equals, false)
+	c.Assert(cfg.due("test.t2"), Equals, true)
+}
+
+func (s *testChecksumSuite) TestChecksumWorker(c *C) {
+	cc, mc, tc := newFakeComboContext(false)
+	cc.driver = &ComboDriver{mysqlDriver: &fakeDriver{newFakeContext()}, tidbDriver: &fakeDriver{newFakeContext()}}
+	cc.checksum = &ChecksumConfig{}
+	cc.db = "test"
+	cc.trackWrite("insert into t values (1)", [2]error{})
+	c.Assert(cc.pendingTables, HasLen, 0)
+	c.Assert(cc.checksumWorker, NotNil)
+	// the client's connections are never used to verify the tables.
+	c.Assert(mc.executed, HasLen, 0)
+	c.Assert(tc.executed, HasLen, 0)
+	cc.Close()
+	cc.Close()
+	cc.trackWrite("insert into t values (2)", [2]error{})
+}
+
+func (s *testChecksumSuite) TestCheckChecksum(c *C) {
+	c.Assert(CheckChecksum(ChecksumNone), IsNil)
+	c.Assert(CheckChecksum(ChecksumSample), IsNil)
+	c.Assert(CheckChecksum("ful"), ErrorMatches, `unknown checksum mode "ful"`)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/ngaut/log"
+)
+
+// sideEffectFuncs are the functions with side effects, some versions of
+// mysql evaluate the derived tables and constant subqueries when explaining,
+// so the statements calling them are never explained.
+var sideEffectFuncs = map[string]bool{
+	"get_lock":          true,
+	"release_lock":      true,
+	"release_all_locks": true,
+	"sleep":             true,
+	"benchmark":         true,
+	"last_insert_id":    true,
+	"master_pos_wait":   true,
+	"load_file":         true,
+	"nextval":           true,
+	"setval":            true,
+}
+
+// explainable reports whether sql is a SELECT which can be explained
+// without side effects.
+func explainable(sql string) bool {
+	if sqlCommand(sql) != "select" {
+		return false
+	}
+	toks := lexSQL(sql)
+	for i, tok := range toks {
+		switch {
+		case tok.is(sql, ":") && i+1 < len(toks) && toks[i+1].is(sql, "="):
+			// assignment to a user variable
+			return false
+		case tok.kind != tokIdent:
+		case tok.is(sql, "into"):
+			// SELECT ... INTO OUTFILE or @var
+			return false
+		case sideEffectFuncs[tok.lower(sql)] && i+1 < len(toks) && toks[i+1].is(sql, "("):
+			return false
+		}
+	}
+	return true
+}
+
+// bindArgs replaces the placeholders of a prepared statement with the literals of args.
+func bindArgs(sql string, args []interface{}) string {
+	if len(args) == 0 {
+		return sql
+	}
+	var buf bytes.Buffer
+	pos, n := 0, 0
+	for _, tok := range lexSQL(sql) {
+		if tok.kind == tokOther && tok.is(sql, "?") && n < len(args) {
+			buf.WriteString(sql[pos:tok.start])
+			buf.WriteString(sqlLiteral(args[n]))
+			pos = tok.end
+			n++
+		}
+	}
+	buf.WriteString(sql[pos:])
+	return buf.String()
+}
+
+// explainPlan returns the EXPLAIN output of sql on ctx as tab separated lines.
+func explainPlan(ctx IContext, sql string) string {
+	rs, err := ctx.Execute("EXPLAIN " + sql)
+	if err != nil {
+		return "error: " + toSQLError(err).Error()
+	}
+	if rs == nil {
+		return ""
+	}
+	var lines []string
+	names := make([]string, len(rs.Columns))
+	for i, col := range rs.Columns {
+		names[i] = col.Name
+	}
+	lines = append(lines, strings.Join(names, "\t"))
+	for _, row := range rs.Rows {
+		values := make([]string, len(row))
+		for i, value := range row {
+			values[i] = schemaValue(value)
+		}
+		lines = append(lines, strings.Join(values, "\t"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// verifyContexts opens the connections used to explain the statements.
+func (cc *ComboContext) verifyContexts() (mc, tc IContext, err error) {
+	if cc.verifyCtx[0] == nil {
+		cc.verifyCtx[0], err = cc.driver.mysqlDriver.OpenCtx(cc.capability, cc.collation, "")
+		if err != nil {
+			return
+		}
+	}
+	if cc.verifyCtx[1] == nil {
+		cc.verifyCtx[1], err = cc.driver.tidbDriver.OpenCtx(cc.capability, cc.collation, "")
+		if err != nil {
+			return
+		}
+	}
+	return cc.verifyCtx[0], cc.verifyCtx[1], nil
+}
+
+// explainCurrent returns the plans of the current statement on mysql and
+// tidb, ok is false if it can not be explained. The statement is explained
+// on dedicated connections, so the warnings and the affected rows the client
+// sees are kept.
+func (cc *ComboContext) explainCurrent() (plans [2]string, ok bool) {
+	if !cc.explain || cc.current == nil || !explainable(cc.current.sql) {
+		return plans, false
+	}
+	mc, tc, err := cc.verifyContexts()
+	if err != nil {
+		log.Warningf("open explain connection error %v", err)
+		return plans, false
+	}
+	sql := bindArgs(cc.current.sql, cc.current.args)
+	for i, ctx := range []IContext{mc, tc} {
+		if cc.db != "" {
+			if _, err = ctx.Execute("USE " + quoteIdent(cc.db)); err != nil {
+				plans[i] = "error: " + toSQLError(err).Error()
+				continue
+			}
+		}
+		plans[i] = explainPlan(ctx, sql)
+	}
+	return plans, true
+}
+
+// logExplain logs the plans of the current statement after it diverged, and
+// attaches them to its diffs in mp.diffs.
+func (cc *ComboContext) logExplain(diffs []*Diff) {
+	if plans, ok := cc.explainCurrent(); ok {
+		log.Warningf("plans of %s\nmysql:\n%s\ntidb:\n%s", cc.current.sql, plans[0], plans[1])
+		recentDiffs.setPlans(diffs, plans)
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testExplainSuite{})
+
+type testExplainSuite struct {
+}
+
+func (s *testExplainSuite) TestExplain(c *C) {
+	c.Assert(explainable("select * from t where a = ?"), Equals, true)
+	c.Assert(explainable("select sleep(1)"), Equals, false)
+	c.Assert(explainable("select @a := 1"), Equals, false)
+	c.Assert(explainable("select a into @b from t"), Equals, false)
+	c.Assert(explainable("select 'sleep(1)', `into` from t"), Equals, true)
+	c.Assert(explainable("update t set a = 1"), Equals, false)
+	c.Assert(bindArgs("select * from t where a = ? and b = '?'", []interface{}{int64(1)}), Equals, "select * from t where a = 1 and b = '?'")
+
+	cc, mc, _ := newFakeComboContext(false)
+	mem, tem := newFakeContext(), newFakeContext()
+	mem.rs = &ResultSet{Columns: []*ColumnInfo{{Name: "id"}, {Name: "table"}}, Rows: [][]interface{}{{int64(1), []byte("t")}}}
+	cc.driver = &ComboDriver{mysqlDriver: &fakeDriver{mem}, tidbDriver: &fakeDriver{tem}}
+	cc.explain = true
+	cc.db = "test"
+	cc.current = &reproStmt{sql: "select * from t where a = ?", args: []interface{}{"x"}, prepared: true}
+	plans, ok := cc.explainCurrent()
+	c.Assert(ok, Equals, true)
+	c.Assert(plans[0], Equals, "id\ttable\n1\tt")
+	c.Assert(mem.executed, DeepEquals, []string{"USE `test`", "EXPLAIN select * from t where a = 'x'"})
+	c.Assert(mc.executed, HasLen, 0)
+
+	// the plans are kept with the diffs of the statement.
+	diffs := []*Diff{{Field: "Rows", Msg: "explained"}}
+	recentDiffs.add(cc.current.sql, diffs, true)
+	cc.logExplain(diffs)
+	entries := recentDiffs.entries()
+	last := entries[len(entries)-1]
+	c.Assert(last.Diff, Equals, diffs[0])
+	c.Assert(last.plans[0], Equals, "id\ttable\n1\tt")
+}
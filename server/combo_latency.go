@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// LatencyConfig configures the latency comparison of combo mode. The latency
+// of every backend is aggregated per statement digest, the digests on which
+// tidb is Ratio times slower than mysql are reported.
+type LatencyConfig struct {
+	// Ratio is the min ratio of the mean tidb latency to the mean mysql latency to report.
+	Ratio float64
+	// MinCount is the min number of executions of a digest to report it.
+	MinCount int64
+	// File is the file the report is written to, empty means logging only.
+	File string
+	// Interval is the interval to report, zero means reporting on exit only.
+	Interval time.Duration
+}
+
+const (
+	defaultLatencyRatio = 2
+	// latencyBuckets is the number of histogram buckets, the upper bound of
+	// bucket i is 2^i microseconds, the last one holds everything slower.
+	latencyBuckets = 32
+)
+
+// latencyHistogram is a histogram with exponential buckets.
+type latencyHistogram struct {
+	buckets [latencyBuckets]int64
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for us := d / time.Microsecond; i < latencyBuckets-1 && us > 1<<uint(i); i++ {
+	}
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *latencyHistogram) mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// quantile returns the upper bound of the bucket holding the q quantile, at most the max latency.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(q*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			bound := time.Duration(1<<uint(i)) * time.Microsecond
+			if bound > h.max || i == latencyBuckets-1 {
+				return h.max
+			}
+			return bound
+		}
+	}
+	return h.max
+}
+
+type digestLatency struct {
+	sql  string // the normalized statement
+	hist [2]latencyHistogram
+	// the plans of mysql and tidb captured when the digest passed the threshold.
+	plans   [2]string
+	planned bool
+}
+
+// LatencyStats holds the latency histograms of both backends per statement digest.
+type LatencyStats struct {
+	cfg LatencyConfig
+
+	mu      sync.Mutex
+	digests map[string]*digestLatency
+}
+
+// LatencyReport is the latency comparison of a statement digest, the
+// durations are of mysql and tidb.
+type LatencyReport struct {
+	Digest string
+	SQL    string
+	Count  int64
+	Mean   [2]time.Duration
+	P50    [2]time.Duration
+	P99    [2]time.Duration
+	Max    [2]time.Duration
+	Ratio  float64
+	Plans  [2]string
+}
+
+func NewLatencyStats(cfg LatencyConfig) *LatencyStats {
+	if cfg.Ratio <= 0 {
+		cfg.Ratio = defaultLatencyRatio
+	}
+	return &LatencyStats{cfg: cfg, digests: make(map[string]*digestLatency)}
+}
+
+// record adds the latencies of mysql and tidb executing sql, it returns
+// true the first time the digest passes the threshold, so the caller can
+// capture the plans.
+func (ls *LatencyStats) record(sql string, latency [2]time.Duration) bool {
+	if ls == nil {
+		return false
+	}
+	normalized := normalizeSQL(sql)
+	digest := sqlDigest(normalized)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	dl, ok := ls.digests[digest]
+	if !ok {
+		dl = &digestLatency{sql: normalized}
+		ls.digests[digest] = dl
+	}
+	dl.hist[0].observe(latency[0])
+	dl.hist[1].observe(latency[1])
+	if dl.planned || dl.hist[0].count < ls.cfg.MinCount || dl.hist[0].mean() <= 0 {
+		return false
+	}
+	if float64(dl.hist[1].mean())/float64(dl.hist[0].mean()) < ls.cfg.Ratio {
+		return false
+	}
+	dl.planned = true
+	return true
+}
+
+// setPlans attaches the plans of mysql and tidb to the digest of sql.
+func (ls *LatencyStats) setPlans(sql string, plans [2]string) {
+	digest := sqlDigest(normalizeSQL(sql))
+	ls.mu.Lock()
+	if dl, ok := ls.digests[digest]; ok {
+		dl.plans = plans
+	}
+	ls.mu.Unlock()
+}
+
+// Report returns the digests passing the ratio threshold, the slowest first.
+func (ls *LatencyStats) Report() []*LatencyReport {
+	if ls == nil {
+		return nil
+	}
+	ls.mu.Lock()
+	var reports []*LatencyReport
+	for digest, dl := range ls.digests {
+		r := &LatencyReport{Digest: digest, SQL: dl.sql, Count: dl.hist[0].count, Plans: dl.plans}
+		for i := range dl.hist {
+			h := &dl.hist[i]
+			r.Mean[i], r.P50[i], r.P99[i], r.Max[i] = h.mean(), h.quantile(0.5), h.quantile(0.99), h.max
+		}
+		if r.Count < ls.cfg.MinCount || r.Mean[0] <= 0 {
+			continue
+		}
+		r.Ratio = float64(r.Mean[1]) / float64(r.Mean[0])
+		if r.Ratio >= ls.cfg.Ratio {
+			reports = append(reports, r)
+		}
+	}
+	ls.mu.Unlock()
+	sort.Sort(latencyReports(reports))
+	return reports
+}
+
+type latencyReports []*LatencyReport
+
+func (rs latencyReports) Len() int           { return len(rs) }
+func (rs latencyReports) Less(i, j int) bool { return rs[i].Ratio > rs[j].Ratio }
+func (rs latencyReports) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+
+func (r *LatencyReport) String() string {
+	s := fmt.Sprintf("digest %s ratio %.2f count %d mean %v/%v p50 %v/%v p99 %v/%v max %v/%v sql %s",
+		r.Digest, r.Ratio, r.Count, r.Mean[0], r.Mean[1], r.P50[0], r.P50[1], r.P99[0], r.P99[1], r.Max[0], r.Max[1], r.SQL)
+	if r.Plans[0] != "" || r.Plans[1] != "" {
+		s += fmt.Sprintf("\nmysql plan:\n%s\ntidb plan:\n%s", r.Plans[0], r.Plans[1])
+	}
+	return s
+}
+
+// LogReport logs the report and writes it to the file if configured.
+func (ls *LatencyStats) LogReport() {
+	if ls == nil {
+		return
+	}
+	reports := ls.Report()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# latency report at %s, tidb/mysql ratio >= %.2f, %d digests\n",
+		time.Now().Format(time.RFC3339), ls.cfg.Ratio, len(reports))
+	for _, r := range reports {
+		log.Warningf("slow on tidb: %s", r)
+		buf.WriteString(r.String())
+		buf.WriteByte('\n')
+	}
+	if ls.cfg.File != "" {
+		if err := ioutil.WriteFile(ls.cfg.File, buf.Bytes(), 0644); err != nil {
+			log.Warningf("write latency report error %s", errors.ErrorStack(err))
+		}
+	}
+}
+
+// Run reports periodically if an interval is configured, it never returns.
+func (ls *LatencyStats) Run() {
+	if ls.cfg.Interval <= 0 {
+		return
+	}
+	for range time.Tick(ls.cfg.Interval) {
+		ls.LogReport()
+	}
+}
+
+// resultSet returns the report as a result set for the admin statement.
+func (ls *LatencyStats) resultSet() *ResultSet {
+	rs := newAdminResultSet("digest", "sql", "count", "ratio",
+		"mysql_mean_us", "tidb_mean_us", "mysql_p50_us", "tidb_p50_us",
+		"mysql_p99_us", "tidb_p99_us", "mysql_max_us", "tidb_max_us", "mysql_plan", "tidb_plan")
+	us := func(d time.Duration) int64 { return int64(d / time.Microsecond) }
+	for _, r := range ls.Report() {
+		rs.AddRow(r.Digest, r.SQL, r.Count, fmt.Sprintf("%.2f", r.Ratio),
+			us(r.Mean[0]), us(r.Mean[1]), us(r.P50[0]), us(r.P50[1]),
+			us(r.P99[0]), us(r.P99[1]), us(r.Max[0]), us(r.Max[1]), r.Plans[0], r.Plans[1])
+	}
+	return rs
+}
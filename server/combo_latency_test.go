@@ -0,0 +1,50 @@
+package server
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testLatencySuite{})
+
+type testLatencySuite struct {
+}
+
+func (s *testLatencySuite) TestLatency(c *C) {
+	var h latencyHistogram
+	for i := 0; i < 99; i++ {
+		h.observe(100 * time.Microsecond)
+	}
+	h.observe(10 * time.Millisecond)
+	c.Assert(h.quantile(0.5), Equals, 128*time.Microsecond)
+	c.Assert(h.quantile(1), Equals, 10*time.Millisecond)
+	c.Assert(h.mean(), Equals, 199*time.Microsecond)
+
+	ls := NewLatencyStats(LatencyConfig{Ratio: 3, MinCount: 2})
+	for i := 0; i < 2; i++ {
+		ls.record("select * from t where id = 1", [2]time.Duration{time.Millisecond, 5 * time.Millisecond})
+		ls.record("select * from t where id = 2", [2]time.Duration{time.Millisecond, 5 * time.Millisecond})
+		ls.record("select a from t", [2]time.Duration{time.Millisecond, 2 * time.Millisecond})
+	}
+	ls.record("select b from t", [2]time.Duration{time.Millisecond, 9 * time.Millisecond})
+	reports := ls.Report()
+	c.Assert(reports, HasLen, 1)
+	c.Assert(reports[0].SQL, Equals, "select * from t where id = ?")
+	c.Assert(reports[0].Count, Equals, int64(4))
+	c.Assert(reports[0].Ratio, Equals, float64(5))
+
+	name, args, ok := parseAdminStatement("show MP latency all;")
+	c.Assert(ok, Equals, true)
+	c.Assert(name, Equals, "latency")
+	c.Assert(args, DeepEquals, []string{"all"})
+	_, _, ok = parseAdminStatement("show tables")
+	c.Assert(ok, Equals, false)
+
+	cc, mc, _ := newFakeComboContext(false)
+	cc.driver = &ComboDriver{Latency: ls}
+	rs, err := cc.Execute("SHOW MP LATENCY")
+	c.Assert(err, IsNil)
+	c.Assert(rs.Rows, HasLen, 1)
+	c.Assert(mc.executed, HasLen, 0)
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+const (
+	// NondeterministicNone compares non-deterministic statements as usual.
+	NondeterministicNone = ""
+	// NondeterministicBind rewrites the calls evaluated once per statement to
+	// literals, so every backend gets the same values. The calls evaluated per
+	// row are never rewritten, the values of their columns are skipped.
+	NondeterministicBind = "bind"
+	// NondeterministicSkip skips comparing the values of the columns computed
+	// by non-deterministic functions, the shape of the result is still compared.
+	NondeterministicSkip = "skip"
+)
+
+// CheckNondeterministic returns an error if mode is not a non-deterministic mode.
+func CheckNondeterministic(mode string) error {
+	switch mode {
+	case NondeterministicNone, NondeterministicBind, NondeterministicSkip:
+		return nil
+	}
+	return errors.Errorf("unknown non-deterministic mode %q", mode)
+}
+
+// nondeterministicFuncs are the functions whose results differ between the
+// backends, the value is true if the function is only non-deterministic when
+// it is called without arguments, like RAND(seed) or LAST_INSERT_ID(expr).
+var nondeterministicFuncs = map[string]bool{
+	"now":               false,
+	"sysdate":           false,
+	"current_timestamp": false,
+	"localtime":         false,
+	"localtimestamp":    false,
+	"curdate":           false,
+	"current_date":      false,
+	"curtime":           false,
+	"current_time":      false,
+	"utc_timestamp":     false,
+	"utc_date":          false,
+	"utc_time":          false,
+	"unix_timestamp":    true,
+	"rand":              true,
+	"uuid":              false,
+	"uuid_short":        false,
+	"connection_id":     false,
+	"last_insert_id":    true,
+}
+
+// perRowFuncs are evaluated for every row, binding them would give every row
+// the same value and change the data written.
+var perRowFuncs = map[string]bool{
+	"sysdate":    true,
+	"rand":       true,
+	"uuid":       true,
+	"uuid_short": true,
+}
+
+// clockFuncs are bound to the time of the primary backend.
+var clockFuncs = map[string]bool{
+	"now":               true,
+	"current_timestamp": true,
+	"localtime":         true,
+	"localtimestamp":    true,
+	"curdate":           true,
+	"current_date":      true,
+	"curtime":           true,
+	"current_time":      true,
+	"utc_timestamp":     true,
+	"utc_date":          true,
+	"utc_time":          true,
+	"unix_timestamp":    true,
+}
+
+// nondeterministicKeywords can be used without parentheses.
+var nondeterministicKeywords = map[string]bool{
+	"current_timestamp": true,
+	"localtime":         true,
+	"localtimestamp":    true,
+	"current_date":      true,
+	"current_time":      true,
+	"utc_timestamp":     true,
+	"utc_date":          true,
+	"utc_time":          true,
+}
+
+// ndCall is a non-deterministic function call in a statement, first and last
+// are the token indexes, start and end are the byte offsets in the statement.
+type ndCall struct {
+	name  string
+	first int
+	last  int
+	start int
+	end   int
+}
+
+// nondeterministicCommands are the statements whose non-deterministic calls
+// are handled, DDL is excluded so column defaults are kept as they are.
+var nondeterministicCommands = map[string]bool{
+	"select":  true,
+	"insert":  true,
+	"replace": true,
+	"update":  true,
+	"delete":  true,
+	"set":     true,
+	"do":      true,
+}
+
+// findNondeterministicCalls returns the calls in the order they appear in sql.
+func findNondeterministicCalls(sql string, toks []sqlToken) (calls []ndCall) {
+	for i := 0; i < len(toks); i++ {
+		tok := toks[i]
+		if tok.kind != tokIdent {
+			continue
+		}
+		name := tok.lower(sql)
+		noArgsOnly, ok := nondeterministicFuncs[name]
+		if !ok || (i > 0 && toks[i-1].is(sql, ".")) {
+			continue
+		}
+		if i+1 < len(toks) && toks[i+1].is(sql, "(") {
+			last := matchParen(sql, toks, i+1)
+			if last < 0 || (noArgsOnly && last != i+2) {
+				continue
+			}
+			calls = append(calls, ndCall{name: name, first: i, last: last, start: tok.start, end: toks[last].end})
+			i = last
+		} else if nondeterministicKeywords[name] {
+			calls = append(calls, ndCall{name: name, first: i, last: i, start: tok.start, end: tok.end})
+		}
+	}
+	return
+}
+
+// matchParen returns the index of the parenthesis closing toks[open], or -1.
+func matchParen(sql string, toks []sqlToken, open int) int {
+	depth := 0
+	for i := open; i < len(toks); i++ {
+		if toks[i].is(sql, "(") {
+			depth++
+		} else if toks[i].is(sql, ")") {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// selectListEnd are the keywords ending the select list.
+var selectListEnd = map[string]bool{
+	"from": true, "into": true, "where": true, "group": true, "having": true,
+	"order": true, "limit": true, "union": true, "for": true, "lock": true, "procedure": true,
+}
+
+var selectModifiers = map[string]bool{
+	"all": true, "distinct": true, "distinctrow": true, "high_priority": true, "straight_join": true,
+	"sql_small_result": true, "sql_big_result": true, "sql_buffer_result": true,
+	"sql_cache": true, "sql_no_cache": true, "sql_calc_found_rows": true,
+}
+
+// nondeterministicColumns maps the calls to the indexes of the select list
+// items. If a call is outside of the select list, the select list contains a
+// wildcard or the statement is a union, the rows can not be compared at all
+// and skipRows is true.
+func nondeterministicColumns(sql string, toks []sqlToken, calls []ndCall) (columns []int, skipRows bool) {
+	if len(calls) == 0 {
+		return nil, false
+	}
+	begin := -1
+	for i, tok := range toks {
+		if tok.is(sql, "select") && begin < 0 {
+			begin = i + 1
+		} else if tok.is(sql, "union") {
+			return nil, true
+		}
+	}
+	if begin < 0 {
+		return nil, false
+	}
+	for begin < len(toks) && toks[begin].kind == tokIdent && selectModifiers[toks[begin].lower(sql)] {
+		begin++
+	}
+
+	// item[i] is the select list item index of toks[i], or -1 if it is not in the select list.
+	item := make([]int, len(toks))
+	for i := range item {
+		item[i] = -1
+	}
+	depth, index, wildcard := 0, 0, false
+	for i := begin; i < len(toks); i++ {
+		tok := toks[i]
+		if tok.is(sql, "(") {
+			depth++
+		} else if tok.is(sql, ")") {
+			depth--
+			if depth < 0 {
+				break
+			}
+		} else if depth == 0 {
+			if tok.kind == tokIdent && selectListEnd[tok.lower(sql)] {
+				break
+			}
+			if tok.is(sql, ",") {
+				index++
+				continue
+			}
+			if tok.is(sql, "*") && (i == begin || toks[i-1].is(sql, ",") || toks[i-1].is(sql, ".")) {
+				wildcard = true
+			}
+		}
+		item[i] = index
+	}
+
+	for _, call := range calls {
+		if item[call.first] < 0 || wildcard {
+			return nil, true
+		}
+		columns = append(columns, item[call.first])
+	}
+	return columns, false
+}
+
+// ndBinder handles the non-deterministic calls of the statements of a session,
+// the values are bound to the ones of the primary backend.
+type ndBinder struct {
+	mode         string
+	primary      IContext
+	connectionID uint64 // the connection id of the primary backend, for binding CONNECTION_ID()
+	lastInsertID uint64 // the last non-zero insert id of the primary backend, for binding LAST_INSERT_ID()
+}
+
+// handle detects the non-deterministic calls in sql. In bind mode it returns
+// the rewritten sql, in skip mode it returns the columns whose values should
+// not be compared.
+//
+// The detection is done on the tokens of the statement, so a call in a
+// string literal or a column named like a function is never matched.
+func (nd *ndBinder) handle(sql string) (string, []int, bool) {
+	if nd.mode == NondeterministicNone || !nondeterministicCommands[sqlCommand(sql)] {
+		return sql, nil, false
+	}
+	toks := lexSQL(sql)
+	calls := findNondeterministicCalls(sql, toks)
+	if len(calls) == 0 {
+		return sql, nil, false
+	}
+	if nd.mode == NondeterministicBind {
+		return nd.bind(sql, toks, calls)
+	}
+	columns, skipRows := nondeterministicColumns(sql, toks, calls)
+	return sql, columns, skipRows
+}
+
+// prepared returns the columns of a prepared statement to skip, its calls can
+// not be bound to literals, they are skipped in both bind and skip modes.
+func (nd *ndBinder) prepared(sql string) ([]int, bool) {
+	if nd.mode == NondeterministicNone || !nondeterministicCommands[sqlCommand(sql)] {
+		return nil, false
+	}
+	toks := lexSQL(sql)
+	calls := findNondeterministicCalls(sql, toks)
+	if len(calls) == 0 {
+		return nil, false
+	}
+	return nondeterministicColumns(sql, toks, calls)
+}
+
+// executed keeps the last insert id of the primary backend after a statement.
+func (nd *ndBinder) executed() {
+	if id := nd.primary.LastInsertID(); id != 0 {
+		nd.lastInsertID = id
+	}
+}
+
+// ndClock is the time of the primary backend the calls of a statement are bound to.
+type ndClock struct {
+	local string // YYYY-MM-DD hh:mm:ss in the session time zone
+	utc   string
+	unix  string
+}
+
+// bind rewrites the calls evaluated once per statement to literals and
+// returns the columns of the other calls to skip.
+func (nd *ndBinder) bind(sql string, toks []sqlToken, calls []ndCall) (string, []int, bool) {
+	var bound, masked []ndCall
+	var clock *ndClock
+	for _, call := range calls {
+		if clockFuncs[call.name] && clock == nil {
+			clock = nd.clock()
+		}
+		if perRowFuncs[call.name] || (clockFuncs[call.name] && clock == nil) {
+			masked = append(masked, call)
+		} else {
+			bound = append(bound, call)
+		}
+	}
+	rewritten := sql
+	if len(bound) > 0 {
+		var buf bytes.Buffer
+		pos := 0
+		for _, call := range bound {
+			buf.WriteString(sql[pos:call.start])
+			buf.WriteString(nd.literal(call.name, clock))
+			pos = call.end
+		}
+		buf.WriteString(sql[pos:])
+		rewritten = buf.String()
+		log.Debugf("bind non-deterministic sql %s to %s", sql, rewritten)
+	}
+	columns, skipRows := nondeterministicColumns(sql, toks, masked)
+	return rewritten, columns, skipRows
+}
+
+func (nd *ndBinder) literal(name string, clock *ndClock) string {
+	switch name {
+	case "now", "current_timestamp", "localtime", "localtimestamp":
+		return quoteString(clock.local)
+	case "curdate", "current_date":
+		return quoteString(clock.local[:10])
+	case "curtime", "current_time":
+		return quoteString(clock.local[11:])
+	case "utc_timestamp":
+		return quoteString(clock.utc)
+	case "utc_date":
+		return quoteString(clock.utc[:10])
+	case "utc_time":
+		return quoteString(clock.utc[11:])
+	case "unix_timestamp":
+		return clock.unix
+	case "connection_id":
+		return strconv.FormatUint(nd.connID(), 10)
+	case "last_insert_id":
+		return strconv.FormatUint(nd.lastInsertID, 10)
+	}
+	return name
+}
+
+// clock reads the time of the primary backend, so the bound values are the
+// ones the client would get, in the time zone of the session. It returns nil
+// on error.
+func (nd *ndBinder) clock() *ndClock {
+	rs, err := nd.primary.Execute("SELECT NOW(), UTC_TIMESTAMP(), UNIX_TIMESTAMP()")
+	if err != nil || rs == nil || len(rs.Rows) == 0 || len(rs.Rows[0]) < 3 {
+		log.Warningf("get the time of the primary backend error %v", err)
+		return nil
+	}
+	row := rs.Rows[0]
+	clock := &ndClock{
+		local: fmt.Sprint(valueString(row[0])),
+		utc:   fmt.Sprint(valueString(row[1])),
+		unix:  fmt.Sprint(valueString(row[2])),
+	}
+	const layout = "2006-01-02 15:04:05"
+	if len(clock.local) != len(layout) || len(clock.utc) != len(layout) {
+		log.Warningf("unexpected time of the primary backend %s", clock.local)
+		return nil
+	}
+	return clock
+}
+
+// connID returns the connection id of the primary backend.
+func (nd *ndBinder) connID() uint64 {
+	if nd.connectionID != 0 {
+		return nd.connectionID
+	}
+	rs, err := nd.primary.Execute("SELECT CONNECTION_ID()")
+	if err != nil || rs == nil || len(rs.Rows) == 0 || len(rs.Rows[0]) == 0 {
+		log.Warningf("get connection id error %v", err)
+		return 0
+	}
+	id, err := strconv.ParseUint(fmt.Sprint(valueString(rs.Rows[0][0])), 10, 64)
+	if err != nil {
+		log.Warningf("parse connection id error %v", err)
+		return 0
+	}
+	nd.connectionID = id
+	return id
+}
+
+// valueString converts a byte slice value to string, so it can be printed.
+func valueString(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+// maskColumns returns a copy of rows with the values of columns set to nil.
+func maskColumns(rows [][]interface{}, columns []int) [][]interface{} {
+	masked := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		masked[i] = append([]interface{}(nil), row...)
+		for _, col := range columns {
+			if col < len(masked[i]) {
+				masked[i][col] = nil
+			}
+		}
+	}
+	return masked
+}
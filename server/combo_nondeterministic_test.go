@@ -0,0 +1,84 @@
+package server
+
+import (
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testNondeterministicSuite{})
+
+type testNondeterministicSuite struct {
+}
+
+func (s *testNondeterministicSuite) TestNondeterministic(c *C) {
+	tbl := []struct {
+		sql      string
+		calls    []string
+		columns  []int
+		skipRows bool
+	}{
+		{"select a, now(), 'rand()' from t", []string{"now"}, []int{1}, false},
+		{"select a, rand(1), RAND() r from t", []string{"rand"}, []int{2}, false},
+		{"select distinct concat(uuid(), a), b from t where t.now = 1", []string{"uuid"}, []int{0}, false},
+		{"select * from t where a < current_timestamp", []string{"current_timestamp"}, nil, true},
+		{"select *, now() from t", []string{"now"}, nil, true},
+		{"select last_insert_id(), last_insert_id(5)", []string{"last_insert_id"}, []int{0}, false},
+		{"select now() union select a from t", []string{"now"}, nil, true},
+	}
+	for _, t := range tbl {
+		toks := lexSQL(t.sql)
+		calls := findNondeterministicCalls(t.sql, toks)
+		var names []string
+		for _, call := range calls {
+			names = append(names, call.name)
+		}
+		c.Assert(names, DeepEquals, t.calls, Commentf("sql %s", t.sql))
+		columns, skipRows := nondeterministicColumns(t.sql, toks, calls)
+		c.Assert(columns, DeepEquals, t.columns, Commentf("sql %s", t.sql))
+		c.Assert(skipRows, Equals, t.skipRows, Commentf("sql %s", t.sql))
+	}
+
+	cc, mc, tc := newFakeComboContext(false)
+	cc.nd.mode = NondeterministicBind
+	cc.nd.lastInsertID = 7
+	// the calls evaluated per row are never bound.
+	cc.Execute("insert into t values (last_insert_id(), uuid())")
+	c.Assert(mc.executed, DeepEquals, []string{"insert into t values (7, uuid())"})
+	c.Assert(tc.executed, DeepEquals, mc.executed)
+
+	// ddl is never rewritten.
+	cc.Execute("create table t (a timestamp default current_timestamp)")
+	c.Assert(mc.executed[1], Equals, "create table t (a timestamp default current_timestamp)")
+
+	// the time is the one of the primary backend.
+	mc.rs = &ResultSet{Rows: [][]interface{}{{[]byte("2015-10-19 18:04:05"), []byte("2015-10-19 10:04:05"), int64(1445249045)}}}
+	sql, columns, skipRows := cc.nd.handle("select now(), curtime(), a, rand(), utc_date() from t")
+	c.Assert(sql, Equals, "select '2015-10-19 18:04:05', '18:04:05', a, rand(), '2015-10-19' from t")
+	c.Assert(columns, DeepEquals, []int{3})
+	c.Assert(skipRows, Equals, false)
+	sql, _, skipRows = cc.nd.handle("insert into t select unix_timestamp(), rand() from s")
+	c.Assert(sql, Equals, "insert into t select 1445249045, rand() from s")
+	c.Assert(skipRows, Equals, false)
+
+	// without the time of the primary backend, the time calls are skipped.
+	mc.rs, mc.err = nil, NewError(ErUnknownError, "unknown")
+	sql, columns, _ = cc.nd.handle("select a, now() from t")
+	c.Assert(sql, Equals, "select a, now() from t")
+	c.Assert(columns, DeepEquals, []int{1})
+	mc.err = nil
+
+	comp := &Compare{
+		rset: [2]*ResultSet{
+			{Columns: []*ColumnInfo{{Name: "a"}, {Name: "b"}}, Rows: [][]interface{}{{int64(1), int64(2)}}},
+			{Columns: []*ColumnInfo{{Name: "a"}, {Name: "b"}}, Rows: [][]interface{}{{int64(1), int64(3)}}},
+		},
+		skipColumns: []int{1},
+	}
+	c.Assert(comp.Diffs(), HasLen, 0)
+}
+
+func (s *testNondeterministicSuite) TestCheckNondeterministic(c *C) {
+	c.Assert(CheckNondeterministic(NondeterministicNone), IsNil)
+	c.Assert(CheckNondeterministic(NondeterministicSkip), IsNil)
+	c.Assert(CheckNondeterministic("bnid"), ErrorMatches, `unknown non-deterministic mode "bnid"`)
+}
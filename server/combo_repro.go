@@ -0,0 +1,467 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// ReproConfig configures the reproducers written for divergent statements.
+// Every session keeps a bounded log of the statements changing state, on the
+// first divergence of a statement digest, the log and the divergent statement
+// are written to Dir as a mysql-test style .test file.
+//
+// The statements are never replayed on the serving backends. With Mysql set,
+// the .result file is generated by replaying them on it, minimizing replays
+// them on both Mysql and Tidb. Replaying runs in a scratch database created for
+// the reproducer, USE statements are redirected to it, the statements naming
+// other databases are never replayed, only their .test file is written.
+type ReproConfig struct {
+	Dir string
+	// Mysql and Tidb are the dedicated backends to replay the reproducers on.
+	Mysql IDriver
+	Tidb  IDriver
+	// MaxStmts is the max number of statements kept for a session.
+	MaxStmts int
+	// Minimize shrinks the statements by delta debugging to a minimum which
+	// still diverges, every try replays the statements on Mysql and Tidb.
+	Minimize bool
+	// MaxTrials is the max number of replays when minimizing.
+	MaxTrials int
+
+	mu      sync.Mutex
+	digests map[string]bool
+}
+
+const (
+	defaultReproMaxStmts  = 256
+	defaultReproMaxTrials = 200
+)
+
+var reproSeq, reproScratchSeq int64
+
+// reproStmt is a statement in the session log, args is set for prepared statements.
+type reproStmt struct {
+	sql      string
+	args     []interface{}
+	prepared bool
+}
+
+// logStatement appends the current statement to the session log if it may change state.
+func (cc *ComboContext) logStatement() {
+	if cc.repro == nil || cc.current == nil || isReadOnlySQL(cc.current.sql) {
+		return
+	}
+	cc.history = append(cc.history, cc.current)
+	max := cc.repro.MaxStmts
+	if max <= 0 {
+		max = defaultReproMaxStmts
+	}
+	if len(cc.history) > max {
+		cc.history = cc.history[len(cc.history)-max:]
+	}
+}
+
+// reproduce writes the reproducer of the current statement in background, only
+// the first divergence of a statement digest is written.
+func (cc *ComboContext) reproduce() {
+	if cc.repro == nil || cc.current == nil {
+		return
+	}
+	digest := sqlDigest(normalizeSQL(cc.current.sql))
+	cc.repro.mu.Lock()
+	if cc.repro.digests == nil {
+		cc.repro.digests = make(map[string]bool)
+	}
+	written := cc.repro.digests[digest]
+	cc.repro.digests[digest] = true
+	cc.repro.mu.Unlock()
+	if written {
+		return
+	}
+
+	stmts := make([]*reproStmt, 0, len(cc.history)+2)
+	if cc.db != "" {
+		stmts = append(stmts, &reproStmt{sql: "use " + quoteIdent(cc.db)})
+	}
+	stmts = append(stmts, cc.history...)
+	stmts = append(stmts, cc.current)
+	r := &reproducer{
+		cfg:        cc.repro,
+		capability: cc.capability,
+		collation:  cc.collation,
+		scratchDB:  fmt.Sprintf("mp_repro_%d_%d", os.Getpid(), atomic.AddInt64(&reproScratchSeq, 1)),
+	}
+	go func() {
+		if err := r.write(stmts); err != nil {
+			log.Warningf("write reproducer error %s", errors.ErrorStack(err))
+		}
+	}()
+}
+
+type reproducer struct {
+	cfg        *ReproConfig
+	capability uint32
+	collation  uint8
+	trials     int
+	// scratchDB is unique to the reproducer, so the concurrent ones don't
+	// replay in the same database.
+	scratchDB string
+}
+
+func (r *reproducer) write(stmts []*reproStmt) error {
+	replayable := r.cfg.Mysql != nil && reproIsolated(stmts)
+	if replayable && r.cfg.Minimize && r.cfg.Tidb != nil {
+		stmts = r.minimize(stmts)
+	}
+
+	var test, result bytes.Buffer
+	fmt.Fprintf(&test, "# reproducer generated by mp at %s\n", time.Now().Format(time.RFC3339))
+	if replayable {
+		ctx, err := r.openScratch(r.cfg.Mysql)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for i, stmt := range stmts {
+			rs, prepareFailed, err := r.replay(ctx, stmt)
+			writeTestStmt(&test, stmt, i, errorCode(err), prepareFailed)
+			writeTestStmt(&result, stmt, i, 0, prepareFailed)
+			writeTestResult(&result, rs, err)
+		}
+		r.closeScratch(ctx)
+	} else {
+		for i, stmt := range stmts {
+			writeTestStmt(&test, stmt, i, 0, false)
+		}
+	}
+
+	name := fmt.Sprintf("%s_%d", time.Now().Format("20060102_150405"), atomic.AddInt64(&reproSeq, 1))
+	testFile := filepath.Join(r.cfg.Dir, name+".test")
+	if err := ioutil.WriteFile(testFile, test.Bytes(), 0644); err != nil {
+		return errors.Trace(err)
+	}
+	if replayable {
+		if err := ioutil.WriteFile(filepath.Join(r.cfg.Dir, name+".result"), result.Bytes(), 0644); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	log.Infof("reproducer of %s written to %s, %d statements", stmts[len(stmts)-1].sql, testFile, len(stmts))
+	return nil
+}
+
+// minimize removes statements before the last one as long as the last one still diverges.
+func (r *reproducer) minimize(stmts []*reproStmt) []*reproStmt {
+	last := stmts[len(stmts)-1]
+	prefix := stmts[:len(stmts)-1]
+	maxTrials := r.cfg.MaxTrials
+	if maxTrials <= 0 {
+		maxTrials = defaultReproMaxTrials
+	}
+	build := func(indexes []int) []*reproStmt {
+		picked := make([]*reproStmt, 0, len(indexes)+1)
+		for _, i := range indexes {
+			picked = append(picked, prefix[i])
+		}
+		return append(picked, last)
+	}
+	kept := ddmin(len(prefix), func(indexes []int) bool {
+		if r.trials >= maxTrials {
+			return false
+		}
+		r.trials++
+		diverges, err := r.diverges(build(indexes))
+		if err != nil {
+			log.Warningf("replay reproducer error %v", err)
+			return false
+		}
+		return diverges
+	})
+	return build(kept)
+}
+
+// diverges replays stmts on both backends and reports whether the last one diverges.
+func (r *reproducer) diverges(stmts []*reproStmt) (bool, error) {
+	mc, err := r.openScratch(r.cfg.Mysql)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	defer r.closeScratch(mc)
+	tc, err := r.openScratch(r.cfg.Tidb)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	defer r.closeScratch(tc)
+
+	var comp *Compare
+	for _, stmt := range stmts {
+		mrs, _, merr := r.replay(mc, stmt)
+		trs, _, terr := r.replay(tc, stmt)
+		comp = newContextsCompare(stmt.sql, mc, tc, mrs, trs, merr, terr)
+	}
+	return len(comp.Diffs()) > 0, nil
+}
+
+// reproIsolated reports whether stmts stay in the scratch database, none of
+// them creates, alters or drops a database, or has a qualified name other than
+// a column of one of its tables. Aliases qualifying columns are refused too.
+func reproIsolated(stmts []*reproStmt) bool {
+	for _, stmt := range stmts {
+		sql := stmt.sql
+		toks := lexSQL(sql)
+		switch sqlCommand(sql) {
+		case "create", "alter", "drop":
+			if len(toks) > 1 && (toks[1].is(sql, "database") || toks[1].is(sql, "schema")) {
+				return false
+			}
+		}
+		tables := make(map[string]bool)
+		for _, table := range statementTables(sql) {
+			if strings.Contains(table, ".") {
+				return false
+			}
+			tables[strings.ToLower(table)] = true
+		}
+		for i := 0; i+2 < len(toks); i++ {
+			if (toks[i].kind == tokIdent || toks[i].kind == tokQuotedIdent) && toks[i+1].is(sql, ".") &&
+				!tables[strings.ToLower(unquoteIdent(toks[i].text(sql)))] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// openScratch creates the scratch database and opens a session using it. An
+// existing database of the same name is an error, it's never dropped.
+func (r *reproducer) openScratch(driver IDriver) (IContext, error) {
+	ctx, err := driver.OpenCtx(r.capability, r.collation, "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err = ctx.Execute("CREATE DATABASE " + quoteIdent(r.scratchDB)); err != nil {
+		ctx.Close()
+		return nil, errors.Trace(err)
+	}
+	if _, err = ctx.Execute("USE " + quoteIdent(r.scratchDB)); err != nil {
+		r.closeScratch(ctx)
+		return nil, errors.Trace(err)
+	}
+	return ctx, nil
+}
+
+// closeScratch drops the scratch database created by openScratch and closes the session.
+func (r *reproducer) closeScratch(ctx IContext) {
+	if _, err := ctx.Execute("DROP DATABASE " + quoteIdent(r.scratchDB)); err != nil {
+		log.Warningf("drop scratch database %s error %v", r.scratchDB, err)
+	}
+	ctx.Close()
+}
+
+// replay executes stmt on ctx, USE statements are redirected to the scratch
+// database. prepareFailed reports whether a prepared statement failed to prepare.
+func (r *reproducer) replay(ctx IContext, stmt *reproStmt) (rs *ResultSet, prepareFailed bool, err error) {
+	if useDB(stmt.sql) != "" {
+		rs, err = ctx.Execute("USE " + quoteIdent(r.scratchDB))
+		return rs, false, err
+	}
+	if !stmt.prepared {
+		rs, err = ctx.Execute(stmt.sql)
+		return rs, false, err
+	}
+	ps, _, _, err := ctx.Prepare(stmt.sql)
+	if err != nil {
+		return nil, true, err
+	}
+	defer ps.Close()
+	rs, err = ps.Execute(stmt.args...)
+	return rs, false, err
+}
+
+// ddmin is the delta debugging algorithm, it returns a minimal subset of the
+// indexes [0, n) for which test still returns true.
+func ddmin(n int, test func(indexes []int) bool) []int {
+	current := make([]int, n)
+	for i := range current {
+		current[i] = i
+	}
+	granularity := 2
+	for len(current) >= 2 {
+		chunks := splitIndexes(current, granularity)
+		reduced := false
+		// try each complement first, it removes a single chunk.
+		for i := range chunks {
+			var complement []int
+			for j, chunk := range chunks {
+				if j != i {
+					complement = append(complement, chunk...)
+				}
+			}
+			if test(complement) {
+				current = complement
+				if granularity > 2 {
+					granularity--
+				}
+				reduced = true
+				break
+			}
+		}
+		if reduced {
+			continue
+		}
+		if granularity >= len(current) {
+			break
+		}
+		granularity *= 2
+		if granularity > len(current) {
+			granularity = len(current)
+		}
+	}
+	if len(current) == 1 && test(nil) {
+		return nil
+	}
+	return current
+}
+
+func splitIndexes(indexes []int, n int) [][]int {
+	chunks := make([][]int, 0, n)
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(indexes)-start)/(n-i)
+		chunks = append(chunks, indexes[start:end])
+		start = end
+	}
+	return chunks
+}
+
+// writeTestStmt writes stmt in mysql-test syntax, prepared statements are
+// written as PREPARE, SET of the arguments and EXECUTE. If errCode isn't 0,
+// the statement is expected to fail with it: the --error directive is written
+// before the PREPARE if prepareFailed, the rest of the prepared statement is
+// then left out, else before the EXECUTE.
+func writeTestStmt(buf *bytes.Buffer, stmt *reproStmt, seq int, errCode uint16, prepareFailed bool) {
+	expectError := func() {
+		if errCode != 0 {
+			fmt.Fprintf(buf, "--error %d\n", errCode)
+		}
+	}
+	if !stmt.prepared {
+		expectError()
+		writeTestQuery(buf, stmt.sql)
+		return
+	}
+	name := fmt.Sprintf("stmt%d", seq)
+	if prepareFailed {
+		expectError()
+	}
+	writeTestQuery(buf, fmt.Sprintf("PREPARE %s FROM %s", name, sqlLiteral(stmt.sql)))
+	if prepareFailed {
+		return
+	}
+	var vars []string
+	for i, arg := range stmt.args {
+		v := fmt.Sprintf("@%s_%d", name, i)
+		writeTestQuery(buf, fmt.Sprintf("SET %s = %s", v, sqlLiteral(arg)))
+		vars = append(vars, v)
+	}
+	expectError()
+	if len(vars) > 0 {
+		writeTestQuery(buf, fmt.Sprintf("EXECUTE %s USING %s", name, strings.Join(vars, ", ")))
+	} else {
+		writeTestQuery(buf, "EXECUTE "+name)
+	}
+	writeTestQuery(buf, "DEALLOCATE PREPARE "+name)
+}
+
+func writeTestQuery(buf *bytes.Buffer, sql string) {
+	if strings.Contains(sql, ";") {
+		fmt.Fprintf(buf, "delimiter //;\n%s//\ndelimiter ;//\n", sql)
+		return
+	}
+	fmt.Fprintf(buf, "%s;\n", sql)
+}
+
+// writeTestResult writes the result in mysql-test .result syntax.
+func writeTestResult(buf *bytes.Buffer, rs *ResultSet, err error) {
+	if err != nil {
+		m := toSQLError(err)
+		fmt.Fprintf(buf, "ERROR %s: %s\n", m.State, m.Message)
+		return
+	}
+	if rs == nil {
+		return
+	}
+	names := make([]string, len(rs.Columns))
+	for i, col := range rs.Columns {
+		names[i] = col.Name
+	}
+	buf.WriteString(strings.Join(names, "\t") + "\n")
+	for _, row := range rs.Rows {
+		values := make([]string, len(row))
+		for i, value := range row {
+			values[i] = checksumValue(rs.Columns[i], value)
+		}
+		buf.WriteString(strings.Join(values, "\t") + "\n")
+	}
+}
+
+// sqlLiteral formats a statement argument as a sql literal.
+func sqlLiteral(v interface{}) string {
+	switch x := uniformValue(v).(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case uint64:
+		return strconv.FormatUint(x, 10)
+	case float32:
+		return strconv.FormatFloat(float64(x), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case bool:
+		if x {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		return quoteString(string(x))
+	case string:
+		return quoteString(x)
+	case time.Time:
+		return quoteString(x.Format(TimeFSPFormat))
+	default:
+		return quoteString(fmt.Sprint(x))
+	}
+}
+
+func quoteString(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case 0:
+			buf.WriteString("\\0")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('\'')
+	return buf.String()
+}
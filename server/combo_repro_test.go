@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testReproSuite{})
+
+type testReproSuite struct {
+}
+
+func (s *testReproSuite) TestReproducer(c *C) {
+	// the divergence needs the statements 2 and 5.
+	var trials int
+	kept := ddmin(8, func(indexes []int) bool {
+		trials++
+		var has2, has5 bool
+		for _, i := range indexes {
+			has2 = has2 || i == 2
+			has5 = has5 || i == 5
+		}
+		return has2 && has5
+	})
+	c.Assert(kept, DeepEquals, []int{2, 5})
+	c.Assert(trials < 28, Equals, true)
+	c.Assert(ddmin(3, func([]int) bool { return true }), HasLen, 0)
+
+	c.Assert(sqlLiteral(nil), Equals, "NULL")
+	c.Assert(sqlLiteral(int32(-1)), Equals, "-1")
+	c.Assert(sqlLiteral([]byte("it's")), Equals, `'it\'s'`)
+
+	var buf bytes.Buffer
+	writeTestStmt(&buf, &reproStmt{sql: "insert into t values (?, ?)", args: []interface{}{int64(1), "a"}, prepared: true}, 3, ErDupEntry, false)
+	writeTestStmt(&buf, &reproStmt{sql: "create trigger tr before insert on t for each row begin set @a = 1; end"}, 4, 0, false)
+	writeTestStmt(&buf, &reproStmt{sql: "select * from t2 where a = ?", args: []interface{}{int64(1)}, prepared: true}, 5, ErNoSuchTable, true)
+	c.Assert(buf.String(), Equals, `PREPARE stmt3 FROM 'insert into t values (?, ?)';
+SET @stmt3_0 = 1;
+SET @stmt3_1 = 'a';
+--error 1062
+EXECUTE stmt3 USING @stmt3_0, @stmt3_1;
+DEALLOCATE PREPARE stmt3;
+delimiter //;
+create trigger tr before insert on t for each row begin set @a = 1; end//
+delimiter ;//
+--error 1146
+PREPARE stmt5 FROM 'select * from t2 where a = ?';
+`)
+
+	buf.Reset()
+	writeTestResult(&buf, &ResultSet{
+		Columns: []*ColumnInfo{{Name: "a", Type: TypeLonglong}, {Name: "b", Type: TypeVarchar}},
+		Rows:    [][]interface{}{{int64(1), nil}},
+	}, nil)
+	writeTestResult(&buf, nil, &SQLError{Code: ErNoSuchTable, Message: "Table 'test.t' doesn't exist", State: "42S02"})
+	c.Assert(buf.String(), Equals, "a\tb\n1\tNULL\nERROR 42S02: Table 'test.t' doesn't exist\n")
+
+	// an existing scratch database isn't dropped.
+	fc := newFakeContext()
+	r := &reproducer{scratchDB: "mp_repro_1_1"}
+	fc.err = NewError(ErDbCreateExists, "database exists")
+	_, err := r.openScratch(&fakeDriver{fc})
+	c.Assert(err, NotNil)
+	c.Assert(fc.executed, DeepEquals, []string{"CREATE DATABASE `mp_repro_1_1`"})
+	fc.err, fc.executed = nil, nil
+	ctx, err := r.openScratch(&fakeDriver{fc})
+	c.Assert(err, IsNil)
+	r.replay(ctx, &reproStmt{sql: "use test"})
+	r.closeScratch(ctx)
+	c.Assert(fc.executed, DeepEquals, []string{"CREATE DATABASE `mp_repro_1_1`", "USE `mp_repro_1_1`", "USE `mp_repro_1_1`", "DROP DATABASE `mp_repro_1_1`"})
+
+	c.Assert(reproIsolated([]*reproStmt{{sql: "insert into t values (1)"}, {sql: "update t set t.a = 2"}}), Equals, true)
+	for _, sql := range []string{
+		"insert into prod.t values (1)",
+		"update t, `prod`.t2 set t.a = 1",
+		"update t a set a.x = 1",
+		"truncate prod.t",
+		"drop database prod",
+		"create schema s",
+	} {
+		c.Assert(reproIsolated([]*reproStmt{{sql: "insert into t values (1)"}, {sql: sql}}), Equals, false, Commentf(sql))
+	}
+
+	// without the dedicated backends only the .test file is written.
+	dir := c.MkDir()
+	r = &reproducer{cfg: &ReproConfig{Dir: dir, Minimize: true}, scratchDB: "mp_repro_1_2"}
+	c.Assert(r.write([]*reproStmt{{sql: "insert into t values (1)"}, {sql: "select * from t"}}), IsNil)
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Assert(strings.HasSuffix(files[0], ".test"), Equals, true)
+	fc.executed = nil
+	r = &reproducer{cfg: &ReproConfig{Dir: dir, Mysql: &fakeDriver{fc}}, scratchDB: "mp_repro_1_3"}
+	c.Assert(r.write([]*reproStmt{{sql: "delete from prod.t"}, {sql: "select * from t"}}), IsNil)
+	c.Assert(fc.executed, HasLen, 0)
+
+	cc, _, _ := newFakeComboContext(false)
+	cc.repro = &ReproConfig{MaxStmts: 2}
+	for _, sql := range []string{"insert into t values (1)", "select * from t", "update t set a = 2", "delete from t"} {
+		cc.Execute(sql)
+	}
+	c.Assert(cc.history, HasLen, 2)
+	c.Assert(cc.history[0].sql, Equals, "update t set a = 2")
+	c.Assert(cc.history[1].sql, Equals, "delete from t")
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+const defaultMaxRowDiffs = 10
+
+// rowKeyColumns returns the primary key columns, or the unique key columns
+// if there is no primary key, the skipped columns are never keys.
+func rowKeyColumns(cols []*ColumnInfo, skipColumns []int) []int {
+	skipped := make(map[int]bool)
+	for _, i := range skipColumns {
+		skipped[i] = true
+	}
+	for _, flag := range []uint16{PriKeyFlag, UniqueKeyFlag} {
+		var keys []int
+		for i, col := range cols {
+			if col.Flag&flag > 0 && !skipped[i] {
+				keys = append(keys, i)
+			}
+		}
+		if len(keys) > 0 {
+			return keys
+		}
+	}
+	return nil
+}
+
+// rowString formats the values of the columns of row, all columns if columns is nil.
+func rowString(cols []*ColumnInfo, row []interface{}, columns []int) string {
+	if columns == nil {
+		columns = make([]int, len(row))
+		for i := range row {
+			columns[i] = i
+		}
+	}
+	values := make([]string, 0, len(columns))
+	for _, i := range columns {
+		if i < len(cols) {
+			values = append(values, checksumValue(cols[i], row[i]))
+		}
+	}
+	return "(" + strings.Join(values, ", ") + ")"
+}
+
+// keyedRows groups the row indexes by key in the row order.
+type keyedRows struct {
+	keys  []string
+	index map[string][]int
+}
+
+func newKeyedRows(cols []*ColumnInfo, rows [][]interface{}, keyColumns []int) *keyedRows {
+	kr := &keyedRows{index: make(map[string][]int)}
+	for i, row := range rows {
+		var key string
+		if keyColumns != nil {
+			key = rowString(cols, row, keyColumns)
+		} else {
+			// the hash of the full row, rows are either missing or extra.
+			sum := sha1.Sum([]byte(rowString(cols, row, nil)))
+			key = hex.EncodeToString(sum[:])
+		}
+		if _, ok := kr.index[key]; !ok {
+			kr.keys = append(kr.keys, key)
+		}
+		kr.index[key] = append(kr.index[key], i)
+	}
+	return kr
+}
+
+// rowsDiffs lists the rows missing from tidb, the extra rows of tidb and the
+// changed columns of the rows with the same key, at most max entries. The
+// rows are keyed by the primary key or unique columns taken from the column
+// flags, or by the hash of the full row.
+func rowsDiffs(cols []*ColumnInfo, mRows, tRows [][]interface{}, skipColumns []int, max int) (diffs []*Diff) {
+	if max <= 0 {
+		max = defaultMaxRowDiffs
+	}
+	keyColumns := rowKeyColumns(cols, skipColumns)
+	m, t := newKeyedRows(cols, mRows, keyColumns), newKeyedRows(cols, tRows, keyColumns)
+	total := 0
+	add := func(column, format string, args ...interface{}) {
+		total++
+		if total <= max {
+			diffs = append(diffs, &Diff{Field: "Rows", Column: column, Msg: fmt.Sprintf(format, args...)})
+		}
+	}
+	keyName := "key"
+	if keyColumns == nil {
+		keyName = "row"
+	}
+
+	for _, key := range m.keys {
+		mIdx, tIdx := m.index[key], t.index[key]
+		for n, i := range mIdx {
+			if n >= len(tIdx) {
+				add("", "missing row %s, %s %s", rowString(cols, mRows[i], nil), keyName, key)
+				continue
+			}
+			mRow, tRow := mRows[i], tRows[tIdx[n]]
+			for c := range mRow {
+				if c >= len(tRow) || containsInt(skipColumns, c) || reflect.DeepEqual(mRow[c], tRow[c]) {
+					continue
+				}
+				add(cols[c].Name, "changed row %s %s, column %s: expect %s, got %s",
+					keyName, key, cols[c].Name, valueWithType(mRow[c]), valueWithType(tRow[c]))
+			}
+		}
+	}
+	for _, key := range t.keys {
+		mIdx, tIdx := m.index[key], t.index[key]
+		for n := len(mIdx); n < len(tIdx); n++ {
+			add("", "extra row %s, %s %s", rowString(cols, tRows[tIdx[n]], nil), keyName, key)
+		}
+	}
+	if total > max {
+		diffs = append(diffs, &Diff{Field: "Rows", Msg: fmt.Sprintf("%d more row differences are not listed", total-max)})
+	}
+	return
+}
+
+// valueWithType formats a value with its go type, so values of the same
+// text but different types are told apart.
+func valueWithType(v interface{}) string {
+	if v == nil {
+		return "NULL"
+	}
+	return fmt.Sprintf("%v(%T)", valueString(v), v)
+}
+
+func containsInt(s []int, v int) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testRowDiffSuite{})
+
+type testRowDiffSuite struct {
+}
+
+func (s *testRowDiffSuite) TestRowsDiff(c *C) {
+	keyed := []*ColumnInfo{{Name: "id", Type: TypeLonglong, Flag: PriKeyFlag}, {Name: "v", Type: TypeVarString}}
+	comp := &Compare{
+		rset: [2]*ResultSet{
+			{Columns: keyed, Rows: [][]interface{}{{int64(1), []byte("a")}, {int64(2), []byte("b")}, {int64(3), []byte("c")}}},
+			{Columns: keyed, Rows: [][]interface{}{{int64(3), []byte("c")}, {int64(2), []byte("x")}, {int64(4), []byte("d")}}},
+		},
+	}
+	diffs := comp.Diffs()
+	c.Assert(diffs, HasLen, 3)
+	c.Assert(diffs[0].Msg, Equals, "missing row (1, a), key (1)")
+	c.Assert(diffs[1].Column, Equals, "v")
+	c.Assert(diffs[1].Msg, Equals, "changed row key (2), column v: expect b([]uint8), got x([]uint8)")
+	c.Assert(diffs[2].Msg, Equals, "extra row (4, d), key (4)")
+
+	// the full row is the key without key columns, the count differs.
+	plain := []*ColumnInfo{{Name: "v", Type: TypeLonglong}}
+	comp = &Compare{
+		rset: [2]*ResultSet{
+			{Columns: plain, Rows: [][]interface{}{{int64(1)}, {int64(1)}, {int64(2)}}},
+			{Columns: plain, Rows: [][]interface{}{{int64(2)}, {int64(1)}}},
+		},
+	}
+	diffs = comp.Diffs()
+	c.Assert(diffs, HasLen, 2)
+	c.Assert(diffs[0].Field, Equals, "RowCount")
+	c.Assert(diffs[1].Msg, Matches, `missing row \(1\), row [0-9a-f]{40}`)
+
+	// the same rows in a different order.
+	comp.rset[1].Rows = [][]interface{}{{int64(2)}, {int64(1)}, {int64(1)}}
+	diffs = comp.Diffs()
+	c.Assert(diffs, HasLen, 1)
+	c.Assert(diffs[0].Field, Equals, "Rows")
+
+	// the row differences are capped.
+	comp.rset[1].Rows = [][]interface{}{{int64(3)}, {int64(4)}, {int64(5)}}
+	comp.maxRowDiffs = 2
+	diffs = comp.Diffs()
+	c.Assert(diffs, HasLen, 3)
+	c.Assert(diffs[2].Msg, Equals, "4 more row differences are not listed")
+}
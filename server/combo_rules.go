@@ -0,0 +1,186 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/mp/etc"
+)
+
+const (
+	ruleActionSuppress  = "suppress"
+	ruleActionDowngrade = "downgrade"
+)
+
+// DiffRuleSet holds the known difference rules of combo mode. A diff hit by a
+// suppress rule is not reported, a diff hit by a downgrade rule is reported at
+// info level instead of warning level.
+type DiffRuleSet struct {
+	rules []*diffRule
+}
+
+type diffRule struct {
+	*etc.DiffRule
+	sqlRe      *regexp.Regexp
+	suppressed int64
+	downgraded int64
+}
+
+// DiffRuleStat is the count of diffs hidden by a rule.
+type DiffRuleStat struct {
+	Name       string
+	Action     string
+	Suppressed int64
+	Downgraded int64
+}
+
+func NewDiffRuleSet(cfg *etc.DiffRules) (*DiffRuleSet, error) {
+	rs := &DiffRuleSet{}
+	for i, r := range cfg.Rules {
+		rule := &diffRule{DiffRule: r}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i)
+		}
+		switch strings.ToLower(rule.Action) {
+		case "", ruleActionSuppress:
+			rule.Action = ruleActionSuppress
+		case ruleActionDowngrade:
+			rule.Action = ruleActionDowngrade
+		default:
+			return nil, errors.Errorf("rule %s: unknown action %s", rule.Name, rule.Action)
+		}
+		if rule.SQL != "" {
+			re, err := regexp.Compile(rule.SQL)
+			if err != nil {
+				return nil, errors.Annotatef(err, "rule %s", rule.Name)
+			}
+			rule.sqlRe = re
+		}
+		rs.rules = append(rs.rules, rule)
+	}
+	return rs, nil
+}
+
+func LoadDiffRuleSet(fileName string) (*DiffRuleSet, error) {
+	cfg, err := etc.ParseDiffRulesFile(fileName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return NewDiffRuleSet(cfg)
+}
+
+func (r *diffRule) match(sql, digest string, diff *Diff, errCodes [2]uint16) bool {
+	if r.sqlRe != nil && !r.sqlRe.MatchString(sql) {
+		return false
+	}
+	if r.Digest != "" && r.Digest != digest {
+		return false
+	}
+	if r.Column != "" && !strings.EqualFold(r.Column, diff.Column) {
+		return false
+	}
+	if r.Field != "" && !strings.EqualFold(r.Field, diff.Field) {
+		return false
+	}
+	if r.MysqlErrCode != 0 || r.TidbErrCode != 0 {
+		if diff.Field != "Error" {
+			return false
+		}
+		if r.MysqlErrCode != 0 && r.MysqlErrCode != errCodes[0] {
+			return false
+		}
+		if r.TidbErrCode != 0 && r.TidbErrCode != errCodes[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// filter splits diffs into the ones to report as warnings and the downgraded
+// ones, suppressed diffs are dropped. The first matching rule wins.
+func (rs *DiffRuleSet) filter(sql string, diffs []*Diff, errs [2]error) (reported, downgraded []*Diff) {
+	if rs == nil || len(rs.rules) == 0 {
+		return diffs, nil
+	}
+	digest := sqlDigest(normalizeSQL(sql))
+	errCodes := [2]uint16{errorCode(errs[0]), errorCode(errs[1])}
+	for _, diff := range diffs {
+		var hit *diffRule
+		for _, rule := range rs.rules {
+			if rule.match(sql, digest, diff, errCodes) {
+				hit = rule
+				break
+			}
+		}
+		switch {
+		case hit == nil:
+			reported = append(reported, diff)
+		case hit.Action == ruleActionDowngrade:
+			atomic.AddInt64(&hit.downgraded, 1)
+			downgraded = append(downgraded, diff)
+		default:
+			atomic.AddInt64(&hit.suppressed, 1)
+		}
+	}
+	return
+}
+
+func (rs *DiffRuleSet) Stats() []DiffRuleStat {
+	if rs == nil {
+		return nil
+	}
+	stats := make([]DiffRuleStat, 0, len(rs.rules))
+	for _, rule := range rs.rules {
+		stats = append(stats, DiffRuleStat{
+			Name:       rule.Name,
+			Action:     rule.Action,
+			Suppressed: atomic.LoadInt64(&rule.suppressed),
+			Downgraded: atomic.LoadInt64(&rule.downgraded),
+		})
+	}
+	return stats
+}
+
+func (rs *DiffRuleSet) LogStats() {
+	for _, stat := range rs.Stats() {
+		log.Infof("diff rule %s(%s): suppressed %d, downgraded %d", stat.Name, stat.Action, stat.Suppressed, stat.Downgraded)
+	}
+}
+
+// errorCode returns the error code the client receives for err.
+func errorCode(err error) uint16 {
+	if err == nil {
+		return 0
+	}
+	return toSQLError(err).Code
+}
+
+// report logs the diffs which are not suppressed by the rules, and returns the
+// diffs to act on. The downgraded ones are logged at info level and kept in
+// the recent diffs, they are not returned.
+func (cc *ComboContext) report(title, sql string, diffs []*Diff, errs [2]error) []*Diff {
+	return cc.rules.report(title, sql, diffs, errs)
+}
+
+func (rs *DiffRuleSet) report(title, sql string, diffs []*Diff, errs [2]error) []*Diff {
+	if len(diffs) == 0 {
+		return nil
+	}
+	reported, downgraded := rs.filter(sql, diffs, errs)
+	for _, d := range reported {
+		metrics.Divergences.Inc(d.Field)
+	}
+	recentDiffs.add(sql, reported, true)
+	recentDiffs.add(sql, downgraded, false)
+	if s := diffsString(title, reported); s != "" {
+		log.Warning(s)
+	}
+	if s := diffsString(title, downgraded); s != "" {
+		log.Info(s)
+	}
+	return reported
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testDiffRulesSuite{})
+
+type testDiffRulesSuite struct {
+}
+
+func (s *testDiffRulesSuite) TestFilter(c *C) {
+	rs, err := NewDiffRuleSet(&etc.DiffRules{Rules: []*etc.DiffRule{
+		{Name: "length", Field: "ColumnLength"},
+		{Name: "charset", SQL: "(?i)^show", Field: "Charset", Action: "downgrade"},
+		{Name: "dup", MysqlErrCode: ErDupEntry, TidbErrCode: ErUnknownError},
+	}})
+	c.Assert(err, IsNil)
+
+	diffs := []*Diff{
+		{Field: "ColumnLength", Column: "a"},
+		{Field: "Charset", Column: "a"},
+		{Field: "Flag", Column: "a"},
+	}
+	reported, downgraded := rs.filter("SHOW TABLES", diffs, [2]error{})
+	c.Assert(reported, HasLen, 1)
+	c.Assert(reported[0].Field, Equals, "Flag")
+	c.Assert(downgraded, HasLen, 1)
+	c.Assert(downgraded[0].Field, Equals, "Charset")
+
+	reported, downgraded = rs.filter("select 1", diffs, [2]error{})
+	c.Assert(reported, HasLen, 2)
+	c.Assert(downgraded, HasLen, 0)
+
+	errs := [2]error{NewError(ErDupEntry, "Duplicate entry"), NewError(ErUnknownError, "key already exist")}
+	reported, _ = rs.filter("insert into t values (1)", []*Diff{{Field: "Error"}}, errs)
+	c.Assert(reported, HasLen, 0)
+
+	// the downgraded diffs are only logged, the caller doesn't act on them.
+	c.Assert(rs.report("diff", "SHOW TABLES", []*Diff{{Field: "Charset"}}, [2]error{}), HasLen, 0)
+
+	stats := rs.Stats()
+	c.Assert(stats[0].Suppressed, Equals, int64(2))
+	c.Assert(stats[1].Downgraded, Equals, int64(2))
+	c.Assert(stats[2].Suppressed, Equals, int64(1))
+
+	_, err = NewDiffRuleSet(&etc.DiffRules{Rules: []*etc.DiffRule{{Action: "ignore"}}})
+	c.Assert(err, NotNil)
+}
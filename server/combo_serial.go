@@ -0,0 +1,198 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+const (
+	// SerializeNone executes the statements of the sessions independently.
+	SerializeNone = ""
+	// SerializeGlobal applies all the statements to the secondary backend in
+	// the order the primary backend executed them.
+	SerializeGlobal = "global"
+	// SerializeTable only orders the statements touching the same tables.
+	SerializeTable = "table"
+)
+
+// CheckSerialize returns an error if mode is not a serialization mode.
+func CheckSerialize(mode string) error {
+	switch mode {
+	case SerializeNone, SerializeGlobal, SerializeTable:
+		return nil
+	}
+	return errors.Errorf("unknown serialize mode %q", mode)
+}
+
+// sequencer hands out tickets in the order the statements are sent to the
+// primary backend, a statement is executed on the secondary backend once all
+// the statements holding earlier tickets of its keys are executed. The
+// tickets of all the keys of a statement are taken at once, so the order is
+// the same for every key and the statements never wait for each other in a cycle.
+//
+// The ticket is taken before the primary backend executes the statement, so
+// a statement blocked on the primary backend by a lock of another session is
+// ordered before the statement of that session releasing the lock. On the
+// secondary backend it waits for the lock until the lock wait timeout.
+type sequencer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	seq     uint64
+	next    map[string]uint64 // the next ticket of the key
+	serving map[string]uint64 // the ticket of the key allowed to execute
+}
+
+// seqTicket is the position of a statement in the order of its keys.
+type seqTicket struct {
+	seq     uint64
+	tickets map[string]uint64
+}
+
+func newSequencer() *sequencer {
+	s := &sequencer{next: make(map[string]uint64), serving: make(map[string]uint64)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *sequencer) acquire(keys []string) *seqTicket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	t := &seqTicket{seq: s.seq, tickets: make(map[string]uint64, len(keys))}
+	for _, key := range keys {
+		if _, ok := t.tickets[key]; ok {
+			continue
+		}
+		t.tickets[key] = s.next[key]
+		s.next[key]++
+	}
+	return t
+}
+
+// wait blocks until t is the ticket being served for all its keys.
+func (s *sequencer) wait(t *seqTicket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.ready(t) {
+		s.cond.Wait()
+	}
+}
+
+func (s *sequencer) ready(t *seqTicket) bool {
+	for key, ticket := range t.tickets {
+		if s.serving[key] != ticket {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *sequencer) release(t *seqTicket) {
+	s.mu.Lock()
+	for key := range t.tickets {
+		s.serving[key]++
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// sequencer returns the sequencer shared by the sessions of the driver.
+func (cd *ComboDriver) sequencer() *sequencer {
+	cd.seqOnce.Do(func() {
+		cd.seq = newSequencer()
+	})
+	return cd.seq
+}
+
+// serialKeys returns the keys sql is ordered by, nil means sql is not ordered.
+// The unqualified tables are in the current database, they are not ordered
+// without one since the statement fails on both backends.
+func (cc *ComboContext) serialKeys(sql string) []string {
+	switch cc.serialize {
+	case SerializeGlobal:
+		return []string{""}
+	case SerializeTable:
+	default:
+		return nil
+	}
+	var keys []string
+	switch sqlCommand(sql) {
+	case "commit", "rollback":
+		// the end of a transaction is ordered by all the tables it touched.
+		for table := range cc.txnTables {
+			keys = append(keys, table)
+		}
+		cc.txnTables = nil
+		return keys
+	}
+	db := cc.CurrentDB()
+	for _, table := range statementTables(sql) {
+		if !strings.Contains(table, ".") {
+			if db == "" {
+				continue
+			}
+			table = db + "." + table
+		}
+		keys = append(keys, strings.ToLower(table))
+	}
+	return keys
+}
+
+// trackTxnTables keeps the tables touched by a statement in the transaction
+// the primary backend is in after executing it.
+func (cc *ComboContext) trackTxnTables(keys []string) {
+	if cc.serialize != SerializeTable || cc.Status()&ServerStatusInTrans == 0 {
+		return
+	}
+	if cc.txnTables == nil {
+		cc.txnTables = make(map[string]bool)
+	}
+	for _, key := range keys {
+		cc.txnTables[key] = true
+	}
+}
+
+// executeBoth executes a statement on both backends, exec executes it on the
+// backend of index i, 0 for mysql and 1 for tidb. If serialisation is
+// enabled, the statement takes its ticket before the primary backend executes
+// it, and the secondary one executes it in the order of the sequencer.
+func (cc *ComboContext) executeBoth(sql string, exec func(i int) (*ResultSet, error)) (rs [2]*ResultSet, errs [2]error) {
+	var latency [2]time.Duration
+	run := func(i int) {
+		start := time.Now()
+		rs[i], errs[i] = exec(i)
+		latency[i] = time.Since(start)
+	}
+	primary, secondary := 0, 1
+	if cc.useTidbResult {
+		primary, secondary = 1, 0
+	}
+	if cc.serialize == SerializeNone {
+		run(0)
+		run(1)
+	} else {
+		keys := cc.serialKeys(sql)
+		if len(keys) == 0 {
+			run(primary)
+			run(secondary)
+		} else {
+			seq := cc.driver.sequencer()
+			t := seq.acquire(keys)
+			run(primary)
+			cc.trackTxnTables(keys)
+			seq.wait(t)
+			run(secondary)
+			seq.release(t)
+		}
+	}
+	if ls := cc.driver.latency(); ls.record(sql, latency) {
+		if plans, ok := cc.explainCurrent(); ok {
+			ls.setPlans(sql, plans)
+		}
+	}
+	return
+}
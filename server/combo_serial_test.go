@@ -0,0 +1,102 @@
+package server
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testSerialSuite{})
+
+type testSerialSuite struct {
+}
+
+func (s *testSerialSuite) TestSerialize(c *C) {
+	c.Assert(statementTables("select * from t1, `test`.t2 as b join t3 on t1.a = t3.a where a in (select a from t4)"),
+		DeepEquals, []string{"t1", "test.t2", "t3", "t4"})
+	c.Assert(statementTables("insert t (a) values (1) on duplicate key update a = 2"), DeepEquals, []string{"t"})
+	c.Assert(statementTables("select a from t for update"), DeepEquals, []string{"t"})
+	c.Assert(statementTables("begin"), HasLen, 0)
+
+	seq := newSequencer()
+	t1 := seq.acquire([]string{"a"})
+	t2 := seq.acquire([]string{"a", "b"})
+	t3 := seq.acquire([]string{"c"})
+	c.Assert(seq.ready(t1), Equals, true)
+	c.Assert(seq.ready(t2), Equals, false)
+	c.Assert(seq.ready(t3), Equals, true)
+	done := make(chan struct{})
+	go func() {
+		seq.wait(t2)
+		seq.release(t2)
+		close(done)
+	}()
+	seq.release(t1)
+	<-done
+	c.Assert(seq.ready(seq.acquire([]string{"a", "b"})), Equals, true)
+
+	cc, mc, tc := newFakeComboContext(false)
+	cc.driver = &ComboDriver{}
+	cc.serialize = SerializeTable
+	cc.db = "test"
+	c.Assert(cc.serialKeys("update T set a = 1"), DeepEquals, []string{"test.t"})
+	cc.Execute("delete from gotest.t2")
+	c.Assert(mc.executed, DeepEquals, []string{"delete from gotest.t2"})
+	c.Assert(tc.executed, DeepEquals, []string{"delete from gotest.t2"})
+	c.Assert(cc.driver.sequencer().next, DeepEquals, map[string]uint64{"gotest.t2": 1})
+
+	// the tables are in the database changed by USE, none without a database.
+	cc.Execute("use gotest")
+	c.Assert(cc.CurrentDB(), Equals, "gotest")
+	c.Assert(cc.serialKeys("update t set a = 1"), DeepEquals, []string{"gotest.t"})
+	cc.db = ""
+	c.Assert(cc.serialKeys("update t, test.t2 set a = 1"), DeepEquals, []string{"test.t2"})
+
+	// the ticket is taken before the primary backend executes the statement.
+	cc.db = "test"
+	seq = cc.driver.sequencer()
+	waiting := seq.acquire([]string{"test.t"})
+	blocked := &blockingContext{fakeContext: mc, unblock: make(chan struct{})}
+	cc.mc = blocked
+	done = make(chan struct{})
+	go func() {
+		cc.Execute("update t set a = 1")
+		close(done)
+	}()
+	for {
+		seq.mu.Lock()
+		next := seq.next["test.t"]
+		seq.mu.Unlock()
+		if next == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(blocked.unblock)
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-done:
+		c.Fatal("the statement is executed before the earlier ticket")
+	default:
+	}
+	seq.release(waiting)
+	<-done
+	c.Assert(tc.executed[len(tc.executed)-1], Equals, "update t set a = 1")
+}
+
+// blockingContext blocks executing until unblock is closed.
+type blockingContext struct {
+	*fakeContext
+	unblock chan struct{}
+}
+
+func (bc *blockingContext) Execute(sql string) (*ResultSet, error) {
+	<-bc.unblock
+	return bc.fakeContext.Execute(sql)
+}
+
+func (s *testSerialSuite) TestCheckSerialize(c *C) {
+	c.Assert(CheckSerialize(SerializeNone), IsNil)
+	c.Assert(CheckSerialize(SerializeTable), IsNil)
+	c.Assert(CheckSerialize("tables"), ErrorMatches, `unknown serialize mode "tables"`)
+}
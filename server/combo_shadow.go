@@ -0,0 +1,410 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/log"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// ShadowConfig configures the shadow mode of the combo driver. The primary
+// backend answers the client synchronously, the statements of a sampled
+// session, or the sampled read-only statements of the other sessions, are
+// queued and replayed on the shadow backend by a worker of the session, the
+// results are compared there, off the request path. The statements are
+// compared like the ones of the combo context: the non-deterministic calls are
+// handled, the diffs go through the diff rules, and the diffs following a
+// stateful divergence are consequences until the shadow session is resynced.
+//
+// When the queue of a session is full, the statement is dropped. Dropping a
+// statement which may change state stops shadowing the session, since the
+// shadow session would no longer be in the same state.
+type ShadowConfig struct {
+	// SessionRate is the fraction of the sessions whose statements are all shadowed.
+	SessionRate float64
+	// ReadOnlyRate is the fraction of the read-only statements of the other
+	// sessions to shadow, their USE and SET statements are always shadowed.
+	ReadOnlyRate float64
+	// QueueSize is the max number of statements queued for a session.
+	QueueSize int
+
+	sessions int64
+	sampled  int64
+	queued   int64
+	dropped  int64
+	compared int64
+	diverged int64
+}
+
+const defaultShadowQueueSize = 1024
+
+// ShadowStats is the counters of the shadow mode.
+type ShadowStats struct {
+	Sessions int64
+	Sampled  int64
+	Queued   int64
+	Dropped  int64
+	Compared int64
+	Diverged int64
+}
+
+func (sc *ShadowConfig) Stats() ShadowStats {
+	return ShadowStats{
+		Sessions: atomic.LoadInt64(&sc.sessions),
+		Sampled:  atomic.LoadInt64(&sc.sampled),
+		Queued:   atomic.LoadInt64(&sc.queued),
+		Dropped:  atomic.LoadInt64(&sc.dropped),
+		Compared: atomic.LoadInt64(&sc.compared),
+		Diverged: atomic.LoadInt64(&sc.diverged),
+	}
+}
+
+func (sc *ShadowConfig) LogStats() {
+	if sc == nil {
+		return
+	}
+	st := sc.Stats()
+	log.Infof("shadow: %d sessions, %d sampled, %d statements queued, %d dropped, %d compared, %d diverged",
+		st.Sessions, st.Sampled, st.Queued, st.Dropped, st.Compared, st.Diverged)
+}
+
+func (sc *ShadowConfig) resultSet() *ResultSet {
+	st := sc.Stats()
+	return newAdminResultSet("sessions", "sampled", "queued", "dropped", "compared", "diverged").
+		AddRow(st.Sessions, st.Sampled, st.Queued, st.Dropped, st.Compared, st.Diverged)
+}
+
+// stmtResult is the result of a statement and the session state after it.
+type stmtResult struct {
+	rs           *ResultSet
+	err          error
+	status       uint16
+	affectedRows uint64
+	lastInsertID uint64
+	warningCount uint16
+	latency      time.Duration
+}
+
+func newStmtResult(ctx IContext, rs *ResultSet, err error, latency time.Duration) *stmtResult {
+	return &stmtResult{
+		rs:           rs,
+		err:          err,
+		status:       ctx.Status(),
+		affectedRows: ctx.AffectedRows(),
+		lastInsertID: ctx.LastInsertID(),
+		warningCount: ctx.WarningCount(),
+		latency:      latency,
+	}
+}
+
+// newResultsCompare compares the results of mysql and tidb.
+func newResultsCompare(sql string, m, t *stmtResult) *Compare {
+	comp := &Compare{sql: sql}
+	for i, r := range [2]*stmtResult{m, t} {
+		comp.rset[i] = r.rs
+		comp.err[i] = r.err
+		comp.status[i] = r.status
+		comp.affectedRows[i] = r.affectedRows
+		comp.lastInsertID[i] = r.lastInsertID
+		comp.warningCount[i] = r.warningCount
+	}
+	return comp
+}
+
+const (
+	shadowExecute = iota
+	shadowExecuteStmt
+	shadowCloseStmt
+)
+
+type shadowTask struct {
+	kind        int
+	sql         string
+	stmtID      int
+	args        []interface{}
+	primary     *stmtResult
+	skipColumns []int
+	skipRows    bool
+}
+
+// ShadowContext answers the client with the primary backend and replays the
+// sampled statements on the shadow backend in background.
+type ShadowContext struct {
+	driver     *ComboDriver
+	cfg        *ShadowConfig
+	primary    IContext
+	nd         ndBinder
+	sampled    bool
+	stopped    bool // the session is no longer shadowed after a statement is dropped
+	stmts      map[int]IStatement
+	capability uint32
+	collation  uint8
+	dbname     string
+
+	mu     sync.Mutex
+	queue  chan *shadowTask
+	closed bool // the queue is closed, the tasks are no longer queued
+}
+
+// ShadowStatement is a prepared statement of the shadow context, it is
+// prepared on the shadow backend by the worker when it is executed.
+type ShadowStatement struct {
+	IStatement
+	sc          *ShadowContext
+	sql         string
+	skipColumns []int
+	skipRows    bool
+}
+
+func (cd *ComboDriver) openShadowCtx(capability uint32, collation uint8, dbname string) (IContext, error) {
+	primaryDriver := cd.mysqlDriver
+	if cd.UseTidbResult {
+		primaryDriver = cd.tidbDriver
+	}
+	primary, err := primaryDriver.OpenCtx(capability, collation, dbname)
+	if err != nil {
+		return nil, err
+	}
+	cfg := cd.Shadow
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultShadowQueueSize
+	}
+	sc := &ShadowContext{
+		driver:     cd,
+		cfg:        cfg,
+		primary:    primary,
+		nd:         ndBinder{mode: cd.Nondeterministic, primary: primary},
+		sampled:    rand.Float64() < cfg.SessionRate,
+		stmts:      make(map[int]IStatement),
+		queue:      make(chan *shadowTask, queueSize),
+		capability: capability,
+		collation:  collation,
+		dbname:     dbname,
+	}
+	atomic.AddInt64(&cfg.sessions, 1)
+	if sc.sampled {
+		atomic.AddInt64(&cfg.sampled, 1)
+	}
+	go sc.run()
+	return sc, nil
+}
+
+func (sc *ShadowContext) Status() uint16       { return sc.primary.Status() }
+func (sc *ShadowContext) LastInsertID() uint64 { return sc.primary.LastInsertID() }
+func (sc *ShadowContext) AffectedRows() uint64 { return sc.primary.AffectedRows() }
+func (sc *ShadowContext) WarningCount() uint16 { return sc.primary.WarningCount() }
+func (sc *ShadowContext) CurrentDB() string    { return sc.primary.CurrentDB() }
+
+func (sc *ShadowContext) Execute(sql string) (*ResultSet, error) {
+	if rs, ok, err := sc.driver.handleAdmin(sql); ok {
+		return rs, err
+	}
+	sql, skipColumns, skipRows := sc.nd.handle(sql)
+	start := time.Now()
+	rs, err := sc.primary.Execute(sql)
+	latency := time.Since(start)
+	sc.nd.executed()
+	if sc.shadowed(sql) {
+		sc.enqueue(&shadowTask{
+			kind:        shadowExecute,
+			sql:         sql,
+			primary:     newStmtResult(sc.primary, rs, err, latency),
+			skipColumns: skipColumns,
+			skipRows:    skipRows,
+		})
+	}
+	return rs, err
+}
+
+// shadowed reports whether sql should be replayed on the shadow backend.
+func (sc *ShadowContext) shadowed(sql string) bool {
+	if sc.stopped {
+		return false
+	}
+	if sc.sampled {
+		return true
+	}
+	switch sqlCommand(sql) {
+	case "use", "set":
+		return true
+	}
+	// reads in a transaction may see data the shadow session never wrote.
+	return isReadOnlySQL(sql) && sc.primary.Status()&ServerStatusInTrans == 0 && rand.Float64() < sc.cfg.ReadOnlyRate
+}
+
+// enqueue queues the task without blocking, the task is dropped if the queue
+// is full. Nothing is queued after the context is closed.
+func (sc *ShadowContext) enqueue(task *shadowTask) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		return
+	}
+	select {
+	case sc.queue <- task:
+		atomic.AddInt64(&sc.cfg.queued, 1)
+	default:
+		atomic.AddInt64(&sc.cfg.dropped, 1)
+		if task.kind == shadowCloseStmt || (task.sql != "" && !isReadOnlySQL(task.sql)) {
+			sc.stopped = true
+			log.Warningf("shadow queue full, stop shadowing the session after dropping %s", task.sql)
+		}
+	}
+}
+
+func (sc *ShadowContext) Prepare(sql string) (IStatement, []*ColumnInfo, []*ColumnInfo, error) {
+	stmt, columns, params, err := sc.primary.Prepare(sql)
+	if err != nil {
+		return nil, columns, params, err
+	}
+	ss := &ShadowStatement{IStatement: stmt, sc: sc, sql: sql}
+	ss.skipColumns, ss.skipRows = sc.nd.prepared(sql)
+	sc.stmts[stmt.ID()] = ss
+	return ss, columns, params, nil
+}
+
+func (sc *ShadowContext) GetStatement(stmtId int) IStatement {
+	return sc.stmts[stmtId]
+}
+
+func (sc *ShadowContext) FieldList(table, wildCard string) ([]*ColumnInfo, error) {
+	return sc.primary.FieldList(table, wildCard)
+}
+
+// Close closes the primary session, the worker closes the shadow session
+// after the queued statements are replayed. Closing it again does nothing.
+func (sc *ShadowContext) Close() error {
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.closed = true
+	close(sc.queue)
+	sc.mu.Unlock()
+	return sc.primary.Close()
+}
+
+// setTrace traces the primary backend only, the shadow one is used by the
+// background worker.
+func (sc *ShadowContext) setTrace(t *packetTrace) {
+	if tracer, ok := sc.primary.(wireTracer); ok {
+		tracer.setTrace(t)
+	}
+}
+
+func (ss *ShadowStatement) Execute(args ...interface{}) (*ResultSet, error) {
+	start := time.Now()
+	rs, err := ss.IStatement.Execute(args...)
+	latency := time.Since(start)
+	ss.sc.nd.executed()
+	if ss.sc.shadowed(ss.sql) {
+		ss.sc.enqueue(&shadowTask{
+			kind:        shadowExecuteStmt,
+			sql:         ss.sql,
+			stmtID:      ss.ID(),
+			args:        append([]interface{}(nil), args...),
+			primary:     newStmtResult(ss.sc.primary, rs, err, latency),
+			skipColumns: ss.skipColumns,
+			skipRows:    ss.skipRows,
+		})
+	}
+	return rs, err
+}
+
+func (ss *ShadowStatement) Close() error {
+	delete(ss.sc.stmts, ss.ID())
+	ss.sc.enqueue(&shadowTask{kind: shadowCloseStmt, stmtID: ss.ID()})
+	return ss.IStatement.Close()
+}
+
+// shadowWorker replays the tasks of a session on the shadow backend.
+type shadowWorker struct {
+	sc     *ShadowContext
+	ctx    IContext
+	stmts  map[int]IStatement // primary statement id : shadow statement
+	sync   sessionSync
+	broken bool
+}
+
+func (sc *ShadowContext) run() {
+	w := &shadowWorker{sc: sc, stmts: make(map[int]IStatement)}
+	for task := range sc.queue {
+		w.handle(task)
+	}
+	if w.ctx != nil {
+		w.ctx.Close()
+	}
+}
+
+func (w *shadowWorker) handle(task *shadowTask) {
+	if w.broken {
+		return
+	}
+	if w.ctx == nil {
+		driver := w.sc.driver.tidbDriver
+		if w.sc.driver.UseTidbResult {
+			driver = w.sc.driver.mysqlDriver
+		}
+		ctx, err := driver.OpenCtx(w.sc.capability, w.sc.collation, w.sc.dbname)
+		if err != nil {
+			log.Warningf("open shadow session error %v, stop shadowing the session", err)
+			w.broken = true
+			return
+		}
+		w.ctx = ctx
+	}
+
+	var rs *ResultSet
+	var err error
+	start := time.Now()
+	switch task.kind {
+	case shadowExecute:
+		rs, err = w.ctx.Execute(task.sql)
+	case shadowExecuteStmt:
+		stmt, ok := w.stmts[task.stmtID]
+		if !ok {
+			if stmt, _, _, err = w.ctx.Prepare(task.sql); err == nil {
+				w.stmts[task.stmtID] = stmt
+			}
+		}
+		if err == nil {
+			rs, err = stmt.Execute(task.args...)
+		}
+	case shadowCloseStmt:
+		if stmt, ok := w.stmts[task.stmtID]; ok {
+			stmt.Close()
+			delete(w.stmts, task.stmtID)
+		}
+		return
+	}
+	shadow := newStmtResult(w.ctx, rs, err, time.Since(start))
+
+	m, t := task.primary, shadow
+	if w.sc.driver.UseTidbResult {
+		m, t = shadow, task.primary
+	}
+	w.sc.driver.latency().record(task.sql, [2]time.Duration{m.latency, t.latency})
+	comp := newResultsCompare(task.sql, m, t)
+	comp.maxRowDiffs = w.sc.driver.MaxRowDiffs
+	comp.skipColumns, comp.skipRows = task.skipColumns, task.skipRows
+	atomic.AddInt64(&w.sc.cfg.compared, 1)
+	title := fmt.Sprintf("shadow diff for %s", task.sql)
+	if len(w.sync.report(w.sc.driver.Rules, title, task.sql, comp.Diffs(), comp.err, true)) > 0 {
+		atomic.AddInt64(&w.sc.cfg.diverged, 1)
+	}
+	if task.primary.err == nil {
+		w.sync.executed(task.sql)
+	}
+	// the primary session is never touched, only the shadow one is resynced.
+	resync := w.sc.driver.Resync
+	if w.sync.desynced && resync != ResyncNone && task.primary.status&ServerStatusInTrans == 0 {
+		w.sync.rollback(resync, w.ctx)
+		w.sync.resynced([2]uint16{task.primary.status, w.ctx.Status()})
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testShadowSuite{})
+
+type testShadowSuite struct {
+}
+
+func (s *testShadowSuite) TestShadow(c *C) {
+	mc, tc := newFakeContext(), newFakeContext()
+	tc.err = NewError(ErUnknownError, "shadow error")
+	cfg := &ShadowConfig{SessionRate: 1}
+	driver := &ComboDriver{mysqlDriver: &fakeDriver{mc}, tidbDriver: &fakeDriver{tc}, Shadow: cfg}
+	// the worker is run after the session is closed, so the queue overflows.
+	sc := &ShadowContext{
+		driver:  driver,
+		cfg:     cfg,
+		primary: mc,
+		nd:      ndBinder{primary: mc},
+		sampled: true,
+		stmts:   make(map[int]IStatement),
+		queue:   make(chan *shadowTask, 2),
+	}
+	_, err := sc.Execute("insert into t values (1)")
+	c.Assert(err, IsNil)
+	stmt, _, _, err := sc.Prepare("select ?")
+	c.Assert(err, IsNil)
+	c.Assert(sc.GetStatement(stmt.ID()), Equals, stmt)
+	stmt.Execute(int64(1))
+	sc.Execute("update t set a = 2")
+	c.Assert(sc.stopped, Equals, true)
+	sc.Execute("select 1")
+	c.Assert(mc.executed, DeepEquals, []string{"insert into t values (1)", "select ?", "update t set a = 2", "select 1"})
+
+	c.Assert(sc.Close(), IsNil)
+	c.Assert(sc.Close(), IsNil)
+	// the statement is closed after the session, e.g. by COM_QUIT.
+	c.Assert(stmt.Close(), IsNil)
+	sc.Execute("select 2")
+	sc.run()
+	c.Assert(tc.executed, DeepEquals, []string{"insert into t values (1)", "select ?"})
+	// the diff of the select is a consequence of the failed insert.
+	c.Assert(cfg.Stats(), Equals, ShadowStats{Queued: 2, Dropped: 1, Compared: 2, Diverged: 1})
+}
+
+func (s *testShadowSuite) TestShadowCompare(c *C) {
+	mc, tc := newFakeContext(), newFakeContext()
+	cfg := &ShadowConfig{SessionRate: 1}
+	driver := &ComboDriver{
+		mysqlDriver:      &fakeDriver{mc},
+		tidbDriver:       &fakeDriver{tc},
+		Shadow:           cfg,
+		Nondeterministic: NondeterministicSkip,
+		Resync:           ResyncRollback,
+	}
+	sc := &ShadowContext{
+		driver:  driver,
+		cfg:     cfg,
+		primary: mc,
+		nd:      ndBinder{mode: NondeterministicSkip, primary: mc},
+		sampled: true,
+		stmts:   make(map[int]IStatement),
+		queue:   make(chan *shadowTask, 8),
+	}
+	columns := []*ColumnInfo{{Name: "a"}, {Name: "b"}}
+	mc.rs = &ResultSet{Columns: columns, Rows: [][]interface{}{{int64(1), 0.5}}}
+	// the column of rand() is not compared.
+	sc.Execute("select a, rand() from t")
+	mc.err = NewError(ErDupEntry, "Duplicate entry")
+	sc.Execute("insert into t values (1)")
+	mc.err = nil
+	sc.Execute("select a, rand() from t")
+	sc.Close()
+
+	tc.rs = &ResultSet{Columns: columns, Rows: [][]interface{}{{int64(1), 0.7}}}
+	sc.run()
+	// the shadow session is rolled back after the divergence.
+	c.Assert(tc.executed, DeepEquals, []string{"select a, rand() from t", "insert into t values (1)", "ROLLBACK", "select a, rand() from t"})
+	c.Assert(cfg.Stats(), Equals, ShadowStats{Queued: 3, Compared: 3, Diverged: 1})
+}
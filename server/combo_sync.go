@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+const (
+	// ResyncNone keeps a desynced session desynced until it is closed.
+	ResyncNone = ""
+	// ResyncRollback rolls back both backends once the client transaction ends.
+	ResyncRollback = "rollback"
+	// ResyncReplay rolls back both backends and replays the setup statements
+	// (USE and SET) of the session.
+	ResyncReplay = "replay"
+)
+
+// CheckResync returns an error if mode is not a resync mode.
+func CheckResync(mode string) error {
+	switch mode {
+	case ResyncNone, ResyncRollback, ResyncReplay:
+		return nil
+	}
+	return errors.Errorf("unknown resync mode %q", mode)
+}
+
+// maxSetupStmts is the max count of setup statements kept for replay.
+const maxSetupStmts = 64
+
+// sessionSync tracks whether the sessions of the backends are still in the
+// same state. After a stateful divergence, such as a write which failed on
+// only one backend, all the following diffs of the session are consequences
+// of it, they are reported at info level until the session is resynced.
+//
+// Resynchronisation only restores the transaction and session state, data
+// written by autocommit statements on one backend only is not reverted.
+type sessionSync struct {
+	desynced     bool
+	cause        string
+	consequences int
+	setup        []string
+}
+
+// statefulDivergence reports whether diffs of sql leave the backends in different states.
+func statefulDivergence(sql string, diffs []*Diff) bool {
+	readOnly := isReadOnlySQL(sql)
+	for _, diff := range diffs {
+		switch diff.Field {
+		case "Status":
+			return true
+		case "Error", "AffectedRows", "LastInsertID", "OneSided":
+			if !readOnly {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// report reports the diffs of sql with rules and returns the diffs to act on.
+// The diffs of a desynced session are consequences, they are logged at info
+// level and nothing is returned. If sql is executed and the reported diffs
+// leave the backends in different states, the session is desynced.
+func (s *sessionSync) report(rules *DiffRuleSet, title, sql string, diffs []*Diff, errs [2]error, executed bool) []*Diff {
+	if s.desynced {
+		if len(diffs) > 0 {
+			s.consequences++
+			title = fmt.Sprintf("%s (consequence of desync at %s)", title, s.cause)
+			reported, downgraded := rules.filter(sql, diffs, errs)
+			if str := diffsString(title, append(reported, downgraded...)); str != "" {
+				log.Info(str)
+			}
+		}
+		return nil
+	}
+	reported := rules.report(title, sql, diffs, errs)
+	if executed && statefulDivergence(sql, reported) {
+		s.desynced = true
+		s.cause = sql
+		s.consequences = 0
+		log.Warningf("session desynced at %s", sql)
+	}
+	return reported
+}
+
+// executed keeps sql for replay if it is a setup statement, it is called after
+// sql succeeded on the primary backend.
+func (s *sessionSync) executed(sql string) {
+	switch sqlCommand(sql) {
+	case "use", "set":
+		s.setup = append(s.setup, sql)
+		if len(s.setup) > maxSetupStmts {
+			s.setup = s.setup[1:]
+		}
+	}
+}
+
+// rollback rolls back ctxs and replays the setup statements on them if mode
+// is ResyncReplay.
+func (s *sessionSync) rollback(mode string, ctxs ...IContext) {
+	for _, ctx := range ctxs {
+		ctx.Execute("ROLLBACK")
+	}
+	if mode != ResyncReplay {
+		return
+	}
+	for _, sql := range s.setup {
+		for _, ctx := range ctxs {
+			if _, err := ctx.Execute(sql); err != nil {
+				log.Warningf("resync replay %s failed, error %v", sql, err)
+			}
+		}
+	}
+}
+
+// resynced ends the divergence if the transaction states are the same again.
+func (s *sessionSync) resynced(status [2]uint16) {
+	if status[0]&ServerStatusInTrans != status[1]&ServerStatusInTrans {
+		log.Warningf("resync after desync at %s failed, transaction status still differs", s.cause)
+		return
+	}
+	log.Infof("session resynced after desync at %s, %d consequent diffs", s.cause, s.consequences)
+	s.desynced = false
+	s.cause = ""
+	s.consequences = 0
+}
+
+// check reports the diffs of sql and updates the divergence state of the
+// session if sql is executed, prepare and field list never change the state.
+func (cc *ComboContext) check(title, sql string, diffs []*Diff, errs [2]error, executed bool) {
+	reported := cc.sync.report(cc.rules, title, sql, diffs, errs, executed)
+	if !executed {
+		return
+	}
+	if len(reported) > 0 {
+		cc.logExplain(reported)
+		cc.reproduce()
+	}
+	cc.logStatement()
+	if cc.primaryErr(errs) == nil {
+		if db := useDB(sql); db != "" {
+			cc.db = db
+		}
+		cc.sync.executed(sql)
+	}
+
+	if cc.sync.desynced && cc.resync != ResyncNone && cc.Status()&ServerStatusInTrans == 0 {
+		cc.resyncSession()
+	}
+}
+
+func (cc *ComboContext) primaryErr(errs [2]error) error {
+	if cc.useTidbResult {
+		return errs[1]
+	}
+	return errs[0]
+}
+
+// resyncSession rolls back both backends and replays the setup statements if configured.
+func (cc *ComboContext) resyncSession() {
+	cc.sync.rollback(cc.resync, cc.mc, cc.tc)
+	cc.sync.resynced([2]uint16{cc.mc.Status(), cc.tc.Status()})
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testSyncSuite{})
+
+type testSyncSuite struct {
+}
+
+func (s *testSyncSuite) TestSessionDivergence(c *C) {
+	cc, mc, tc := newFakeComboContext(false)
+	tc.err = NewError(ErDupEntry, "Duplicate entry")
+	cc.Execute("insert into t values (1)")
+	c.Assert(cc.sync.desynced, Equals, true)
+	c.Assert(cc.sync.cause, Equals, "insert into t values (1)")
+
+	cc.Execute("select * from t")
+	c.Assert(cc.sync.consequences, Equals, 1)
+
+	cc.resync = ResyncReplay
+	tc.err = nil
+	cc.Execute("set @a = 1")
+	c.Assert(cc.sync.desynced, Equals, false)
+	c.Assert(mc.executed[len(mc.executed)-1], Equals, "set @a = 1")
+	c.Assert(tc.executed[len(tc.executed)-2], Equals, "ROLLBACK")
+
+	// a diverged read never desyncs the session.
+	tc.err = NewError(ErNoSuchTable, "no such table")
+	cc.Execute("select * from t")
+	c.Assert(cc.sync.desynced, Equals, false)
+}
+
+func (s *testSyncSuite) TestCheckResync(c *C) {
+	c.Assert(CheckResync(ResyncNone), IsNil)
+	c.Assert(CheckResync(ResyncReplay), IsNil)
+	c.Assert(CheckResync("rolback"), ErrorMatches, `unknown resync mode "rolback"`)
+}
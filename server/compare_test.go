@@ -0,0 +1,168 @@
+package server
+
+import (
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testCompareSuite{})
+
+type testCompareSuite struct {
+}
+
+func (s *testCompareSuite) TestColumnsDiffs(c *C) {
+	mCols := []*ColumnInfo{{Schema: "test", Table: "t", OrgTable: "t", Name: "a", OrgName: "a", Type: TypeLong, ColumnLength: 11}}
+	tCols := []*ColumnInfo{{Schema: "", Table: "t", OrgTable: "", Name: "a", OrgName: "a", Type: TypeLong, ColumnLength: 11}}
+	diffs := columnsDiffs("column", mCols, tCols)
+	c.Assert(diffs, HasLen, 2)
+	c.Assert(diffs[0].Field, Equals, "Schema")
+	c.Assert(diffs[0].Column, Equals, "a")
+	c.Assert(diffs[1].Field, Equals, "OrgTable")
+
+	diffs = columnsDiffs("param", mCols, nil)
+	c.Assert(diffs, HasLen, 1)
+	c.Assert(diffs[0].Field, Equals, "ParamCount")
+
+	pc := &PrepareCompare{
+		sql:      "select a from t where a = ?",
+		mColumns: mCols,
+		tColumns: mCols,
+		mParams:  []*ColumnInfo{{Type: TypeLonglong}},
+		tParams:  []*ColumnInfo{{Type: TypeBlob}},
+	}
+	diffs = pc.Diffs()
+	c.Assert(diffs, HasLen, 1)
+	c.Assert(diffs[0].Field, Equals, "Type")
+}
+
+// fakeContext is an in memory IContext which returns the preset result or error.
+type fakeContext struct {
+	rs       *ResultSet
+	err      error
+	prepErr  error
+	executed []string
+	stmts    map[int]IStatement
+	lastID   int
+}
+
+func newFakeContext() *fakeContext {
+	return &fakeContext{stmts: make(map[int]IStatement)}
+}
+
+func (fc *fakeContext) Status() uint16                 { return ServerStatusAutocommit }
+func (fc *fakeContext) LastInsertID() uint64           { return 0 }
+func (fc *fakeContext) AffectedRows() uint64           { return 0 }
+func (fc *fakeContext) WarningCount() uint16           { return 0 }
+func (fc *fakeContext) CurrentDB() string              { return "test" }
+func (fc *fakeContext) Close() error                   { return nil }
+func (fc *fakeContext) GetStatement(id int) IStatement { return fc.stmts[id] }
+
+func (fc *fakeContext) Execute(sql string) (*ResultSet, error) {
+	fc.executed = append(fc.executed, sql)
+	return fc.rs, fc.err
+}
+
+func (fc *fakeContext) Prepare(sql string) (IStatement, []*ColumnInfo, []*ColumnInfo, error) {
+	if fc.prepErr != nil {
+		return nil, nil, nil, fc.prepErr
+	}
+	// both backends start statement ids from 1, so they collide in combo mode.
+	fc.lastID++
+	stmt := &fakeStatement{id: fc.lastID, ctx: fc, sql: sql}
+	fc.stmts[stmt.id] = stmt
+	return stmt, nil, nil, nil
+}
+
+func (fc *fakeContext) FieldList(table, wildCard string) ([]*ColumnInfo, error) {
+	return nil, fc.err
+}
+
+type fakeStatement struct {
+	id     int
+	ctx    *fakeContext
+	sql    string
+	closed bool
+}
+
+func (fs *fakeStatement) ID() int                                    { return fs.id }
+func (fs *fakeStatement) AppendParam(paramId int, data []byte) error { return nil }
+func (fs *fakeStatement) NumParams() int                             { return 0 }
+func (fs *fakeStatement) BoundParams() [][]byte                      { return nil }
+func (fs *fakeStatement) Reset()                                     {}
+
+func (fs *fakeStatement) Execute(args ...interface{}) (*ResultSet, error) {
+	return fs.ctx.Execute(fs.sql)
+}
+
+func (fs *fakeStatement) Close() error {
+	fs.closed = true
+	delete(fs.ctx.stmts, fs.id)
+	return nil
+}
+
+func newFakeComboContext(useTidbResult bool) (*ComboContext, *fakeContext, *fakeContext) {
+	mc, tc := newFakeContext(), newFakeContext()
+	cc := &ComboContext{
+		useTidbResult: useTidbResult,
+		mc:            mc,
+		tc:            tc,
+		stmts:         make(map[int]IStatement),
+		nd:            ndBinder{primary: mc},
+	}
+	if useTidbResult {
+		cc.nd.primary = tc
+	}
+	return cc, mc, tc
+}
+
+func (s *testCompareSuite) TestComboPrepare(c *C) {
+	cc, mc, tc := newFakeComboContext(true)
+	mc.prepErr = NewError(ErParseError, "syntax error")
+	stmt, _, _, err := cc.Prepare("select 1")
+	c.Assert(err, IsNil)
+	_, err = stmt.Execute()
+	c.Assert(err, IsNil)
+	c.Assert(tc.executed, DeepEquals, []string{"select 1"})
+	c.Assert(mc.executed, HasLen, 0)
+
+	mc.prepErr = nil
+	stmt2, _, _, err := cc.Prepare("select 2")
+	c.Assert(err, IsNil)
+	c.Assert(stmt2.ID(), Not(Equals), stmt.ID())
+	c.Assert(cc.GetStatement(stmt2.ID()), Equals, stmt2)
+	stmt2.Close()
+	c.Assert(cc.GetStatement(stmt2.ID()), IsNil)
+
+	cc, mc, tc = newFakeComboContext(false)
+	mc.prepErr = NewError(ErParseError, "syntax error")
+	_, _, _, err = cc.Prepare("select 1")
+	c.Assert(err, NotNil)
+	c.Assert(tc.stmts, HasLen, 0)
+}
+
+type fakeDriver struct {
+	ctx *fakeContext
+}
+
+func (fd *fakeDriver) OpenCtx(capability uint32, collation uint8, dbname string) (IContext, error) {
+	return fd.ctx, nil
+}
+
+// scriptedContext returns the result set of a query from results.
+type scriptedContext struct {
+	*fakeContext
+	results map[string]*ResultSet
+}
+
+func (sc *scriptedContext) Execute(sql string) (*ResultSet, error) {
+	sc.executed = append(sc.executed, sql)
+	return sc.results[sql], nil
+}
+
+type scriptedDriver struct {
+	ctx *scriptedContext
+}
+
+func (sd *scriptedDriver) OpenCtx(capability uint32, collation uint8, dbname string) (IContext, error) {
+	return sd.ctx, nil
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"net"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/ngaut/arena"
@@ -30,11 +32,18 @@ type ClientConn struct {
 	collation    uint8
 	charset      string
 	user         string
+	admin        bool // authenticated by the credentials of the admin user
 	dbname       string
 	salt         []byte
 	alloc        arena.ArenaAllocator
 	lastCmd      string
 	ctx          IContext
+	record       *CaptureRecord // the command being captured, nil if capture is disabled
+	stmtSQL      map[int]string // the sql of the prepared statements
+	rowsSent     int            // the rows sent by the current command
+	affectedRows uint64         // the rows affected by the current command
+	infoMu       sync.Mutex
+	info         ClientInfo // the state listed by the admin api
 }
 
 func (cc *ClientConn) String() string {
@@ -44,6 +53,7 @@ func (cc *ClientConn) String() string {
 }
 
 func (cc *ClientConn) Handshake() error {
+	cc.updateTrace()
 	if err := cc.writeInitialHandshake(); err != nil {
 		return errors.Trace(err)
 	}
@@ -72,6 +82,7 @@ func (cc *ClientConn) Close() error {
 	cc.server.rwlock.Lock()
 	delete(cc.server.clients, cc.connectionId)
 	cc.server.rwlock.Unlock()
+	cc.server.tracer.forgetConn(cc.connectionId)
 	cc.conn.Close()
 	return cc.ctx.Close()
 }
@@ -151,7 +162,10 @@ func calcPassword(scramble, password []byte) []byte {
 	return scramble
 }
 
-func (cc *ClientConn) readHandshakeResponse() error {
+func (cc *ClientConn) readHandshakeResponse() (err error) {
+	defer func() {
+		cc.auditLogin(err)
+	}()
 	data, err := cc.readPacket()
 
 	if err != nil {
@@ -176,8 +190,8 @@ func (cc *ClientConn) readHandshakeResponse() error {
 	authLen := int(data[pos])
 	pos++
 	auth := data[pos : pos+authLen]
-	checkAuth := calcPassword(cc.salt, []byte(cc.server.CfgGetPwd(cc.user)))
-	if !bytes.Equal(auth, checkAuth) && !cc.server.SkipAuth() {
+	var ok bool
+	if cc.admin, ok = cc.server.login(cc.user, cc.salt, auth); !ok {
 		return errors.Trace(NewDefaultError(ErAccessDeniedError, cc.conn.RemoteAddr().String(), cc.user, "Yes"))
 	}
 
@@ -207,11 +221,15 @@ func (cc *ClientConn) Run() {
 
 	for {
 		cc.alloc.Reset()
+		cc.updateTrace()
 		data, err := cc.readPacket()
 		if err != nil {
 			if errors2.ErrorNotEqual(err, io.EOF) {
 				log.Info(err)
 			}
+			if capture := cc.server.getCapture(); capture != nil {
+				capture.Write(&CaptureRecord{Conn: cc.connectionId, Time: time.Now(), Cmd: CaptureDisconnect})
+			}
 			return
 		}
 
@@ -227,7 +245,7 @@ func (cc *ClientConn) Run() {
 	}
 }
 
-func (cc *ClientConn) dispatch(data []byte) error {
+func (cc *ClientConn) dispatch(data []byte) (err error) {
 	cmd := data[0]
 	data = data[1:]
 	if len(data) > 256 {
@@ -237,7 +255,66 @@ func (cc *ClientConn) dispatch(data []byte) error {
 	}
 	cc.lastCmd = hack.String(data)
 
+	if capture := cc.server.getCapture(); capture != nil {
+		cc.record = newCaptureRecord(cc.connectionId, cmd, data)
+		defer func() {
+			// the error is written to the client by Run after dispatch returns.
+			if err != nil {
+				cc.record.Result = errorResult(err)
+			}
+			cc.record.Duration = int64(time.Since(cc.record.Time) / time.Microsecond)
+			capture.Write(cc.record)
+			cc.record = nil
+		}()
+	}
+
+	start, name, sql := time.Now(), commandName(cmd), cc.commandSQL(cmd, data)
+	metrics.Commands.Inc(cc.server.mode, name)
+	cc.setCommand(name, sql)
+	defer func() {
+		metrics.CommandDuration.ObserveDuration(time.Since(start), cc.server.mode, name)
+		cc.setCommand("", "")
+	}()
+
+	cc.rowsSent, cc.affectedRows = 0, 0
+	if ql := cc.server.queryLog; ql != nil {
+		defer func() {
+			e := &QueryLogEntry{
+				Time:         start,
+				Conn:         cc.connectionId,
+				User:         cc.user,
+				Host:         cc.remoteHost(),
+				DB:           cc.dbname,
+				Cmd:          name,
+				SQL:          redactPasswords(sql),
+				Duration:     int64(time.Since(start) / time.Microsecond),
+				RowsSent:     cc.rowsSent,
+				RowsAffected: cc.affectedRows,
+			}
+			if err != nil {
+				e.ErrCode = toSQLError(err).Code
+			}
+			ql.Write(e)
+		}()
+	}
+
+	if ds := cc.server.digests; ds != nil && (cmd == ComQuery || cmd == ComStmtExecute) && sql != "" {
+		// the schema the statement runs in, a USE query updates it when it succeeds.
+		db := cc.dbname
+		defer func() {
+			ds.record(db, sql, time.Since(start), err != nil, cc.rowsSent, cc.affectedRows)
+		}()
+	}
+
+	if class := auditClass(cmd, sql); cc.server.audit.audited(class, cc.user) {
+		defer func() {
+			cc.auditCommand(class, name, sql, err)
+		}()
+	}
+
+	wait := time.Now()
 	token := cc.server.GetToken()
+	metrics.TokenWait.ObserveDuration(time.Since(wait))
 
 	defer func() {
 		cc.server.ReleaseToken(token)
@@ -279,6 +356,54 @@ func (cc *ClientConn) dispatch(data []byte) error {
 	return nil
 }
 
+// updateTrace switches the wire trace of the connection if the tracer is
+// changed, it's called between commands.
+func (cc *ClientConn) updateTrace() {
+	on := cc.server.tracer.Traced(cc.connectionId, cc.user)
+	if on != (cc.pkg.trace != nil) {
+		cc.setTrace(on)
+	}
+}
+
+// setTrace switches the wire trace of the connection and its backend connections.
+func (cc *ClientConn) setTrace(on bool) {
+	var client, backend *packetTrace
+	if on {
+		maxDump := cc.server.tracer.maxDump
+		client = &packetTrace{name: fmt.Sprintf("conn %d client", cc.connectionId), maxDump: maxDump}
+		backend = &packetTrace{name: fmt.Sprintf("conn %d backend", cc.connectionId), backend: true, maxDump: maxDump}
+	}
+	cc.pkg.trace = client
+	if t, ok := cc.ctx.(wireTracer); ok {
+		t.setTrace(backend)
+	}
+}
+
+// commandSQL returns the sql of a command, the sql of the prepared statement
+// for the statement commands.
+func (cc *ClientConn) commandSQL(cmd byte, data []byte) string {
+	switch cmd {
+	case ComQuery, ComInitDB, ComFieldList, ComStmtPrepare:
+		return string(data)
+	case ComStmtExecute, ComStmtClose, ComStmtReset, ComStmtSendLongData:
+		if len(data) >= 4 {
+			return cc.stmtSQL[int(binary.LittleEndian.Uint32(data[0:4]))]
+		}
+	}
+	return ""
+}
+
+func (cc *ClientConn) remoteHost() string {
+	if cc.conn == nil {
+		return ""
+	}
+	addr := cc.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
 func (cc *ClientConn) useDB(db string) (err error) {
 	_, err = cc.ctx.Execute("use " + db)
 	if err != nil {
@@ -301,6 +426,10 @@ func (cc *ClientConn) writeOK() error {
 		data = append(data, dumpUint16(cc.ctx.Status())...)
 		data = append(data, dumpUint16(cc.ctx.WarningCount())...)
 	}
+	cc.affectedRows = cc.ctx.AffectedRows()
+	if cc.record != nil {
+		cc.record.Result = okResult(cc.ctx)
+	}
 
 	err := cc.writePacket(data)
 	if err != nil {
@@ -311,11 +440,7 @@ func (cc *ClientConn) writeOK() error {
 }
 
 func (cc *ClientConn) writeError(e error) error {
-	var m *SQLError
-	var ok bool
-	if m, ok = e.(*SQLError); !ok {
-		m = NewError(ErUnknownError, e.Error())
-	}
+	m := toSQLError(e)
 
 	data := make([]byte, 4, 16+len(m.Message))
 	data = append(data, ErrHeader)
@@ -348,10 +473,41 @@ func (cc *ClientConn) writeEOF() error {
 }
 
 func (cc *ClientConn) handleQuery(sql string) (err error) {
-	rs, err := cc.ctx.Execute(sql)
+	var rs *ResultSet
+	if name, args, ok := parseAdminStatement(sql); ok && name == "trace" {
+		if !cc.admin {
+			return errors.Trace(errAdminRequired)
+		}
+		if cc.server.tracer == nil {
+			return errors.New("wire trace is not enabled")
+		}
+		rs, err = cc.server.tracer.admin(args)
+	} else if table, ok := parseMPTruncate(sql); ok {
+		if !cc.admin {
+			return errors.Trace(errAdminRequired)
+		}
+		if err = cc.server.truncateMP(table); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(cc.writeOK())
+	} else if q, ok, perr := parseMPQuery(sql); ok {
+		if !cc.admin {
+			return errors.Trace(errAdminRequired)
+		}
+		if perr != nil {
+			return errors.Trace(perr)
+		}
+		rs, err = cc.server.queryMP(q)
+	} else {
+		rs, err = cc.ctx.Execute(sql)
+	}
 	if err != nil {
 		return errors.Trace(err)
 	}
+	// the logs, the digests and the audit see the database changed by USE.
+	if db := useDB(sql); db != "" {
+		cc.dbname = db
+	}
 	if rs != nil {
 		err = cc.writeResultset(rs, false)
 	} else {
@@ -365,6 +521,9 @@ func (cc *ClientConn) handleFieldList(sql string) (err error) {
 	if err != nil {
 		return
 	}
+	if cc.record != nil {
+		cc.record.Result = &CaptureResult{Kind: "fields", Rows: len(columns)}
+	}
 	data := make([]byte, 4, 1024)
 	for _, v := range columns {
 		data = data[0:4]
@@ -380,6 +539,10 @@ func (cc *ClientConn) handleFieldList(sql string) (err error) {
 }
 
 func (cc *ClientConn) writeResultset(rs *ResultSet, binary bool) error {
+	cc.rowsSent = len(rs.Rows)
+	if cc.record != nil {
+		cc.record.Result = rowsResult(rs)
+	}
 	columnLen := dumpLengthEncodedInt(uint64(len(rs.Columns)))
 	data := cc.alloc.AllocBytesWithLen(4, 1024)
 	data = append(data, columnLen...)
@@ -15,6 +15,14 @@ func (cc *ClientConn) handleStmtPrepare(sql string) error {
 	if err != nil {
 		return err
 	}
+	if cc.stmtSQL == nil {
+		cc.stmtSQL = make(map[int]string)
+	}
+	cc.stmtSQL[stmt.ID()] = sql
+	if cc.record != nil {
+		cc.record.StmtID = stmt.ID()
+		cc.record.Result = &CaptureResult{Kind: "ok"}
+	}
 	data := make([]byte, 4, 128)
 
 	//status ok
@@ -124,6 +132,9 @@ func (cc *ClientConn) handleStmtExecute(data []byte) (err error) {
 			return err
 		}
 	}
+	if cc.record != nil {
+		cc.record.Args = captureArgs(args)
+	}
 	rs, err := stmt.Execute(args...)
 	if err != nil {
 		return err
@@ -278,6 +289,7 @@ func (cc *ClientConn) handleStmtClose(data []byte) (err error) {
 	if stmt != nil {
 		stmt.Close()
 	}
+	delete(cc.stmtSQL, stmtId)
 	return
 }
 
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// normalizeSQL replaces literals in sql with '?', lower cases keywords and
+// identifiers, and collapses white spaces and comments, so that statements
+// which only differ in constant values get the same normalized form.
+func normalizeSQL(sql string) string {
+	var buf bytes.Buffer
+	buf.Grow(len(sql))
+	for _, tok := range lexSQL(sql) {
+		if tok.space && buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		switch tok.kind {
+		case tokString, tokNumber:
+			buf.WriteByte('?')
+		case tokIdent:
+			buf.WriteString(tok.lower(sql))
+		default:
+			buf.WriteString(tok.text(sql))
+		}
+	}
+	return collapseValueLists(buf.String())
+}
+
+// sqlDigest returns the hex encoded digest of a normalized sql.
+func sqlDigest(normalized string) string {
+	sum := sha1.Sum([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// collapseValueLists rewrites "(?, ?, ?)" to "(...)" so IN lists and multi-row
+// inserts of different lengths share one digest.
+func collapseValueLists(s string) string {
+	var buf bytes.Buffer
+	buf.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '(' {
+			buf.WriteByte(s[i])
+			continue
+		}
+		j := i + 1
+		n := 0
+		for j < len(s) {
+			if s[j] == '?' {
+				n++
+				j++
+			} else if s[j] == ',' || s[j] == ' ' {
+				j++
+			} else {
+				break
+			}
+		}
+		if n > 0 && j < len(s) && s[j] == ')' {
+			buf.WriteString("(...)")
+			i = j
+			continue
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// sqlCommand returns the lower cased first keyword of sql, leading comments
+// and parentheses are skipped.
+func sqlCommand(sql string) string {
+	// the command is at the beginning, avoid lexing the whole of a large statement.
+	const maxPrefix = 1024
+	if len(sql) > maxPrefix {
+		sql = sql[:maxPrefix]
+	}
+	for _, tok := range lexSQL(sql) {
+		if tok.kind == tokIdent {
+			return tok.lower(sql)
+		}
+		if !tok.is(sql, "(") {
+			return ""
+		}
+	}
+	return ""
+}
+
+// isReadOnlySQL reports whether sql never changes data or session state. The
+// locking reads, SELECT ... INTO and the assignments of user variables are
+// not read only.
+func isReadOnlySQL(sql string) bool {
+	switch sqlCommand(sql) {
+	case "select", "show", "explain", "desc", "describe":
+	default:
+		return false
+	}
+	toks := lexSQL(sql)
+	for i, tok := range toks {
+		switch {
+		case tok.is(sql, "for") && i+1 < len(toks):
+			if toks[i+1].is(sql, "update") || toks[i+1].is(sql, "share") {
+				return false
+			}
+		case tok.is(sql, "lock") && i+1 < len(toks) && toks[i+1].is(sql, "in"):
+			return false
+		case tok.is(sql, "into"):
+			return false
+		case tok.is(sql, ":") && i+1 < len(toks) && toks[i+1].is(sql, "=") && !toks[i+1].space:
+			return false
+		}
+	}
+	return true
+}
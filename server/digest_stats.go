@@ -0,0 +1,170 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/mp/etc"
+)
+
+// DigestStats aggregates the statements of the clients per schema and
+// statement digest in every mode, the proxy-level equivalent of
+// performance_schema.events_statements_summary_by_digest. When MaxDigests
+// digests are kept, the new ones are aggregated into the row with empty
+// schema and digest.
+type DigestStats struct {
+	maxDigests int
+
+	mu      sync.Mutex
+	digests map[digestKey]*digestStat
+}
+
+type digestKey struct {
+	schema string
+	digest string
+}
+
+type digestStat struct {
+	sql          string
+	count        int64
+	errors       int64
+	latency      latencyHistogram
+	min          time.Duration
+	rowsSent     int64
+	rowsAffected int64
+	firstSeen    time.Time
+	lastSeen     time.Time
+}
+
+// DigestSummary is the statistics of a statement digest. The rows examined
+// are unknown to mp, the backends don't return them over the protocol.
+type DigestSummary struct {
+	Schema       string    `json:"schema"`
+	Digest       string    `json:"digest"`
+	SQL          string    `json:"sql"` // the normalized statement
+	Count        int64     `json:"count"`
+	Errors       int64     `json:"errors"`
+	Total        int64     `json:"total_us"`
+	Min          int64     `json:"min_us"`
+	Avg          int64     `json:"avg_us"`
+	Max          int64     `json:"max_us"`
+	P50          int64     `json:"p50_us"`
+	P95          int64     `json:"p95_us"`
+	P99          int64     `json:"p99_us"`
+	RowsSent     int64     `json:"rows_sent"`
+	RowsAffected int64     `json:"rows_affected"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// NewDigestStats returns nil if the digest statistics are disabled.
+func NewDigestStats(cfg etc.Digests) *DigestStats {
+	if cfg.MaxDigests <= 0 {
+		return nil
+	}
+	return &DigestStats{maxDigests: cfg.MaxDigests, digests: make(map[digestKey]*digestStat)}
+}
+
+// record adds an execution of sql in the schema.
+func (ds *DigestStats) record(schema, sql string, d time.Duration, failed bool, rowsSent int, rowsAffected uint64) {
+	if ds == nil {
+		return
+	}
+	normalized := normalizeSQL(sql)
+	key := digestKey{schema: schema, digest: sqlDigest(normalized)}
+	now := time.Now()
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	st, ok := ds.digests[key]
+	if !ok {
+		if len(ds.digests) >= ds.maxDigests {
+			key, normalized = digestKey{}, ""
+			st = ds.digests[key]
+		}
+		if st == nil {
+			st = &digestStat{sql: normalized, min: d, firstSeen: now}
+			ds.digests[key] = st
+		}
+	}
+	st.count++
+	if failed {
+		st.errors++
+	}
+	st.latency.observe(d)
+	if d < st.min {
+		st.min = d
+	}
+	st.rowsSent += int64(rowsSent)
+	st.rowsAffected += int64(rowsAffected)
+	st.lastSeen = now
+}
+
+// Summaries returns the statistics of the digests, the ones taking the most
+// total time first.
+func (ds *DigestStats) Summaries() []*DigestSummary {
+	if ds == nil {
+		return nil
+	}
+	us := func(d time.Duration) int64 { return int64(d / time.Microsecond) }
+	ds.mu.Lock()
+	summaries := make([]*DigestSummary, 0, len(ds.digests))
+	for key, st := range ds.digests {
+		summaries = append(summaries, &DigestSummary{
+			Schema:       key.schema,
+			Digest:       key.digest,
+			SQL:          st.sql,
+			Count:        st.count,
+			Errors:       st.errors,
+			Total:        us(st.latency.sum),
+			Min:          us(st.min),
+			Avg:          us(st.latency.mean()),
+			Max:          us(st.latency.max),
+			P50:          us(st.latency.quantile(0.5)),
+			P95:          us(st.latency.quantile(0.95)),
+			P99:          us(st.latency.quantile(0.99)),
+			RowsSent:     st.rowsSent,
+			RowsAffected: st.rowsAffected,
+			FirstSeen:    st.firstSeen,
+			LastSeen:     st.lastSeen,
+		})
+	}
+	ds.mu.Unlock()
+	sort.Sort(digestSummaries(summaries))
+	return summaries
+}
+
+type digestSummaries []*DigestSummary
+
+func (s digestSummaries) Len() int      { return len(s) }
+func (s digestSummaries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s digestSummaries) Less(i, j int) bool {
+	if s[i].Total != s[j].Total {
+		return s[i].Total > s[j].Total
+	}
+	return s[i].Digest < s[j].Digest
+}
+
+// Reset drops the statistics of all digests.
+func (ds *DigestStats) Reset() {
+	if ds == nil {
+		return
+	}
+	ds.mu.Lock()
+	ds.digests = make(map[digestKey]*digestStat)
+	ds.mu.Unlock()
+}
+
+// resultSet returns the statistics as the table mp.digests, the rows
+// examined are NULL.
+func (ds *DigestStats) resultSet() *ResultSet {
+	rs := newAdminResultSet("schema", "digest", "sql", "count", "errors",
+		"total_us", "min_us", "avg_us", "max_us", "p50_us", "p95_us", "p99_us",
+		"rows_sent", "rows_examined", "rows_affected", "first_seen", "last_seen")
+	for _, s := range ds.Summaries() {
+		rs.AddRow(s.Schema, s.Digest, s.SQL, s.Count, s.Errors,
+			s.Total, s.Min, s.Avg, s.Max, s.P50, s.P95, s.P99,
+			s.RowsSent, nil, s.RowsAffected, s.FirstSeen.Format(mpTimeFormat), s.LastSeen.Format(mpTimeFormat))
+	}
+	return rs
+}
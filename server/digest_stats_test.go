@@ -0,0 +1,82 @@
+package server
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testDigestStatsSuite{})
+
+type testDigestStatsSuite struct {
+}
+
+func (s *testDigestStatsSuite) TestDigestStats(c *C) {
+	fc := newFakeContext()
+	fc.rs = newAdminResultSet("id").AddRow(int64(1)).AddRow(int64(2))
+	cc := newCaptureConn(nil, fc)
+	cc.server.digests = NewDigestStats(etc.Digests{MaxDigests: 2})
+	cc.admin = true
+	cc.dbname = "test"
+	query := func(sql string) error {
+		return cc.dispatch(append([]byte{ComQuery}, sql...))
+	}
+	c.Assert(query("select * from t where id = 1"), IsNil)
+	c.Assert(query("SELECT * FROM t WHERE id = 22"), IsNil)
+	fc.err = errors.New("failed")
+	c.Assert(query("select * from t where id = 3"), NotNil)
+	fc.err = nil
+	c.Assert(cc.dispatch([]byte{ComPing}), IsNil)
+
+	summaries := cc.server.digests.Summaries()
+	c.Assert(summaries, HasLen, 1)
+	sum := summaries[0]
+	c.Assert(sum.Schema, Equals, "test")
+	c.Assert(sum.SQL, Equals, "select * from t where id = ?")
+	c.Assert(sum.Digest, Equals, sqlDigest(sum.SQL))
+	c.Assert(sum.Count, Equals, int64(3))
+	c.Assert(sum.Errors, Equals, int64(1))
+	c.Assert(sum.RowsSent, Equals, int64(4))
+	c.Assert(sum.Min <= sum.Avg && sum.Avg <= sum.Max && sum.P99 <= sum.Max, Equals, true)
+	c.Assert(sum.FirstSeen.After(sum.LastSeen), Equals, false)
+
+	// the digests beyond the max are aggregated into the row of empty digest.
+	c.Assert(query("select 1"), IsNil)
+	c.Assert(query("select 2 from dual"), IsNil)
+	c.Assert(query("select 3 from dual"), IsNil)
+	q, _, _ := parseMPQuery("select digest, count, rows_examined from mp.digests where sql = '' or sql like 'select ?%' order by sql")
+	rs, err := cc.server.queryMP(q)
+	c.Assert(err, IsNil)
+	c.Assert(rs.Rows, HasLen, 2)
+	c.Assert(rs.Rows[0][0], Equals, "")
+	c.Assert(rs.Rows[0][1:], DeepEquals, []interface{}{int64(2), nil})
+
+	c.Assert(query("truncate table mp.digests"), IsNil)
+	c.Assert(cc.server.digests.Summaries(), HasLen, 1)
+	c.Assert(query("truncate mp.clients"), NotNil)
+	c.Assert(fc.executed, HasLen, 6)
+	_, ok := parseMPTruncate("truncate table t")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *testDigestStatsSuite) TestDigestStatsSchema(c *C) {
+	fc := newFakeContext()
+	cc := newCaptureConn(nil, fc)
+	cc.server.digests = NewDigestStats(etc.Digests{MaxDigests: 10})
+	cc.dbname = "test"
+	query := func(sql string) error {
+		return cc.dispatch(append([]byte{ComQuery}, sql...))
+	}
+	c.Assert(query("select * from t where id = 1"), IsNil)
+	c.Assert(query("use gotest"), IsNil)
+	c.Assert(query("select * from t where id = 2"), IsNil)
+
+	schemas := make(map[string]int64)
+	for _, sum := range cc.server.digests.Summaries() {
+		if sum.SQL == "select * from t where id = ?" {
+			schemas[sum.Schema] = sum.Count
+		}
+	}
+	c.Assert(schemas, DeepEquals, map[string]int64{"test": 1, "gotest": 1})
+}
@@ -1,19 +1,42 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 
-	"github.com/ngaut/log"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/util/types"
-	"github.com/reborndb/go/errors2"
 )
 
 type ComboDriver struct {
-	UseTidbResult bool // if true use the result from ql, otherwise the result from mysql will be used.
+	UseTidbResult bool         // if true use the result from ql, otherwise the result from mysql will be used.
+	Rules         *DiffRuleSet // known differences to suppress or downgrade, may be nil.
+	Resync        string       // how to resync a desynced session, ResyncNone, ResyncRollback or ResyncReplay.
 	tidbDriver    IDriver
 	mysqlDriver   IDriver
+
+	// how to handle non-deterministic statements, NondeterministicNone, NondeterministicBind or NondeterministicSkip.
+	Nondeterministic string
+	// verify the contents of the written tables after commit if not nil.
+	Checksum *ChecksumConfig
+	// write reproducers of the divergent statements if not nil.
+	Repro *ReproConfig
+	// compare the latency of the backends per statement digest if not nil.
+	Latency *LatencyStats
+	// answer with the primary backend only and compare in background if not nil.
+	Shadow *ShadowConfig
+	// how to order the statements of the sessions, SerializeNone, SerializeGlobal or SerializeTable.
+	Serialize string
+	// capture the plans of the SELECTs which diverge or pass the latency threshold.
+	Explain bool
+	// the max number of missing, extra and changed rows listed for a statement, zero means the default.
+	MaxRowDiffs int
+
+	seqOnce sync.Once
+	seq     *sequencer
 }
 
 type ResultDesc struct {
@@ -27,129 +50,195 @@ type Compare struct {
 	lastInsertID [2]uint64
 	warningCount [2]uint16
 	err          [2]error
+	skipColumns  []int // columns whose values are not compared
+	skipRows     bool  // if true, only the columns are compared
+	maxRowDiffs  int   // the max number of row differences listed, zero means the default
+}
+
+// Diff is a single difference found when comparing the results of the backends.
+type Diff struct {
+	Field  string // the kind of the difference, such as Flag, ColumnLength or Rows.
+	Column string // the column name if the difference is about a column.
+	Msg    string
 }
 
 func (d *Compare) String() string {
-	s := "diff for " + d.sql + ":\n"
+	return diffsString("diff for "+d.sql, d.Diffs())
+}
+
+func (d *Compare) Diffs() (diffs []*Diff) {
+	add := func(field, column, format string, args ...interface{}) {
+		diffs = append(diffs, &Diff{Field: field, Column: column, Msg: fmt.Sprintf(format, args...)})
+	}
 	if d.rset[0] == nil && d.rset[1] != nil {
-		s += "expect empty result, got non-empty result.\n"
-		return s
+		add("Result", "", "expect empty result, got non-empty result.")
+		return
 	} else if d.rset[0] != nil && d.rset[1] == nil {
-		s += "expect non-empty result, got empty result.\n"
-		return s
+		add("Result", "", "expect non-empty result, got empty result.")
+		return
 	} else if d.rset[0] != nil {
 		mysqlRset := d.rset[0]
 		tidbRset := d.rset[1]
-		if len(mysqlRset.Columns) != len(tidbRset.Columns) {
-			s += fmt.Sprintf("expect columns count %d, got %d\n", len(mysqlRset.Columns), len(tidbRset.Columns))
-			return s
-		}
-
-		for i, mCol := range mysqlRset.Columns {
-			tCol := tidbRset.Columns[i]
-			if mCol.Type != tCol.Type {
-				s += fmt.Sprintf("expect column %s type %s, got %s\n", mCol.Name, types.TypeStr(mCol.Type), types.TypeStr(tCol.Type))
+		if colDiffs := columnsDiffs("column", mysqlRset.Columns, tidbRset.Columns); len(colDiffs) > 0 {
+			diffs = append(diffs, colDiffs...)
+			if colDiffs[0].Field == "ColumnCount" {
+				return
 			}
-			if mCol.ColumnLength != tCol.ColumnLength {
-				s += fmt.Sprintf("expect column %s length %d, got %d\n", mCol.Name, mCol.ColumnLength, tCol.ColumnLength)
-			}
-			if mCol.Flag != tCol.Flag {
-				s += fmt.Sprintf("expect column %s flag %d, got %d\n", mCol.Name, mCol.Flag, tCol.Flag)
-			}
-			if mCol.Charset != tCol.Charset {
-				s += fmt.Sprintf("expect column %s charset %d, got %d\n", mCol.Name, mCol.Charset, tCol.Charset)
-			}
-			if mCol.Decimal != tCol.Decimal {
-				s += fmt.Sprintf("expect column %s charset %d, got %d\n", mCol.Name, mCol.Decimal, tCol.Decimal)
-			}
-			//TODO compare more column info
 		}
 
-		if len(mysqlRset.Rows) != len(tidbRset.Rows) {
-			s += fmt.Sprintf("expect rows count %d, got %d\n", len(mysqlRset.Rows), len(tidbRset.Rows))
-			return s
+		if d.skipRows {
+			return
+		}
+		mRows, tRows := mysqlRset.Rows, tidbRset.Rows
+		if len(d.skipColumns) > 0 {
+			mRows, tRows = maskColumns(mRows, d.skipColumns), maskColumns(tRows, d.skipColumns)
 		}
-		if !reflect.DeepEqual(d.rset[0].Rows, d.rset[1].Rows) {
-			s += fmt.Sprintf("expect %v\n", d.rset[0].Rows)
-			s += fmt.Sprintf("got %v\n", d.rset[1].Rows)
+		if len(mRows) != len(tRows) {
+			add("RowCount", "", "expect rows count %d, got %d", len(mRows), len(tRows))
+			diffs = append(diffs, rowsDiffs(mysqlRset.Columns, mRows, tRows, d.skipColumns, d.maxRowDiffs)...)
+			return
+		}
+		if !reflect.DeepEqual(mRows, tRows) {
+			if rowDiffs := rowsDiffs(mysqlRset.Columns, mRows, tRows, d.skipColumns, d.maxRowDiffs); len(rowDiffs) > 0 {
+				diffs = append(diffs, rowDiffs...)
+			} else {
+				add("Rows", "", "expect the same rows in a different order")
+			}
 		}
 	}
 	if d.err[0] == nil && d.err[1] != nil {
-		s += fmt.Sprintf("expect nil error, got %s\n", d.err[1].Error())
-		return s
+		add("Error", "", "expect nil error, got %s", d.err[1].Error())
+		return
 	} else if d.err[0] != nil && d.err[1] == nil {
-		s += fmt.Sprintf("expected err %s, got nil error\n", d.err[0])
-		return s
+		add("Error", "", "expected err %s, got nil error", d.err[0])
+		return
 	}
-	if errors2.ErrorNotEqual(d.err[0], d.err[1]) {
-		s += fmt.Sprintf("expected err %s, got %s\n", d.err[0], d.err[1])
-		return s
+	if !errorsEqual(d.err[0], d.err[1]) {
+		add("Error", "", "expected err %s, got %s", toSQLError(d.err[0]), toSQLError(d.err[1]))
+		return
 	}
 	if d.rset[0] == nil && d.rset[1] == nil {
 		if d.affectedRows[0] != d.affectedRows[1] {
-			s += fmt.Sprintf("expect affected rows %d, got %d\n", d.affectedRows[0], d.affectedRows[1])
-			return s
+			add("AffectedRows", "", "expect affected rows %d, got %d", d.affectedRows[0], d.affectedRows[1])
+			return
 		}
 		if d.lastInsertID[0] != d.lastInsertID[1] {
-			s += fmt.Sprintf("expect last insert ID %d, got %d\n", d.lastInsertID[0], d.lastInsertID[1])
-			return s
+			add("LastInsertID", "", "expect last insert ID %d, got %d", d.lastInsertID[0], d.lastInsertID[1])
+			return
 		}
 	}
 	if d.status[0] != d.status[1] {
-		s += fmt.Sprintf("expect status %d, got %d\n", d.status[0], d.status[1])
-		return s
+		add("Status", "", "expect status %d, got %d", d.status[0], d.status[1])
+		return
 	}
 	if d.warningCount[0] != d.warningCount[1] {
-		s += fmt.Sprintf("expect warning count %d, %d\n", d.warningCount[0], d.warningCount[1])
-		return s
+		add("WarningCount", "", "expect warning count %d, %d", d.warningCount[0], d.warningCount[1])
+		return
 	}
-	return "" // no diffierence return empty string
+	return // no diffierence
+}
+
+// diffsString formats diffs under title, it returns empty string if there is no diff.
+func diffsString(title string, diffs []*Diff) string {
+	if len(diffs) == 0 {
+		return ""
+	}
+	s := title + ":\n"
+	for _, diff := range diffs {
+		s += diff.Msg + "\n"
+	}
+	return s
 }
 
 //Combo context will send request to both mysql and tidb, then compare the results
 type ComboContext struct {
 	useTidbResult bool
+	rules         *DiffRuleSet
+	resync        string
+	sync          sessionSync
 	mc            IContext
 	tc            IContext
 	stmts         map[int]IStatement
+	lastStmtID    int
+
+	nd ndBinder
+
+	driver         *ComboDriver
+	capability     uint32
+	collation      uint8
+	db             string // the current database of the session
+	checksum       *ChecksumConfig
+	pendingTables  map[string]bool // tables written in the current transaction
+	checksumWorker *checksumWorker // verifies the written tables, started on the first commit
+	verifyCtx      [2]IContext     // connections to explain the statements
+
+	repro   *ReproConfig
+	history []*reproStmt // the statements which may change state, for reproducers
+	current *reproStmt   // the statement being executed
+
+	serialize string
+	txnTables map[string]bool // tables touched in the current transaction, for table serialisation
+	explain   bool
 }
 
+// ComboStatement is a prepared statement of the combo context, its id is
+// assigned by the combo context so ids of the backends never collide. If the
+// statement failed to prepare on the backend whose result is not used, the
+// statement only exists on one backend and is executed there only.
 type ComboStatement struct {
+	id  int
 	cc  *ComboContext
 	sql string
 	ms  IStatement
 	ts  IStatement
+	// non-deterministic calls of a prepared statement can not be bound to
+	// literals, their columns are skipped in both bind and skip modes.
+	skipColumns []int
+	skipRows    bool
 }
 
 func (cs *ComboStatement) ID() int {
+	return cs.id
+}
+
+// primary returns the statement whose result is returned to the client.
+func (cs *ComboStatement) primary() IStatement {
 	if cs.cc.useTidbResult {
-		return cs.ts.ID()
-	} else {
-		return cs.ms.ID()
+		return cs.ts
 	}
+	return cs.ms
 }
 
-func (cs *ComboStatement) Execute(args ...interface{}) (*ResultSet, error) {
-	mrs, merr := cs.ms.Execute(args...)
-	trs, terr := cs.ts.Execute(args...)
-	comp := new(Compare)
-	comp.sql = cs.sql
-	comp.rset[0] = mrs
-	comp.rset[1] = trs
-	comp.affectedRows[0] = cs.cc.mc.AffectedRows()
-	comp.affectedRows[1] = cs.cc.tc.AffectedRows()
-	comp.lastInsertID[0] = cs.cc.mc.LastInsertID()
-	comp.lastInsertID[1] = cs.cc.tc.LastInsertID()
-	comp.status[0] = cs.cc.mc.Status()
-	comp.status[1] = cs.cc.tc.Status()
-	comp.warningCount[0] = cs.cc.mc.WarningCount()
-	comp.warningCount[1] = cs.cc.tc.WarningCount()
-	comp.err[0] = merr
-	comp.err[1] = terr
-	compStr := comp.String()
-	if compStr != "" {
-		log.Warning(compStr)
+// oneSided returns the backend name the statement is prepared on if the
+// statement only exists on one backend, otherwise returns empty string.
+func (cs *ComboStatement) oneSided() string {
+	if cs.ms == nil {
+		return "tidb"
+	} else if cs.ts == nil {
+		return "mysql"
 	}
+	return ""
+}
+
+func (cs *ComboStatement) Execute(args ...interface{}) (*ResultSet, error) {
+	cs.cc.current = &reproStmt{sql: cs.sql, args: append([]interface{}(nil), args...), prepared: true}
+	if side := cs.oneSided(); side != "" {
+		rs, err := cs.primary().Execute(args...)
+		cs.cc.check("diff for "+cs.sql, cs.sql, []*Diff{{
+			Field: "OneSided",
+			Msg:   fmt.Sprintf("statement is only prepared on %s, skip comparing", side),
+		}}, [2]error{}, true)
+		return rs, err
+	}
+	stmts := [2]IStatement{cs.ms, cs.ts}
+	results, errs := cs.cc.executeBoth(cs.sql, func(i int) (*ResultSet, error) {
+		return stmts[i].Execute(args...)
+	})
+	mrs, trs, merr, terr := results[0], results[1], errs[0], errs[1]
+	comp := cs.cc.newCompare(cs.sql, mrs, trs, merr, terr)
+	comp.skipColumns, comp.skipRows = cs.skipColumns, cs.skipRows
+	cs.cc.check("diff for "+comp.sql, comp.sql, comp.Diffs(), comp.err, true)
+	cs.cc.trackWrite(cs.sql, comp.err)
 	if cs.cc.useTidbResult {
 		return trs, terr
 	}
@@ -157,38 +246,42 @@ func (cs *ComboStatement) Execute(args ...interface{}) (*ResultSet, error) {
 }
 
 func (cs *ComboStatement) AppendParam(paramId int, data []byte) error {
-	err := cs.ts.AppendParam(paramId, data)
-	if err != nil {
-		return err
+	if cs.ts != nil {
+		if err := cs.ts.AppendParam(paramId, data); err != nil {
+			return err
+		}
+	}
+	if cs.ms != nil {
+		return cs.ms.AppendParam(paramId, data)
 	}
-	return cs.ms.AppendParam(paramId, data)
+	return nil
 }
 
 func (cs *ComboStatement) NumParams() int {
-	if cs.cc.useTidbResult {
-		return cs.ts.NumParams()
-	} else {
-		return cs.ms.NumParams()
-	}
+	return cs.primary().NumParams()
 }
 
 func (cs *ComboStatement) BoundParams() [][]byte {
-	if cs.cc.useTidbResult {
-		return cs.ts.BoundParams()
-	} else {
-		return cs.ms.BoundParams()
-	}
+	return cs.primary().BoundParams()
 }
 
 func (cs *ComboStatement) Reset() {
-	cs.ts.Reset()
-	cs.ms.Reset()
+	if cs.ts != nil {
+		cs.ts.Reset()
+	}
+	if cs.ms != nil {
+		cs.ms.Reset()
+	}
 }
 
 func (cs *ComboStatement) Close() error {
-	cs.ts.Close()
-	cs.ms.Close()
-	delete(cs.cc.stmts, cs.ID())
+	if cs.ts != nil {
+		cs.ts.Close()
+	}
+	if cs.ms != nil {
+		cs.ms.Close()
+	}
+	delete(cs.cc.stmts, cs.id)
 	return nil
 }
 
@@ -200,7 +293,18 @@ func NewComboDriver(useTidbResult bool, myDriver IDriver, store kv.Storage) *Com
 	}
 }
 
+// latency returns the latency stats, it may be called on a nil driver.
+func (cd *ComboDriver) latency() *LatencyStats {
+	if cd == nil {
+		return nil
+	}
+	return cd.Latency
+}
+
 func (cd *ComboDriver) OpenCtx(capability uint32, collation uint8, dbname string) (IContext, error) {
+	if cd.Shadow != nil {
+		return cd.openShadowCtx(capability, collation, dbname)
+	}
 	mc, err := cd.mysqlDriver.OpenCtx(capability, collation, dbname)
 	if err != nil {
 		return nil, err
@@ -213,7 +317,22 @@ func (cd *ComboDriver) OpenCtx(capability uint32, collation uint8, dbname string
 		mc:            mc,
 		tc:            tc,
 		useTidbResult: cd.UseTidbResult,
+		rules:         cd.Rules,
+		resync:        cd.Resync,
 		stmts:         make(map[int]IStatement),
+		nd:            ndBinder{mode: cd.Nondeterministic, primary: mc},
+
+		driver:     cd,
+		capability: capability,
+		collation:  collation,
+		db:         dbname,
+		checksum:   cd.Checksum,
+		repro:      cd.Repro,
+		serialize:  cd.Serialize,
+		explain:    cd.Explain,
+	}
+	if cd.UseTidbResult {
+		comCtx.nd.primary = tc
 	}
 	return comCtx, nil
 }
@@ -239,11 +358,10 @@ func (cc *ComboContext) AffectedRows() uint64 {
 	return cc.mc.AffectedRows()
 }
 
+// CurrentDB returns the current database of the session, it follows the USE
+// statements which succeeded on the primary backend.
 func (cc *ComboContext) CurrentDB() string {
-	if cc.useTidbResult {
-		return cc.tc.CurrentDB()
-	}
-	return cc.mc.CurrentDB()
+	return cc.db
 }
 
 func (cc *ComboContext) WarningCount() uint16 {
@@ -256,34 +374,73 @@ func (cc *ComboContext) WarningCount() uint16 {
 func (cc *ComboContext) Close() error {
 	cc.mc.Close()
 	cc.tc.Close()
+	if cc.checksumWorker != nil {
+		cc.checksumWorker.close()
+	}
+	for _, ctx := range cc.verifyCtx {
+		if ctx != nil {
+			ctx.Close()
+		}
+	}
 	return nil
 }
 
+func (cc *ComboContext) setTrace(t *packetTrace) {
+	for _, ctx := range []IContext{cc.mc, cc.tc} {
+		if tracer, ok := ctx.(wireTracer); ok {
+			tracer.setTrace(t)
+		}
+	}
+}
+
 func (cc *ComboContext) Execute(sql string) (rs *ResultSet, err error) {
-	mrs, merr := cc.mc.Execute(sql)
-	trs, terr := cc.tc.Execute(sql)
+	if rs, ok, err := cc.driver.handleAdmin(sql); ok {
+		return rs, err
+	}
+	sql, skipColumns, skipRows := cc.nd.handle(sql)
+	cc.current = &reproStmt{sql: sql}
+	ctxs := [2]IContext{cc.mc, cc.tc}
+	results, errs := cc.executeBoth(sql, func(i int) (*ResultSet, error) {
+		return ctxs[i].Execute(sql)
+	})
+	mrs, trs, merr, terr := results[0], results[1], errs[0], errs[1]
+	comp := cc.newCompare(sql, mrs, trs, merr, terr)
+	comp.skipColumns, comp.skipRows = skipColumns, skipRows
+	cc.check("diff for "+sql, sql, comp.Diffs(), comp.err, true)
+	cc.trackWrite(sql, comp.err)
+	if cc.useTidbResult {
+		return trs, terr
+	}
+	return mrs, merr
+}
+
+// newCompare collects the results and the session states of both backends after executing sql.
+func (cc *ComboContext) newCompare(sql string, mrs, trs *ResultSet, merr, terr error) *Compare {
+	cc.nd.executed()
+	comp := newContextsCompare(sql, cc.mc, cc.tc, mrs, trs, merr, terr)
+	if cc.driver != nil {
+		comp.maxRowDiffs = cc.driver.MaxRowDiffs
+	}
+	return comp
+}
+
+// newContextsCompare collects the results and the session states of mc and tc.
+func newContextsCompare(sql string, mc, tc IContext, mrs, trs *ResultSet, merr, terr error) *Compare {
 	comp := new(Compare)
 	comp.sql = sql
 	comp.rset[0] = mrs
 	comp.rset[1] = trs
-	comp.affectedRows[0] = cc.mc.AffectedRows()
-	comp.affectedRows[1] = cc.tc.AffectedRows()
-	comp.lastInsertID[0] = cc.mc.LastInsertID()
-	comp.lastInsertID[1] = cc.tc.LastInsertID()
-	comp.status[0] = cc.mc.Status()
-	comp.status[1] = cc.tc.Status()
-	comp.warningCount[0] = cc.mc.WarningCount()
-	comp.warningCount[1] = cc.tc.WarningCount()
+	comp.affectedRows[0] = mc.AffectedRows()
+	comp.affectedRows[1] = tc.AffectedRows()
+	comp.lastInsertID[0] = mc.LastInsertID()
+	comp.lastInsertID[1] = tc.LastInsertID()
+	comp.status[0] = mc.Status()
+	comp.status[1] = tc.Status()
+	comp.warningCount[0] = mc.WarningCount()
+	comp.warningCount[1] = tc.WarningCount()
 	comp.err[0] = merr
 	comp.err[1] = terr
-	compStr := comp.String()
-	if compStr != "" {
-		log.Warning(compStr)
-	}
-	if cc.useTidbResult {
-		return trs, terr
-	}
-	return mrs, merr
+	return comp
 }
 
 type PrepareCompare struct {
@@ -297,30 +454,118 @@ type PrepareCompare struct {
 }
 
 func (pc *PrepareCompare) String() string {
-	s := "diff for prepare " + pc.sql + ":\n"
-	if len(pc.tParams) != len(pc.mParams) {
-		s += fmt.Sprintf("expect params count %d, got %d\n", len(pc.mParams), len(pc.tParams))
-		return s
-	}
-	for i, tParam := range pc.tParams {
-		mParam := pc.mParams[i]
-		if tParam.Type != mParam.Type {
-			s += fmt.Sprintf("expect param %d type %s, got %s\n", i, types.TypeStr(mParam.Type), types.TypeStr(tParam.Type))
-			return s
-		}
+	return diffsString("diff for prepare "+pc.sql, pc.Diffs())
+}
+
+func (pc *PrepareCompare) Diffs() (diffs []*Diff) {
+	add := func(field, format string, args ...interface{}) {
+		diffs = append(diffs, &Diff{Field: field, Msg: fmt.Sprintf(format, args...)})
 	}
 	if pc.mErr == nil && pc.tErr != nil {
-		s += fmt.Sprintf("expect nil error, got %s\n", pc.tErr.Error())
-		return s
+		add("Error", "expect nil error, got %s", pc.tErr.Error())
+		return
 	} else if pc.mErr != nil && pc.tErr == nil {
-		s += fmt.Sprintf("expected err %s, got nil error\n", pc.mErr)
-		return s
+		add("Error", "expected err %s, got nil error", pc.mErr)
+		return
 	}
-	if errors2.ErrorNotEqual(pc.mErr, pc.tErr) {
-		s += fmt.Sprintf("expected err %s, got %s\n", pc.mErr, pc.tErr)
-		return s
+	if !errorsEqual(pc.mErr, pc.tErr) {
+		add("Error", "expected err %s, got %s", toSQLError(pc.mErr), toSQLError(pc.tErr))
+		return
 	}
-	return ""
+	diffs = append(diffs, columnsDiffs("param", pc.mParams, pc.tParams)...)
+	diffs = append(diffs, columnsDiffs("column", pc.mColumns, pc.tColumns)...)
+	return
+}
+
+// FieldListCompare compares the field list responses of mysql and tidb.
+type FieldListCompare struct {
+	table    string
+	mColumns []*ColumnInfo
+	tColumns []*ColumnInfo
+	mErr     error
+	tErr     error
+}
+
+func (fc *FieldListCompare) String() string {
+	return diffsString("diff for field list "+fc.table, fc.Diffs())
+}
+
+func (fc *FieldListCompare) Diffs() (diffs []*Diff) {
+	add := func(format string, args ...interface{}) {
+		diffs = append(diffs, &Diff{Field: "Error", Msg: fmt.Sprintf(format, args...)})
+	}
+	if fc.mErr == nil && fc.tErr != nil {
+		add("expect nil error, got %s", fc.tErr.Error())
+		return
+	} else if fc.mErr != nil && fc.tErr == nil {
+		add("expected err %s, got nil error", fc.mErr)
+		return
+	}
+	if !errorsEqual(fc.mErr, fc.tErr) {
+		add("expected err %s, got %s", toSQLError(fc.mErr), toSQLError(fc.tErr))
+		return
+	}
+	return columnsDiffs("column", fc.mColumns, fc.tColumns)
+}
+
+// columnsDiffs compares every field of the column infos, kind is "column" or "param".
+// If the counts differ, a single ColumnCount or ParamCount diff is returned.
+func columnsDiffs(kind string, mCols, tCols []*ColumnInfo) (diffs []*Diff) {
+	if len(mCols) != len(tCols) {
+		field := "ColumnCount"
+		if kind == "param" {
+			field = "ParamCount"
+		}
+		return []*Diff{{Field: field, Msg: fmt.Sprintf("expect %ss count %d, got %d", kind, len(mCols), len(tCols))}}
+	}
+	for i, mCol := range mCols {
+		tCol := tCols[i]
+		name := mCol.Name
+		if kind == "param" || name == "" {
+			name = fmt.Sprintf("%d", i)
+		}
+		add := func(field string, expect, got interface{}) {
+			diffs = append(diffs, &Diff{
+				Field:  field,
+				Column: mCol.Name,
+				Msg:    fmt.Sprintf("expect %s %s %s %v, got %v", kind, name, strings.ToLower(field), expect, got),
+			})
+		}
+		if mCol.Schema != tCol.Schema {
+			add("Schema", mCol.Schema, tCol.Schema)
+		}
+		if mCol.Table != tCol.Table {
+			add("Table", mCol.Table, tCol.Table)
+		}
+		if mCol.OrgTable != tCol.OrgTable {
+			add("OrgTable", mCol.OrgTable, tCol.OrgTable)
+		}
+		if mCol.Name != tCol.Name {
+			add("Name", mCol.Name, tCol.Name)
+		}
+		if mCol.OrgName != tCol.OrgName {
+			add("OrgName", mCol.OrgName, tCol.OrgName)
+		}
+		if mCol.Type != tCol.Type {
+			add("Type", types.TypeStr(mCol.Type), types.TypeStr(tCol.Type))
+		}
+		if mCol.ColumnLength != tCol.ColumnLength {
+			add("ColumnLength", mCol.ColumnLength, tCol.ColumnLength)
+		}
+		if mCol.Flag != tCol.Flag {
+			add("Flag", mCol.Flag, tCol.Flag)
+		}
+		if mCol.Charset != tCol.Charset {
+			add("Charset", mCol.Charset, tCol.Charset)
+		}
+		if mCol.Decimal != tCol.Decimal {
+			add("Decimal", mCol.Decimal, tCol.Decimal)
+		}
+		if mCol.DefaultValueLength != tCol.DefaultValueLength || !bytes.Equal(mCol.DefaultValue, tCol.DefaultValue) {
+			add("DefaultValue", string(mCol.DefaultValue), string(tCol.DefaultValue))
+		}
+	}
+	return
 }
 
 func (cc *ComboContext) Prepare(sql string) (statement IStatement, columns, params []*ColumnInfo, err error) {
@@ -336,29 +581,39 @@ func (cc *ComboContext) Prepare(sql string) (statement IStatement, columns, para
 		tErr:     tErr,
 	}
 
-	compStr := prepareCompare.String()
-	if len(compStr) != 0 {
-		log.Warning(compStr)
+	cc.check("diff for prepare "+sql, sql, prepareCompare.Diffs(), [2]error{mErr, tErr}, false)
+	if mErr != nil {
+		mStatement = nil
+	}
+	if tErr != nil {
+		tStatement = nil
+	}
+	if cc.useTidbResult {
+		columns, params, err = tColumns, tParams, tErr
+	} else {
+		columns, params, err = mColumns, mParams, mErr
 	}
-	if mErr == nil && tErr != nil {
-		// both prepare must be executed successfully, or we will get panic later.
-		err = tErr
+	if err != nil {
+		// the client never sees the statement, close the one prepared on the other backend.
+		if mStatement != nil {
+			mStatement.Close()
+		}
+		if tStatement != nil {
+			tStatement.Close()
+		}
 		return
 	}
+	cc.lastStmtID++
 	comboStmt := &ComboStatement{
+		id:  cc.lastStmtID,
 		cc:  cc,
 		sql: sql,
 		ms:  mStatement,
 		ts:  tStatement,
 	}
+	comboStmt.skipColumns, comboStmt.skipRows = cc.nd.prepared(sql)
+	cc.stmts[comboStmt.id] = comboStmt
 	statement = comboStmt
-	if cc.useTidbResult {
-		cc.stmts[tStatement.ID()] = comboStmt
-		columns, params, err = tColumns, tParams, tErr
-	} else {
-		cc.stmts[mStatement.ID()] = comboStmt
-		columns, params, err = mColumns, mParams, mErr
-	}
 	return
 }
 
@@ -367,5 +622,18 @@ func (cc *ComboContext) GetStatement(stmtId int) IStatement {
 }
 
 func (cc *ComboContext) FieldList(tableName, wildCard string) (columns []*ColumnInfo, err error) {
-	return cc.mc.FieldList(tableName, wildCard)
+	mColumns, mErr := cc.mc.FieldList(tableName, wildCard)
+	tColumns, tErr := cc.tc.FieldList(tableName, wildCard)
+	fieldListCompare := &FieldListCompare{
+		table:    tableName,
+		mColumns: mColumns,
+		tColumns: tColumns,
+		mErr:     mErr,
+		tErr:     tErr,
+	}
+	cc.check("diff for field list "+tableName, tableName, fieldListCompare.Diffs(), [2]error{mErr, tErr}, false)
+	if cc.useTidbResult {
+		return tColumns, tErr
+	}
+	return mColumns, mErr
 }
@@ -198,6 +198,7 @@ func (ms *MysqlStatement) sendExecuteCommand(args ...interface{}) error {
 }
 
 func (ms *MysqlStatement) Execute(args ...interface{}) (rs *ResultSet, err error) {
+	defer func() { countBackendError("mysql", err) }()
 	ms.Reset()
 	if len(args) != ms.NumParams() {
 		return nil, fmt.Errorf(
@@ -286,6 +287,7 @@ func (mc *MysqlConn) connect(addr string, user string, password string, db strin
 
 	mc.conn = netConn
 	mc.pkg = NewPacketIO(netConn)
+	mc.pkg.countBytes("backend")
 
 	if err := mc.readInitialHandshake(); err != nil {
 		mc.conn.Close()
@@ -304,6 +306,15 @@ func (mc *MysqlConn) connect(addr string, user string, password string, db strin
 	return nil
 }
 
+func (mc *MysqlConn) setTrace(t *packetTrace) {
+	if t != nil {
+		traced := *t
+		traced.name += " " + mc.addr
+		t = &traced
+	}
+	mc.pkg.trace = t
+}
+
 func (mc *MysqlConn) readPacket() ([]byte, error) {
 	d, err := mc.pkg.ReadPacket()
 	mc.pkgErr = err
@@ -497,11 +508,14 @@ func (mc *MysqlConn) GetDB() string {
 	return mc.db
 }
 
-func (mc *MysqlConn) Execute(command string) (*ResultSet, error) {
-	return mc.exec(command)
+func (mc *MysqlConn) Execute(command string) (rs *ResultSet, err error) {
+	rs, err = mc.exec(command)
+	countBackendError("mysql", err)
+	return
 }
 
-func (mc *MysqlConn) FieldList(table string, wildcard string) ([]*ColumnInfo, error) {
+func (mc *MysqlConn) FieldList(table string, wildcard string) (columns []*ColumnInfo, err error) {
+	defer func() { countBackendError("mysql", err) }()
 	if err := mc.writeCommandStrStr(byte(ComFieldList), table, wildcard); err != nil {
 		return nil, err
 	}
@@ -744,6 +758,7 @@ func (mc *MysqlConn) readResult(binary bool) (*ResultSet, error) {
 }
 
 func (mc *MysqlConn) Prepare(query string) (stmt IStatement, columns, params []*ColumnInfo, err error) {
+	defer func() { countBackendError("mysql", err) }()
 	if err = mc.writeCommandBuf(byte(ComStmtPrepare), hack.Slice(query)); err != nil {
 		return
 	}
@@ -38,6 +38,10 @@ func (ts *TidbStatement) ID() int {
 }
 
 func (ts *TidbStatement) Execute(args ...interface{}) (rs *ResultSet, err error) {
+	defer func() {
+		err = classifyTidbError(err)
+		countBackendError("tidb", err)
+	}()
 	tidbRecordset, err := ts.ctx.session.ExecutePreparedStmt(ts.id, args...)
 	if err != nil {
 		return nil, err
@@ -102,7 +106,7 @@ func (qd *TidbDriver) OpenCtx(capability uint32, collation uint8, dbname string)
 	if dbname != "" {
 		_, err := session.Execute("use " + dbname)
 		if err != nil {
-			return nil, err
+			return nil, classifyTidbError(err)
 		}
 	}
 	tc := &TidbContext{
@@ -134,6 +138,10 @@ func (tc *TidbContext) WarningCount() uint16 {
 }
 
 func (tc *TidbContext) Execute(sql string) (rs *ResultSet, err error) {
+	defer func() {
+		err = classifyTidbError(err)
+		countBackendError("tidb", err)
+	}()
 	qrsList, err := tc.session.Execute(sql)
 	if err != nil {
 		return
@@ -187,6 +195,10 @@ func (tc *TidbContext) GetStatement(stmtId int) IStatement {
 }
 
 func (tc *TidbContext) Prepare(sql string) (statement IStatement, columns, params []*ColumnInfo, err error) {
+	defer func() {
+		err = classifyTidbError(err)
+		countBackendError("tidb", err)
+	}()
 	stmtId, paramCount, fields, err := tc.session.PrepareStmt(sql)
 	if err != nil {
 		return
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"regexp"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// tidbErrors maps the error values of tidb to mysql error codes. Only the
+// write conflicts are mapped to ErLockDeadlock, the clients retry the whole
+// transaction on it.
+var tidbErrors = map[error]uint16{
+	kv.ErrKeyExists:    ErDupEntry,
+	kv.ErrLockConflict: ErLockDeadlock,
+}
+
+// errorPattern maps the errors whose message matches re to a mysql error code.
+type errorPattern struct {
+	re   *regexp.Regexp
+	code uint16
+}
+
+// tidbErrorPatterns classifies the errors tidb returns as plain errors, the
+// first matching pattern wins.
+var tidbErrorPatterns = []errorPattern{
+	{regexp.MustCompile(`(?i)duplicate entry|key already exist`), ErDupEntry},
+	{regexp.MustCompile(`(?i)table .* doesn't exist|table .* not exist`), ErNoSuchTable},
+	{regexp.MustCompile(`(?i)unknown table`), ErBadTableError},
+	{regexp.MustCompile(`(?i)table .* already exists|table .* exists`), ErTableExistsError},
+	{regexp.MustCompile(`(?i)unknown database|database .* not exist`), ErBadDb},
+	{regexp.MustCompile(`(?i)can't create database|database .* exists`), ErDbCreateExists},
+	{regexp.MustCompile(`(?i)can't drop database`), ErDbDropExists},
+	{regexp.MustCompile(`(?i)no database selected`), ErNoDbError},
+	{regexp.MustCompile(`(?i)unknown column|column .* not found`), ErBadFieldError},
+	{regexp.MustCompile(`(?i)column .* is ambiguous`), ErNonUniq},
+	{regexp.MustCompile(`(?i)duplicate column`), ErDupFieldname},
+	{regexp.MustCompile(`(?i)duplicate key name|duplicate index`), ErDupKeyname},
+	{regexp.MustCompile(`(?i)column count doesn't match`), ErWrongValueCountOnRow},
+	{regexp.MustCompile(`(?i)cannot be null|can not be null`), ErBadNullError},
+	{regexp.MustCompile(`(?i)data too long`), ErDataTooLong},
+	{regexp.MustCompile(`(?i)out of range`), ErWarnDataOutOfRange},
+	{regexp.MustCompile(`(?i)division by (0|zero)`), ErDivisionByZero},
+	{regexp.MustCompile(`(?i)incorrect .* value|invalid time format`), ErTruncatedWrongValue},
+	{regexp.MustCompile(`(?i)lock conflict`), ErLockDeadlock},
+	{regexp.MustCompile(`(?i)syntax error|parse error`), ErParseError},
+}
+
+// classifyTidbError converts an error returned by tidb to the *SQLError of
+// the mysql error code and SQLSTATE of the same meaning, the ones which can
+// not be classified are ErUnknownError. The message is kept. It is only
+// applied by the tidb driver, the errors of the other backends and of the
+// network are never matched with the patterns of tidb.
+func classifyTidbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	cause := errors.Cause(err)
+	if _, ok := cause.(*SQLError); ok {
+		return err
+	}
+	if code, ok := tidbErrors[cause]; ok {
+		return NewError(code, cause.Error())
+	}
+	msg := cause.Error()
+	for _, p := range tidbErrorPatterns {
+		if p.re.MatchString(msg) {
+			return NewError(p.code, msg)
+		}
+	}
+	return NewError(ErUnknownError, msg)
+}
+
+// toSQLError converts err to the *SQLError the client receives, the errors
+// which are not a *SQLError are ErUnknownError. The message is kept.
+func toSQLError(err error) *SQLError {
+	cause := errors.Cause(err)
+	if m, ok := cause.(*SQLError); ok {
+		return m
+	}
+	return NewError(ErUnknownError, cause.Error())
+}
+
+// errorsEqual reports whether the errors mean the same to the client. The
+// classified errors are compared by code, the unknown ones by message.
+func errorsEqual(e1, e2 error) bool {
+	if e1 == nil || e2 == nil {
+		return e1 == e2
+	}
+	m1, m2 := toSQLError(e1), toSQLError(e2)
+	if m1.Code != m2.Code {
+		return false
+	}
+	if m1.Code == ErUnknownError {
+		return m1.Message == m2.Message
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testErrClassSuite{})
+
+type testErrClassSuite struct {
+}
+
+func (s *testErrClassSuite) TestErrorEquivalence(c *C) {
+	dup := NewError(ErDupEntry, "Duplicate entry '1' for key 'PRIMARY'")
+	c.Assert(toSQLError(errors.Trace(dup)), Equals, dup)
+	m := toSQLError(classifyTidbError(errors.Trace(kv.ErrKeyExists)))
+	c.Assert(m.Code, Equals, ErDupEntry)
+	c.Assert(m.State, Equals, "23000")
+	c.Assert(toSQLError(classifyTidbError(errors.New("Table 'test.t' doesn't exist"))).Code, Equals, ErNoSuchTable)
+	c.Assert(toSQLError(classifyTidbError(errors.New("something else"))).Code, Equals, ErUnknownError)
+	c.Assert(classifyTidbError(nil), IsNil)
+	c.Assert(classifyTidbError(dup), Equals, dup)
+
+	// only the write conflicts are retried by the clients.
+	c.Assert(toSQLError(classifyTidbError(kv.ErrLockConflict)).Code, Equals, ErLockDeadlock)
+	c.Assert(toSQLError(classifyTidbError(kv.ErrConditionNotMatch)).Code, Equals, ErUnknownError)
+	c.Assert(toSQLError(classifyTidbError(errors.New("server is busy, try again later"))).Code, Equals, ErUnknownError)
+	// the errors of the other backends and the network are not classified.
+	c.Assert(toSQLError(errors.New("Table 'test.t' doesn't exist")).Code, Equals, ErUnknownError)
+
+	c.Assert(errorsEqual(nil, nil), Equals, true)
+	c.Assert(errorsEqual(dup, nil), Equals, false)
+	c.Assert(errorsEqual(dup, classifyTidbError(kv.ErrKeyExists)), Equals, true)
+	c.Assert(errorsEqual(dup, classifyTidbError(errors.New("Table 'test.t' doesn't exist"))), Equals, false)
+	c.Assert(errorsEqual(errors.New("a"), errors.New("a")), Equals, true)
+	c.Assert(errorsEqual(errors.New("a"), errors.New("b")), Equals, false)
+
+	comp := &Compare{err: [2]error{dup, errors.Trace(classifyTidbError(kv.ErrKeyExists))}}
+	c.Assert(comp.Diffs(), HasLen, 0)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// logFile is a file opened for appending, which is rotated to a file
+// suffixed by the rotation time when it reaches the max size. It's shared by
+// the session log and the query logs.
+type logFile struct {
+	name     string
+	maxSize  int64 // zero means never rotating
+	maxFiles int   // the rotated files kept, zero means keeping all
+	// header returns the lines written at the start of every new file, nil
+	// means no header.
+	header func() []byte
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openLogFile(name string, maxSize int64, maxFiles int, header func() []byte) (*logFile, error) {
+	f := &logFile{name: name, maxSize: maxSize, maxFiles: maxFiles, header: header}
+	if err := f.open(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return f, nil
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Trace(err)
+	}
+	size := st.Size()
+	if size == 0 && f.header != nil {
+		n, err := file.Write(f.header())
+		if err != nil {
+			file.Close()
+			return errors.Trace(err)
+		}
+		size = int64(n)
+	}
+	f.file, f.size = file, size
+	return nil
+}
+
+func (f *logFile) write(b []byte) error {
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return errors.Trace(err)
+}
+
+// Write appends b, rotating the file first if it reached the max size. If
+// the rotation fails, b is still appended to the current file and the error
+// is returned. The writes after Close are dropped.
+func (f *logFile) Write(b []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	var rotateErr error
+	if f.maxSize > 0 && f.size >= f.maxSize {
+		rotateErr = f.rotate()
+	}
+	if err := f.write(b); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Annotate(rotateErr, "rotate")
+}
+
+// rotate renames the file with the rotation time suffix, opens a new file,
+// and removes the oldest rotated files beyond the max files. The current
+// file is kept open until the new one is opened.
+func (f *logFile) rotate() error {
+	rotated := f.name + "." + time.Now().Format("20060102-150405.000000")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s-%d", f.name, time.Now().Format("20060102-150405.000000"), i)
+	}
+	if err := os.Rename(f.name, rotated); err != nil {
+		return errors.Trace(err)
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		// keep the current file under its name.
+		os.Rename(rotated, f.name)
+		return errors.Trace(err)
+	}
+	if err := old.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if f.maxFiles > 0 {
+		files, err := logFiles(f.name)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// the current file is the last one.
+		files = files[:len(files)-1]
+		for len(files) > f.maxFiles {
+			if err = os.Remove(files[0]); err != nil {
+				return errors.Trace(err)
+			}
+			files = files[1:]
+		}
+	}
+	return nil
+}
+
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return errors.Trace(err)
+}
+
+// logFiles returns the rotated files of a log file followed by the file
+// itself if it exists, the oldest first.
+func logFiles(name string) ([]string, error) {
+	files, err := filepath.Glob(name + ".[0-9]*")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(files)
+	if _, err = os.Stat(name); err == nil {
+		files = append(files, name)
+	}
+	return files, nil
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testLogFileSuite{})
+
+type testLogFileSuite struct {
+}
+
+func (s *testLogFileSuite) TestRotate(c *C) {
+	dir, err := ioutil.TempDir("", "logfile")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "mp.log")
+	f, err := openLogFile(name, 4, 1, func() []byte { return []byte("#\n") })
+	c.Assert(err, IsNil)
+	for _, line := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		c.Assert(f.Write([]byte(line)), IsNil)
+	}
+	files, err := logFiles(name)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	b, err := ioutil.ReadFile(name)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "#\nd\n")
+
+	// the file is kept and written if it can't be rotated.
+	c.Assert(os.Remove(name), IsNil)
+	c.Assert(f.Write([]byte("e\n")), NotNil)
+	c.Assert(f.file, NotNil)
+	c.Assert(f.Close(), IsNil)
+	c.Assert(f.Write([]byte("f\n")), IsNil)
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// durationBuckets are the upper bounds in seconds of the latency histograms.
+var durationBuckets = []float64{0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10}
+
+// metricVec is a counter or a gauge with labels.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // counter or gauge
+	labels []string
+
+	mu       sync.RWMutex
+	children map[string]*int64 // label values joined by \xff : value
+}
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, children: make(map[string]*int64)}
+}
+
+func (v *metricVec) child(values []string) *int64 {
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = new(int64)
+		v.children[key] = c
+	}
+	return c
+}
+
+// Add adds delta to the series of the label values.
+func (v *metricVec) Add(delta int64, values ...string) {
+	atomic.AddInt64(v.child(values), delta)
+}
+
+func (v *metricVec) Inc(values ...string) {
+	v.Add(1, values...)
+}
+
+// Value returns the value of the series of the label values.
+func (v *metricVec) Value(values ...string) int64 {
+	return atomic.LoadInt64(v.child(values))
+}
+
+func (v *metricVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for _, key := range sortedKeys(v.children) {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, labelPairs(v.labels, key, ""), atomic.LoadInt64(v.children[key]))
+	}
+}
+
+// histogramVec is a histogram with labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu       sync.Mutex
+	children map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // the observations of every bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, children: make(map[string]*histogram)}
+}
+
+// Observe adds an observation to the series of the label values.
+func (v *histogramVec) Observe(value float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.children[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(v.buckets))}
+		v.children[key] = h
+	}
+	if i := sort.SearchFloat64s(v.buckets, value); i < len(v.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+func (v *histogramVec) ObserveDuration(d time.Duration, values ...string) {
+	v.Observe(d.Seconds(), values...)
+}
+
+func (v *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := v.children[key]
+		var cumulative uint64
+		for i, upper := range v.buckets {
+			cumulative += h.counts[i]
+			le := `le="` + strconv.FormatFloat(upper, 'g', -1, 64) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelPairs(v.labels, key, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelPairs(v.labels, key, `le="+Inf"`), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labelPairs(v.labels, key, ""), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labelPairs(v.labels, key, ""), h.count)
+	}
+}
+
+func sortedKeys(m map[string]*int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs formats the labels of a series, extra is appended as is.
+func labelPairs(names []string, key, extra string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+"="+strconv.Quote(value))
+			}
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Metrics are the runtime metrics of mp, exposed in the text format of
+// prometheus.
+type Metrics struct {
+	Connections        *metricVec
+	ConnectionsTotal   *metricVec
+	ConnectionsRefused *metricVec
+	HandshakeFailures  *metricVec
+	Commands           *metricVec
+	CommandDuration    *histogramVec
+	PacketBytes        *metricVec
+	TokenWait          *histogramVec
+	BackendErrors      *metricVec
+	Divergences        *metricVec
+	AuditDropped       *metricVec
+}
+
+// metrics is the registry of the process, shared by all the servers and
+// drivers.
+var metrics = newMetrics()
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		Connections:        newMetricVec("mp_connections", "Current client connections.", "gauge", "mode"),
+		ConnectionsTotal:   newMetricVec("mp_connections_total", "Client connections accepted.", "counter", "mode"),
+		ConnectionsRefused: newMetricVec("mp_connections_refused_total", "Client connections closed before serving, by failed handshakes or backend connections.", "counter", "mode"),
+		HandshakeFailures:  newMetricVec("mp_handshake_failures_total", "Failed handshakes of client connections.", "counter", "reason"),
+		Commands:           newMetricVec("mp_commands_total", "Commands of the clients.", "counter", "mode", "cmd"),
+		CommandDuration:    newHistogramVec("mp_command_duration_seconds", "Latency of the commands of the clients.", durationBuckets, "mode", "cmd"),
+		PacketBytes:        newMetricVec("mp_packet_bytes_total", "Bytes of the mysql protocol packets, including the headers.", "counter", "side", "direction"),
+		TokenWait:          newHistogramVec("mp_token_wait_seconds", "Time the commands wait for a token of the concurrency limiter.", durationBuckets),
+		BackendErrors:      newMetricVec("mp_backend_errors_total", "Errors returned by the backends.", "counter", "driver"),
+		Divergences:        newMetricVec("mp_combo_divergences_total", "Reported differences of the backends in combo mode.", "counter", "kind"),
+		AuditDropped:       newMetricVec("mp_audit_dropped_total", "Audit events dropped since the queue of the audit log was full.", "counter"),
+	}
+}
+
+// Dump writes all metrics in the text format of prometheus.
+func (m *Metrics) Dump(w io.Writer) {
+	bw := bufio.NewWriter(w)
+	for _, v := range []*metricVec{m.Connections, m.ConnectionsTotal, m.ConnectionsRefused, m.HandshakeFailures, m.Commands, m.PacketBytes, m.BackendErrors, m.Divergences, m.AuditDropped} {
+		v.write(bw)
+	}
+	for _, v := range []*histogramVec{m.CommandDuration, m.TokenWait} {
+		v.write(bw)
+	}
+	bw.Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Dump(w)
+}
+
+// countBackendError counts err if it is not nil.
+func countBackendError(driver string, err error) {
+	if err != nil {
+		metrics.BackendErrors.Inc(driver)
+	}
+}
+
+// handshakeFailure returns the reason of a failed handshake.
+func handshakeFailure(err error) string {
+	cause := errors.Cause(err)
+	if m, ok := cause.(*SQLError); ok && m.Code == ErAccessDeniedError {
+		return "access_denied"
+	}
+	if cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		return "closed"
+	}
+	if ne, ok := cause.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	return "protocol"
+}
+
+// driverMode returns the mode of a driver, the label of the connection metrics.
+func driverMode(driver IDriver) string {
+	switch driver.(type) {
+	case *ComboDriver:
+		return "combo"
+	case *MysqlDriver:
+		return "mysql"
+	case *TidbDriver:
+		return "tidb"
+	}
+	return "other"
+}
+
+// countBytes counts the bytes read and written by p, side is client or backend.
+func (p *PacketIO) countBytes(side string) {
+	p.bytesIn = metrics.PacketBytes.child([]string{side, "in"})
+	p.bytesOut = metrics.PacketBytes.child([]string{side, "out"})
+}
+
+// serveMetrics serves the metrics at /metrics of l until l is closed.
+func serveMetrics(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	if err := http.Serve(l, mux); err != nil {
+		log.Infof("metrics server stopped %v", err)
+	}
+}
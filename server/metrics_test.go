@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testMetricsSuite{})
+
+type testMetricsSuite struct {
+}
+
+func (s *testMetricsSuite) TestMetrics(c *C) {
+	m := newMetrics()
+	m.Connections.Inc("combo")
+	m.Connections.Inc("combo")
+	m.Connections.Add(-1, "combo")
+	m.Commands.Inc("tidb", "query")
+	m.TokenWait.Observe(0.003)
+	m.TokenWait.Observe(20)
+	var b bytes.Buffer
+	m.Dump(&b)
+	out := b.String()
+	c.Assert(out, Matches, `(?s)# HELP mp_connections Current client connections\.\n# TYPE mp_connections gauge\nmp_connections{mode="combo"} 1\n.*`)
+	c.Assert(strings.Contains(out, `mp_commands_total{mode="tidb",cmd="query"} 1`+"\n"), Equals, true)
+	c.Assert(strings.Contains(out, `mp_token_wait_seconds_bucket{le="0.002"} 0`+"\n"+`mp_token_wait_seconds_bucket{le="0.005"} 1`+"\n"), Equals, true)
+	c.Assert(strings.Contains(out, `mp_token_wait_seconds_bucket{le="+Inf"} 2`+"\n"+"mp_token_wait_seconds_sum 20.003\nmp_token_wait_seconds_count 2\n"), Equals, true)
+
+	// the commands and the packets of a connection are counted.
+	fc := newFakeContext()
+	cc := newCaptureConn(nil, fc)
+	cc.server.mode = "mysql"
+	cc.pkg.countBytes("client")
+	commands := metrics.Commands.Value("mysql", CapturePing)
+	out0 := metrics.PacketBytes.Value("client", "out")
+	c.Assert(cc.dispatch([]byte{ComPing}), IsNil)
+	c.Assert(metrics.Commands.Value("mysql", CapturePing), Equals, commands+1)
+	c.Assert(metrics.PacketBytes.Value("client", "out"), Equals, out0+4+7)
+
+	c.Assert(handshakeFailure(errors.Trace(NewDefaultError(ErAccessDeniedError, "127.0.0.1", "root", "Yes"))), Equals, "access_denied")
+	c.Assert(handshakeFailure(errors.Trace(io.EOF)), Equals, "closed")
+	c.Assert(handshakeFailure(errors.New("invalid sequence 2 != 1")), Equals, "protocol")
+	c.Assert(driverMode(&MysqlDriver{}), Equals, "mysql")
+}
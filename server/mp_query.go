@@ -0,0 +1,694 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// mpQuery is a query of a table of the virtual mp schema:
+//
+//	SELECT * | col, ... FROM mp.<table> [WHERE cond] [ORDER BY col [ASC|DESC], ...]
+//	    [LIMIT [offset,] count | LIMIT count OFFSET offset]
+//
+// The conditions are comparisons (=, !=, <>, <, <=, >, >=), [NOT] LIKE,
+// IS [NOT] NULL and [NOT] IN (...) of the columns and literals, combined by
+// AND, OR, NOT and parentheses. They are evaluated over the rows in memory.
+type mpQuery struct {
+	table   string
+	columns []string // nil means all columns
+	where   mpExpr   // nil means all rows
+	orderBy []mpOrder
+	limit   int // -1 means no limit
+	offset  int
+	refs    []string // the columns referred to by the conditions and the order
+}
+
+type mpOrder struct {
+	column string
+	desc   bool
+}
+
+// mpRow is a row being filtered, the column names are lower cased.
+type mpRow struct {
+	index  map[string]int
+	values []interface{}
+}
+
+// mpExpr evaluates to a value of a row, nil is NULL and the predicates are bool.
+type mpExpr func(row *mpRow) interface{}
+
+// parseMPQuery parses sql if it selects from a table of the mp schema, ok is
+// false if it does not.
+func parseMPQuery(sql string) (q *mpQuery, ok bool, err error) {
+	if !mentionsMP(sql, "select") {
+		return nil, false, nil
+	}
+	toks := lexSQL(sql)
+	if len(toks) == 0 || !toks[0].is(sql, "select") {
+		return nil, false, nil
+	}
+	from := -1
+	for i, tok := range toks {
+		if tok.is(sql, "from") {
+			if name, _ := parseTableName(sql, toks, i+1); strings.HasPrefix(strings.ToLower(name), "mp.") {
+				from = i
+				break
+			}
+		}
+	}
+	if from < 0 {
+		return nil, false, nil
+	}
+	p := &mpParser{sql: sql, toks: toks}
+	q, err = p.parse()
+	if err != nil {
+		return nil, true, errors.Annotate(err, "mp schema supports simple selects only")
+	}
+	return q, true, nil
+}
+
+// mentionsMP is the cheap check done before lexing a statement of the
+// clients: sql starts with keyword and mentions a table of the mp schema.
+func mentionsMP(sql, keyword string) bool {
+	sql = strings.TrimLeft(sql, " \t\r\n")
+	if len(sql) <= len(keyword) || !strings.EqualFold(sql[:len(keyword)], keyword) {
+		return false
+	}
+	for i := len(keyword); i+2 < len(sql); i++ {
+		if (sql[i] == 'm' || sql[i] == 'M') && (sql[i+1] == 'p' || sql[i+1] == 'P') && (sql[i+2] == '.' || sql[i+2] == '`') {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMPTruncate parses TRUNCATE [TABLE] mp.<table>, it returns the table name.
+func parseMPTruncate(sql string) (table string, ok bool) {
+	if !mentionsMP(sql, "truncate") {
+		return "", false
+	}
+	toks := lexSQL(sql)
+	if len(toks) < 2 || !toks[0].is(sql, "truncate") {
+		return "", false
+	}
+	i := 1
+	if toks[i].is(sql, "table") {
+		i++
+	}
+	name, next := parseTableName(sql, toks, i)
+	if next < len(toks) && toks[next].is(sql, ";") {
+		next++
+	}
+	if next < len(toks) || !strings.HasPrefix(strings.ToLower(name), "mp.") {
+		return "", false
+	}
+	return strings.ToLower(name[len("mp."):]), true
+}
+
+type mpParser struct {
+	sql  string
+	toks []sqlToken
+	pos  int
+	q    *mpQuery
+}
+
+func (p *mpParser) peekIs(words ...string) bool {
+	for i, w := range words {
+		if p.pos+i >= len(p.toks) || !p.toks[p.pos+i].is(p.sql, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// accept consumes the words if they are next.
+func (p *mpParser) accept(words ...string) bool {
+	if p.peekIs(words...) {
+		p.pos += len(words)
+		return true
+	}
+	return false
+}
+
+func (p *mpParser) expect(word string) error {
+	if !p.accept(word) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *mpParser) unexpected() error {
+	if p.pos >= len(p.toks) {
+		return errors.New("unexpected end of statement")
+	}
+	return errors.Errorf("unexpected %q", p.toks[p.pos].text(p.sql))
+}
+
+// ident parses a column name.
+func (p *mpParser) ident() (string, error) {
+	if p.pos >= len(p.toks) || (p.toks[p.pos].kind != tokIdent && p.toks[p.pos].kind != tokQuotedIdent) {
+		return "", p.unexpected()
+	}
+	name := strings.ToLower(unquoteIdent(p.toks[p.pos].text(p.sql)))
+	p.pos++
+	return name, nil
+}
+
+func (p *mpParser) integer() (int, error) {
+	if p.pos >= len(p.toks) || p.toks[p.pos].kind != tokNumber {
+		return 0, p.unexpected()
+	}
+	n, err := strconv.Atoi(p.toks[p.pos].text(p.sql))
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid number %s", p.toks[p.pos].text(p.sql))
+	}
+	p.pos++
+	return n, nil
+}
+
+func (p *mpParser) parse() (*mpQuery, error) {
+	p.q = &mpQuery{limit: -1}
+	p.pos = 1
+	if !p.accept("*") {
+		for {
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			p.q.columns = append(p.q.columns, name)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if err := p.expect("from"); err != nil {
+		return nil, err
+	}
+	name, next := parseTableName(p.sql, p.toks, p.pos)
+	p.q.table, p.pos = strings.ToLower(name[len("mp."):]), next
+	if p.accept("where") {
+		where, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		p.q.where = where
+	}
+	if p.accept("order", "by") {
+		for {
+			name, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			p.q.refs = append(p.q.refs, name)
+			order := mpOrder{column: name}
+			if p.accept("desc") {
+				order.desc = true
+			} else {
+				p.accept("asc")
+			}
+			p.q.orderBy = append(p.q.orderBy, order)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("limit") {
+		n, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		p.q.limit = n
+		if p.accept(",") {
+			if p.q.limit, err = p.integer(); err != nil {
+				return nil, err
+			}
+			p.q.offset = n
+		} else if p.accept("offset") {
+			if p.q.offset, err = p.integer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.accept(";")
+	if p.pos < len(p.toks) {
+		return nil, p.unexpected()
+	}
+	return p.q, nil
+}
+
+func (p *mpParser) or() (mpExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") || p.accept("|", "|") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = mpLogical(left, right, true)
+	}
+	return left, nil
+}
+
+func (p *mpParser) and() (mpExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") || p.accept("&", "&") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = mpLogical(left, right, false)
+	}
+	return left, nil
+}
+
+func (p *mpParser) not() (mpExpr, error) {
+	if p.accept("not") || p.accept("!") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return mpNot(e), nil
+	}
+	return p.predicate()
+}
+
+// operator parses a comparison operator, the characters of the two
+// character operators are separate tokens.
+func (p *mpParser) operator() string {
+	if p.pos >= len(p.toks) || p.toks[p.pos].kind != tokOther {
+		return ""
+	}
+	op := p.toks[p.pos].text(p.sql)
+	if op != "=" && op != "<" && op != ">" && op != "!" {
+		return ""
+	}
+	if p.pos+1 < len(p.toks) && !p.toks[p.pos+1].space {
+		if second := p.toks[p.pos+1].text(p.sql); (op != "=" && second == "=") || (op == "<" && second == ">") {
+			p.pos += 2
+			return op + second
+		}
+	}
+	if op == "!" {
+		return ""
+	}
+	p.pos++
+	return op
+}
+
+func (p *mpParser) predicate() (mpExpr, error) {
+	left, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.operator(); op != "" {
+		right, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		return mpComparison(op, left, right), nil
+	}
+	if p.accept("is") {
+		not := p.accept("not")
+		if err = p.expect("null"); err != nil {
+			return nil, err
+		}
+		return func(row *mpRow) interface{} { return (left(row) == nil) != not }, nil
+	}
+	not := p.accept("not")
+	var e mpExpr
+	switch {
+	case p.accept("like"):
+		pattern, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		e = mpLike(left, pattern)
+	case p.accept("in"):
+		if err = p.expect("("); err != nil {
+			return nil, err
+		}
+		var list []mpExpr
+		for {
+			item, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err = p.expect(")"); err != nil {
+			return nil, err
+		}
+		e = mpIn(left, list)
+	default:
+		if not {
+			return nil, p.unexpected()
+		}
+		return left, nil
+	}
+	if not {
+		e = mpNot(e)
+	}
+	return e, nil
+}
+
+func (p *mpParser) primary() (mpExpr, error) {
+	if p.pos >= len(p.toks) {
+		return nil, p.unexpected()
+	}
+	tok := p.toks[p.pos]
+	switch {
+	case tok.is(p.sql, "("):
+		p.pos++
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case tok.kind == tokString:
+		p.pos++
+		v := unquoteString(tok.text(p.sql))
+		return func(*mpRow) interface{} { return v }, nil
+	case tok.kind == tokNumber || (tok.is(p.sql, "-") && p.pos+1 < len(p.toks) && p.toks[p.pos+1].kind == tokNumber):
+		text := tok.text(p.sql)
+		if tok.is(p.sql, "-") {
+			p.pos++
+			text = "-" + p.toks[p.pos].text(p.sql)
+		}
+		p.pos++
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid number %s", text)
+		}
+		return func(*mpRow) interface{} { return f }, nil
+	case tok.is(p.sql, "null"):
+		p.pos++
+		return func(*mpRow) interface{} { return nil }, nil
+	case tok.is(p.sql, "true") || tok.is(p.sql, "false"):
+		p.pos++
+		v := tok.is(p.sql, "true")
+		return func(*mpRow) interface{} { return v }, nil
+	}
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	p.q.refs = append(p.q.refs, name)
+	return func(row *mpRow) interface{} { return row.values[row.index[name]] }, nil
+}
+
+// unquoteString removes the quotes of a string literal and unescapes it.
+func unquoteString(s string) string {
+	quote := s[0]
+	s = s[1 : len(s)-1]
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b = append(b, '\n')
+			case 't':
+				b = append(b, '\t')
+			case '0':
+				b = append(b, 0)
+			default:
+				b = append(b, s[i])
+			}
+		case s[i] == quote && i+1 < len(s) && s[i+1] == quote:
+			i++
+			b = append(b, quote)
+		default:
+			b = append(b, s[i])
+		}
+	}
+	return string(b)
+}
+
+// mpTruth returns whether v is true, NULL is not.
+func mpTruth(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	}
+	f, ok := mpNumber(v)
+	return ok && f != 0
+}
+
+// mpNumber converts v to a number if it is or looks like one.
+func mpNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	case float64:
+		return x, true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(mpString(v)), 64)
+	return f, err == nil
+}
+
+func mpString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	}
+	return fmt.Sprint(v)
+}
+
+// mpCompare compares the values as numbers if both are numbers, otherwise
+// as case insensitive strings like the default collation of mysql. ok is
+// false if either is NULL.
+func mpCompare(a, b interface{}) (c int, ok bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	if fa, okA := mpNumber(a); okA {
+		if fb, okB := mpNumber(b); okB {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	sa, sb := strings.ToLower(mpString(a)), strings.ToLower(mpString(b))
+	switch {
+	case sa < sb:
+		return -1, true
+	case sa > sb:
+		return 1, true
+	}
+	return 0, true
+}
+
+func mpComparison(op string, left, right mpExpr) mpExpr {
+	return func(row *mpRow) interface{} {
+		c, ok := mpCompare(left(row), right(row))
+		if !ok {
+			return nil
+		}
+		switch op {
+		case "=":
+			return c == 0
+		case "!=", "<>":
+			return c != 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}
+}
+
+func mpLogical(left, right mpExpr, or bool) mpExpr {
+	return func(row *mpRow) interface{} {
+		l, r := left(row), right(row)
+		if or {
+			if mpTruth(l) || mpTruth(r) {
+				return true
+			}
+		} else if (l != nil && !mpTruth(l)) || (r != nil && !mpTruth(r)) {
+			return false
+		}
+		if l == nil || r == nil {
+			return nil
+		}
+		return !or
+	}
+}
+
+func mpNot(e mpExpr) mpExpr {
+	return func(row *mpRow) interface{} {
+		v := e(row)
+		if v == nil {
+			return nil
+		}
+		return !mpTruth(v)
+	}
+}
+
+func mpLike(left, pattern mpExpr) mpExpr {
+	var cached string
+	var re *regexp.Regexp
+	return func(row *mpRow) interface{} {
+		v, p := left(row), pattern(row)
+		if v == nil || p == nil {
+			return nil
+		}
+		if ps := mpString(p); re == nil || ps != cached {
+			cached, re = ps, likeRegexp(ps)
+		}
+		return re.MatchString(mpString(v))
+	}
+}
+
+// likeRegexp converts a LIKE pattern to a case insensitive regular expression.
+func likeRegexp(pattern string) *regexp.Regexp {
+	var b bytes.Buffer
+	b.WriteString("(?is)^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func mpIn(left mpExpr, list []mpExpr) mpExpr {
+	return func(row *mpRow) interface{} {
+		v := left(row)
+		if v == nil {
+			return nil
+		}
+		null := false
+		for _, item := range list {
+			c, ok := mpCompare(v, item(row))
+			if !ok {
+				null = true
+			} else if c == 0 {
+				return true
+			}
+		}
+		if null {
+			return nil
+		}
+		return false
+	}
+}
+
+// apply filters, orders, limits and projects the rows of a table.
+func (q *mpQuery) apply(table *ResultSet) (*ResultSet, error) {
+	index := make(map[string]int, len(table.Columns))
+	for i, col := range table.Columns {
+		index[strings.ToLower(col.Name)] = i
+	}
+	for _, name := range append(q.refs, q.columns...) {
+		if _, ok := index[name]; !ok {
+			return nil, errors.Errorf("unknown column %s in mp.%s", name, q.table)
+		}
+	}
+	var rows [][]interface{}
+	for _, values := range table.Rows {
+		if q.where == nil || mpTruth(q.where(&mpRow{index: index, values: values})) {
+			rows = append(rows, values)
+		}
+	}
+	if len(q.orderBy) > 0 {
+		sort.Stable(&mpSorter{rows: rows, index: index, orderBy: q.orderBy})
+	}
+	if q.offset >= len(rows) {
+		rows = nil
+	} else {
+		rows = rows[q.offset:]
+	}
+	if q.limit >= 0 && q.limit < len(rows) {
+		rows = rows[:q.limit]
+	}
+	if q.columns == nil {
+		return &ResultSet{Columns: table.Columns, Rows: rows}, nil
+	}
+	rs := &ResultSet{}
+	for _, name := range q.columns {
+		rs.Columns = append(rs.Columns, table.Columns[index[name]])
+	}
+	for _, values := range rows {
+		row := make([]interface{}, len(q.columns))
+		for i, name := range q.columns {
+			row[i] = values[index[name]]
+		}
+		rs.Rows = append(rs.Rows, row)
+	}
+	return rs, nil
+}
+
+type mpSorter struct {
+	rows    [][]interface{}
+	index   map[string]int
+	orderBy []mpOrder
+}
+
+func (s *mpSorter) Len() int      { return len(s.rows) }
+func (s *mpSorter) Swap(i, j int) { s.rows[i], s.rows[j] = s.rows[j], s.rows[i] }
+
+// Less orders NULL first like mysql.
+func (s *mpSorter) Less(i, j int) bool {
+	for _, o := range s.orderBy {
+		a, b := s.rows[i][s.index[o.column]], s.rows[j][s.index[o.column]]
+		c, ok := mpCompare(a, b)
+		if !ok {
+			switch {
+			case a == nil && b == nil:
+				c = 0
+			case a == nil:
+				c = -1
+			default:
+				c = 1
+			}
+		}
+		if c != 0 {
+			return (c < 0) != o.desc
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testMPQuerySuite{})
+
+type testMPQuerySuite struct {
+}
+
+func (s *testMPQuerySuite) TestMPQuery(c *C) {
+	for _, sql := range []string{"select 1", "select * from t where a = 'mp.clients'", "show tables from mp"} {
+		_, ok, _ := parseMPQuery(sql)
+		c.Assert(ok, Equals, false, Commentf(sql))
+	}
+	for _, sql := range []string{"select count(*) from mp.clients", "select * from mp.clients join t", "select * from mp.clients where"} {
+		_, ok, err := parseMPQuery(sql)
+		c.Assert(ok, Equals, true, Commentf(sql))
+		c.Assert(err, NotNil, Commentf(sql))
+	}
+
+	table := newAdminResultSet("id", "user", "time_ms")
+	table.AddRow(int64(1), "root", int64(30)).AddRow(int64(2), "app", int64(5)).
+		AddRow(int64(3), "App", nil).AddRow(int64(10), "batch", int64(500))
+	ids := func(sql string) []int64 {
+		q, ok, err := parseMPQuery(sql)
+		c.Assert(ok, Equals, true, Commentf(sql))
+		c.Assert(err, IsNil, Commentf(sql))
+		rs, err := q.apply(table)
+		c.Assert(err, IsNil, Commentf(sql))
+		var ids []int64
+		for _, row := range rs.Rows {
+			ids = append(ids, row[0].(int64))
+		}
+		return ids
+	}
+	c.Assert(ids("select * from mp.clients"), DeepEquals, []int64{1, 2, 3, 10})
+	c.Assert(ids("SELECT id FROM `mp`.`clients` WHERE user = 'APP'"), DeepEquals, []int64{2, 3})
+	c.Assert(ids("select id from mp.clients where time_ms >= 30 or user like 'b%'"), DeepEquals, []int64{1, 10})
+	c.Assert(ids("select id from mp.clients where not (id in (1, 10) or time_ms is null)"), DeepEquals, []int64{2})
+	c.Assert(ids("select id from mp.clients where time_ms != 5 and user not like '_pp'"), DeepEquals, []int64{1, 10})
+	c.Assert(ids("select id from mp.clients where id > 2"), DeepEquals, []int64{3, 10})
+	c.Assert(ids("select id from mp.clients order by time_ms desc"), DeepEquals, []int64{10, 1, 2, 3})
+	c.Assert(ids("select id from mp.clients order by user, id desc limit 1, 2"), DeepEquals, []int64{2, 10})
+	c.Assert(ids("select id from mp.clients order by id limit 2 offset 3"), DeepEquals, []int64{10})
+	q, _, _ := parseMPQuery("select id, host from mp.clients")
+	_, err := q.apply(table)
+	c.Assert(err, NotNil)
+
+	c.Assert(mentionsMP("  SELECT * FROM `mp`.clients", "select"), Equals, true)
+	c.Assert(mentionsMP("select * from t where a = 'm'", "select"), Equals, false)
+	c.Assert(mentionsMP("truncate mp.digests", "select"), Equals, false)
+	_, ok := parseMPTruncate("truncate table t")
+	c.Assert(ok, Equals, false)
+}
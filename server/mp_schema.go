@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// mpTables builds the tables of the virtual mp schema from the live state
+// of the server.
+var mpTables = map[string]func(s *Server) (*ResultSet, error){
+	"clients":  (*Server).mpClients,
+	"diffs":    (*Server).mpDiffs,
+	"digests":  (*Server).mpDigests,
+	"latency":  (*Server).mpLatency,
+	"backends": (*Server).mpBackends,
+	"config":   (*Server).mpConfig,
+}
+
+// queryMP returns the result of a query of the mp schema.
+func (s *Server) queryMP(q *mpQuery) (*ResultSet, error) {
+	build, ok := mpTables[q.table]
+	if !ok {
+		return nil, errors.Errorf("unknown table mp.%s", q.table)
+	}
+	table, err := build(s)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return q.apply(table)
+}
+
+const mpTimeFormat = "2006-01-02 15:04:05"
+
+func (s *Server) mpClients() (*ResultSet, error) {
+	rs := newAdminResultSet("id", "user", "host", "db", "connected", "command", "sql", "since", "time_ms", "commands", "traced")
+	now := time.Now()
+	for _, c := range s.Clients() {
+		rs.AddRow(int64(c.ID), c.User, c.Host, c.DB, c.Connected.Format(mpTimeFormat), c.Command, c.SQL,
+			c.Since.Format(mpTimeFormat), int64(now.Sub(c.Since)/time.Millisecond), c.Commands, fmt.Sprint(c.Traced))
+	}
+	return rs, nil
+}
+
+func (s *Server) mpDiffs() (*ResultSet, error) {
+	rs := newAdminResultSet("time", "sql", "kind", "column", "msg", "reported", "mysql_plan", "tidb_plan")
+	for _, d := range recentDiffs.entries() {
+		rs.AddRow(d.time.Format(mpTimeFormat), d.sql, d.Field, d.Column, d.Msg, fmt.Sprint(d.reported), d.plans[0], d.plans[1])
+	}
+	return rs, nil
+}
+
+func (s *Server) mpDigests() (*ResultSet, error) {
+	if s.digests == nil {
+		return nil, errors.New("digest statistics are disabled")
+	}
+	return s.digests.resultSet(), nil
+}
+
+// mpLatency is the latency comparison of the combo mode, it is empty if the
+// latency stats are disabled.
+func (s *Server) mpLatency() (*ResultSet, error) {
+	cd, _ := s.driver.(*ComboDriver)
+	return cd.latency().resultSet(), nil
+}
+
+// truncateMP resets a table of the mp schema, only mp.digests can be reset.
+func (s *Server) truncateMP(table string) error {
+	if table != "digests" {
+		return errors.Errorf("table mp.%s can't be truncated", table)
+	}
+	if s.digests == nil {
+		return errors.New("digest statistics are disabled")
+	}
+	s.digests.Reset()
+	return nil
+}
+
+func (s *Server) mpBackends() (*ResultSet, error) {
+	rs := newAdminResultSet("name", "role", "addr", "ready", "errors")
+	add := func(name, role string, driver IDriver) {
+		var addr string
+		if md, ok := driver.(*MysqlDriver); ok {
+			addr = md.Addr
+		}
+		ready := "yes"
+		if rc, ok := driver.(readyChecker); ok {
+			if err := rc.ready(); err != nil {
+				ready = err.Error()
+			}
+		}
+		rs.AddRow(name, role, addr, ready, metrics.BackendErrors.Value(name))
+	}
+	switch d := s.driver.(type) {
+	case *ComboDriver:
+		mysqlRole, tidbRole := "primary", "secondary"
+		if d.UseTidbResult {
+			mysqlRole, tidbRole = tidbRole, mysqlRole
+		}
+		add("mysql", mysqlRole, d.mysqlDriver)
+		add("tidb", tidbRole, d.tidbDriver)
+	case *MysqlDriver:
+		add("mysql", "primary", d)
+	case *TidbDriver:
+		add("tidb", "primary", d)
+	}
+	return rs, nil
+}
+
+// mpConfig lists the loaded config as flattened name and value pairs, such
+// as capture.file, the secrets are redacted.
+func (s *Server) mpConfig() (*ResultSet, error) {
+	b, err := json.Marshal(s.redactedConfig())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Trace(err)
+	}
+	values := make(map[string]string)
+	flattenConfig("", m, values)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rs := newAdminResultSet("name", "value")
+	for _, name := range names {
+		rs.AddRow(name, values[name])
+	}
+	return rs, nil
+}
+
+func flattenConfig(prefix string, m map[string]interface{}, values map[string]string) {
+	for k, v := range m {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			flattenConfig(prefix+k+".", x, values)
+		case string:
+			values[prefix+k] = x
+		case nil:
+			values[prefix+k] = ""
+		default:
+			b, _ := json.Marshal(x)
+			values[prefix+k] = string(b)
+		}
+	}
+}
+
+// diffLog keeps the recently reported differences of the backends for mp.diffs.
+type diffLog struct {
+	mu   sync.Mutex
+	ring []diffEntry
+	next int
+	full bool
+}
+
+type diffEntry struct {
+	*Diff
+	time     time.Time
+	sql      string
+	reported bool      // false if the difference is downgraded by a rule
+	plans    [2]string // the plans of mysql and tidb if the statement is explained
+}
+
+const maxRecentDiffs = 1000
+
+var recentDiffs = &diffLog{ring: make([]diffEntry, maxRecentDiffs)}
+
+func (l *diffLog) add(sql string, diffs []*Diff, reported bool) {
+	if len(diffs) == 0 {
+		return
+	}
+	now := time.Now()
+	sql = redactPasswords(sql)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range diffs {
+		l.ring[l.next] = diffEntry{Diff: d, time: now, sql: sql, reported: reported}
+		l.next++
+		if l.next == len(l.ring) {
+			l.next, l.full = 0, true
+		}
+	}
+}
+
+// setPlans attaches the plans of the statement to its kept diffs.
+func (l *diffLog) setPlans(diffs []*Diff, plans [2]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, d := range diffs {
+		for i := range l.ring {
+			if l.ring[i].Diff == d {
+				l.ring[i].plans = plans
+			}
+		}
+	}
+}
+
+// entries returns the kept differences, the oldest first.
+func (l *diffLog) entries() []diffEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]diffEntry(nil), l.ring[:l.next]...)
+	}
+	return append(append([]diffEntry(nil), l.ring[l.next:]...), l.ring[:l.next]...)
+}
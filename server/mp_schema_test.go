@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testMPSchemaSuite{})
+
+type testMPSchemaSuite struct {
+}
+
+func (s *testMPSchemaSuite) TestMPSchema(c *C) {
+	fc := newFakeContext()
+	cc := newCaptureConn(nil, fc)
+	cc.server.cfg = &etc.Config{Password: "secret", Capture: etc.Capture{File: "session.log"}}
+	cc.server.clients = map[uint32]*ClientConn{7: cc}
+	cc.user = "root"
+	cc.info = ClientInfo{ID: 7, User: "root", Command: "sleep"}
+	// only the admin user reads the mp schema.
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select * from mp.config"...)), NotNil)
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "truncate mp.digests"...)), NotNil)
+	c.Assert(fc.executed, HasLen, 0)
+	cc.admin = true
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select id, command from mp.clients where user = 'root'"...)), IsNil)
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select * from mp.nothing"...)), NotNil)
+	c.Assert(fc.executed, HasLen, 0)
+
+	q, _, _ := parseMPQuery("select command from mp.clients where id = 7")
+	rs, err := cc.server.queryMP(q)
+	c.Assert(err, IsNil)
+	c.Assert(rs.Rows, DeepEquals, [][]interface{}{{"sleep"}})
+	q, _, _ = parseMPQuery("select value from mp.config where name in ('password', 'capture.file')")
+	rs, err = cc.server.queryMP(q)
+	c.Assert(err, IsNil)
+	c.Assert(rs.Rows, DeepEquals, [][]interface{}{{"session.log"}, {"******"}})
+
+	diffs := []*Diff{{Field: "Rows", Msg: "differ"}}
+	recentDiffs.add("select 1", diffs, true)
+	recentDiffs.setPlans(diffs, [2]string{"id\tselect_type", "id\ttask"})
+	q, _, _ = parseMPQuery("select sql, reported, mysql_plan, tidb_plan from mp.diffs where kind = 'Rows' and sql = 'select 1'")
+	rs, err = cc.server.queryMP(q)
+	c.Assert(err, IsNil)
+	c.Assert(rs.Rows, DeepEquals, [][]interface{}{{"select 1", "true", "id\tselect_type", "id\ttask"}})
+
+	// the passwords are never listed.
+	recentDiffs.add("set password = 'secret'", []*Diff{{Field: "Error", Msg: "differ"}}, true)
+	q, _, _ = parseMPQuery("select sql from mp.diffs where kind = 'Error'")
+	rs, err = cc.server.queryMP(q)
+	c.Assert(err, IsNil)
+	c.Assert(rs.Rows[len(rs.Rows)-1], DeepEquals, []interface{}{"set password = '***'"})
+	cc.setCommand("query", "CREATE USER 'bob'@'%' IDENTIFIED BY 'secret'")
+	q, _, _ = parseMPQuery("select sql from mp.clients where id = 7")
+	rs, err = cc.server.queryMP(q)
+	c.Assert(err, IsNil)
+	c.Assert(rs.Rows, DeepEquals, [][]interface{}{{"CREATE USER 'bob'@'%' IDENTIFIED BY '***'"}})
+}
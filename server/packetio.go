@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 
 	"github.com/juju/errors"
 	. "github.com/pingcap/tidb/mysqldef"
@@ -15,6 +16,11 @@ type PacketIO struct {
 	wb *bufio.Writer
 
 	Sequence uint8
+
+	trace *packetTrace // nil if the wire trace is off
+	// the byte counters of the metrics, nil if not counted
+	bytesIn  *int64
+	bytesOut *int64
 }
 
 func NewPacketIO(conn net.Conn) *PacketIO {
@@ -49,6 +55,12 @@ func (p *PacketIO) ReadPacket() ([]byte, error) {
 	if _, err := io.ReadFull(p.rb, data); err != nil {
 		return nil, errors.Trace(err)
 	} else {
+		if p.trace != nil {
+			p.trace.packet(false, sequence, data)
+		}
+		if p.bytesIn != nil {
+			atomic.AddInt64(p.bytesIn, int64(4+length))
+		}
 		if length < MaxPayloadLen {
 			return data, nil
 		}
@@ -66,6 +78,13 @@ func (p *PacketIO) ReadPacket() ([]byte, error) {
 //data already have header
 func (p *PacketIO) WritePacket(data []byte) error {
 	length := len(data) - 4
+	if p.trace != nil {
+		p.trace.packet(true, p.Sequence, data[4:])
+	}
+	if p.bytesOut != nil {
+		// the headers of the split packets are counted too.
+		atomic.AddInt64(p.bytesOut, int64(len(data)+length/MaxPayloadLen*4))
+	}
 
 	for length >= MaxPayloadLen {
 		data[0] = 0xff
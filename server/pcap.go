@@ -0,0 +1,453 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// The link types of the captured packets.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+const (
+	pcapngSectionHeader   = 0x0A0D0D0A
+	pcapngInterfaceBlock  = 1
+	pcapngSimplePacket    = 3
+	pcapngEnhancedPacket  = 6
+	pcapngByteOrderMagic  = 0x1A2B3C4D
+	pcapngOptionTSResol   = 9
+	defaultPcapngTSResol  = 6
+	maxPcapBlockSize      = 64 << 20
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+)
+
+// capturedPacket is a link layer frame of a capture file.
+type capturedPacket struct {
+	time     time.Time
+	linkType int
+	data     []byte
+}
+
+// pcapReader reads the frames of a pcap or pcapng file.
+type pcapReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+
+	// pcap
+	linkType int
+	nano     bool
+
+	// pcapng, the link type and timestamp resolution of the interfaces.
+	ifaces []pcapngInterface
+}
+
+type pcapngInterface struct {
+	linkType int
+	// tsUnit is the duration of a timestamp unit in nanoseconds.
+	tsUnit float64
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	pr := &pcapReader{r: bufio.NewReader(r)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, errors.Errorf("read capture file magic error %v", err)
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		pr.ng = true
+		return pr, nil
+	}
+	header := make([]byte, 24)
+	if _, err = io.ReadFull(pr.r, header); err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header) {
+		case pcapMagicMicroseconds:
+			pr.order = order
+		case pcapMagicNanoseconds:
+			pr.order, pr.nano = order, true
+		}
+	}
+	if pr.order == nil {
+		return nil, errors.Errorf("not a pcap or pcapng file, magic %x", header[:4])
+	}
+	pr.linkType = int(pr.order.Uint32(header[20:]) & 0xffff)
+	return pr, nil
+}
+
+// next returns the next frame, io.EOF at the end.
+func (pr *pcapReader) next() (*capturedPacket, error) {
+	if pr.ng {
+		return pr.nextBlock()
+	}
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(pr.r, header); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sec, frac := int64(pr.order.Uint32(header)), int64(pr.order.Uint32(header[4:]))
+	if !pr.nano {
+		frac *= 1000
+	}
+	size := pr.order.Uint32(header[8:])
+	if size > maxPcapBlockSize {
+		return nil, errors.Errorf("invalid packet size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &capturedPacket{time: time.Unix(sec, frac), linkType: pr.linkType, data: data}, nil
+}
+
+// nextBlock reads the pcapng blocks until a packet block.
+func (pr *pcapReader) nextBlock() (*capturedPacket, error) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(pr.r, header); err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+		blockType := binary.LittleEndian.Uint32(header)
+		if blockType == pcapngSectionHeader {
+			// the byte order of a section follows its header.
+			magic, err := pr.r.Peek(4)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			pr.order = binary.LittleEndian
+			if binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic {
+				pr.order = binary.BigEndian
+			}
+			pr.ifaces = nil
+		} else if pr.order == nil {
+			return nil, errors.New("pcapng block before the section header")
+		}
+		blockType = pr.order.Uint32(header)
+		size := pr.order.Uint32(header[4:])
+		if size < 12 || size > maxPcapBlockSize {
+			return nil, errors.Errorf("invalid pcapng block size %d", size)
+		}
+		body := make([]byte, size-8)
+		if _, err := io.ReadFull(pr.r, body); err != nil {
+			return nil, errors.Trace(err)
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case pcapngInterfaceBlock:
+			if len(body) < 8 {
+				return nil, errors.New("invalid pcapng interface block")
+			}
+			iface := pcapngInterface{linkType: int(pr.order.Uint16(body))}
+			resol := pr.interfaceResolution(body[8:])
+			if resol&0x80 == 0 {
+				iface.tsUnit = 1e9
+				for i := byte(0); i < resol; i++ {
+					iface.tsUnit /= 10
+				}
+			} else {
+				iface.tsUnit = 1e9 / float64(uint64(1)<<(resol&0x7f))
+			}
+			pr.ifaces = append(pr.ifaces, iface)
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return nil, errors.New("invalid pcapng packet block")
+			}
+			id := int(pr.order.Uint32(body))
+			if id >= len(pr.ifaces) {
+				return nil, errors.Errorf("unknown pcapng interface %d", id)
+			}
+			iface := pr.ifaces[id]
+			ts := uint64(pr.order.Uint32(body[4:]))<<32 | uint64(pr.order.Uint32(body[8:]))
+			size := int(pr.order.Uint32(body[12:]))
+			if 20+size > len(body) {
+				return nil, errors.New("invalid pcapng packet length")
+			}
+			ns := int64(float64(ts) * iface.tsUnit)
+			return &capturedPacket{time: time.Unix(0, ns), linkType: iface.linkType, data: body[20 : 20+size]}, nil
+		case pcapngSimplePacket:
+			if len(pr.ifaces) == 0 || len(body) < 4 {
+				return nil, errors.New("invalid pcapng simple packet block")
+			}
+			size := int(pr.order.Uint32(body))
+			if 4+size > len(body) {
+				size = len(body) - 4
+			}
+			return &capturedPacket{linkType: pr.ifaces[0].linkType, data: body[4 : 4+size]}, nil
+		}
+	}
+}
+
+// interfaceResolution returns the if_tsresol option of an interface block.
+func (pr *pcapReader) interfaceResolution(options []byte) byte {
+	for len(options) >= 4 {
+		code, size := pr.order.Uint16(options), int(pr.order.Uint16(options[2:]))
+		options = options[4:]
+		if code == 0 || size > len(options) {
+			break
+		}
+		if code == pcapngOptionTSResol && size >= 1 {
+			return options[0]
+		}
+		options = options[(size+3)&^3:]
+	}
+	return defaultPcapngTSResol
+}
+
+// tcpSegment is the tcp part of a frame.
+type tcpSegment struct {
+	src, dst         string // ip:port
+	srcPort, dstPort int
+	seq              uint32
+	syn              bool
+	payload          []byte
+}
+
+// decodeTCP decodes the ip and tcp headers of a frame, ok is false if the
+// frame is not a tcp segment.
+func decodeTCP(p *capturedPacket) (seg *tcpSegment, ok bool) {
+	data := p.data
+	var etherType uint16
+	switch p.linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:]), data[14:]
+		for etherType == 0x8100 && len(data) >= 4 {
+			// vlan tags
+			etherType, data = binary.BigEndian.Uint16(data[2:]), data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:]), data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data), data[20:]
+	case linkTypeNull:
+		if len(data) < 4 {
+			return nil, false
+		}
+		// the address family in host byte order, 2 is AF_INET.
+		etherType = 0x86dd
+		if data[0] == 2 || data[3] == 2 {
+			etherType = 0x0800
+		}
+		data = data[4:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		if len(data) < 1 {
+			return nil, false
+		}
+		etherType = 0x0800
+		if data[0]>>4 == 6 {
+			etherType = 0x86dd
+		}
+	default:
+		return nil, false
+	}
+
+	var srcIP, dstIP net.IP
+	switch etherType {
+	case 0x0800:
+		if len(data) < 20 || data[9] != 6 {
+			return nil, false
+		}
+		ihl, total := int(data[0]&0x0f)*4, int(binary.BigEndian.Uint16(data[2:]))
+		if ihl < 20 || ihl > len(data) {
+			return nil, false
+		}
+		if binary.BigEndian.Uint16(data[6:])&0x3fff != 0 {
+			// fragments are not reassembled.
+			return nil, false
+		}
+		if total < ihl || total > len(data) {
+			total = len(data)
+		}
+		srcIP, dstIP, data = net.IP(data[12:16]), net.IP(data[16:20]), data[ihl:total]
+	case 0x86dd:
+		if len(data) < 40 || data[6] != 6 {
+			return nil, false
+		}
+		end := 40 + int(binary.BigEndian.Uint16(data[4:]))
+		if end > len(data) {
+			end = len(data)
+		}
+		srcIP, dstIP, data = net.IP(data[8:24]), net.IP(data[24:40]), data[40:end]
+	default:
+		return nil, false
+	}
+
+	if len(data) < 20 {
+		return nil, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return nil, false
+	}
+	flags := data[13]
+	seg = &tcpSegment{
+		srcPort: int(binary.BigEndian.Uint16(data)),
+		dstPort: int(binary.BigEndian.Uint16(data[2:])),
+		seq:     binary.BigEndian.Uint32(data[4:]),
+		syn:     flags&0x02 > 0,
+		payload: data[offset:],
+	}
+	seg.src = net.JoinHostPort(srcIP.String(), fmt.Sprint(seg.srcPort))
+	seg.dst = net.JoinHostPort(dstIP.String(), fmt.Sprint(seg.dstPort))
+	return seg, true
+}
+
+// tcpStream reassembles the payload of a direction of a tcp connection.
+type tcpStream struct {
+	started bool
+	nextSeq uint32
+	pending map[uint32]*pendingSegment // out of order segments by seq
+	data    []byte
+	times   []streamTime
+}
+
+type pendingSegment struct {
+	payload []byte
+	time    time.Time
+}
+
+// streamTime is the capture time of the stream bytes from offset.
+type streamTime struct {
+	offset int
+	time   time.Time
+}
+
+func (s *tcpStream) add(seg *tcpSegment, t time.Time) {
+	if !s.started {
+		s.started = true
+		s.nextSeq = seg.seq
+		s.pending = make(map[uint32]*pendingSegment)
+	}
+	if seg.syn {
+		s.nextSeq = seg.seq + 1
+		return
+	}
+	if len(seg.payload) == 0 {
+		return
+	}
+	if diff := int32(seg.seq - s.nextSeq); diff > 0 {
+		if _, ok := s.pending[seg.seq]; !ok {
+			s.pending[seg.seq] = &pendingSegment{payload: append([]byte(nil), seg.payload...), time: t}
+		}
+		return
+	}
+	s.append(seg.seq, seg.payload, t)
+	for len(s.pending) > 0 {
+		progressed := false
+		for seq, p := range s.pending {
+			if int32(seq-s.nextSeq) <= 0 {
+				delete(s.pending, seq)
+				s.append(seq, p.payload, p.time)
+				progressed = true
+			}
+		}
+		if !progressed {
+			return
+		}
+	}
+}
+
+// append appends the part of the payload after the next seq, the
+// retransmitted bytes are dropped.
+func (s *tcpStream) append(seq uint32, payload []byte, t time.Time) {
+	skip := int(s.nextSeq - seq)
+	if skip >= len(payload) {
+		return
+	}
+	s.times = append(s.times, streamTime{offset: len(s.data), time: t})
+	s.data = append(s.data, payload[skip:]...)
+	s.nextSeq += uint32(len(payload) - skip)
+}
+
+// timeAt returns the capture time of the byte at offset.
+func (s *tcpStream) timeAt(offset int) time.Time {
+	i := sort.Search(len(s.times), func(i int) bool { return s.times[i].offset > offset })
+	if i == 0 {
+		if len(s.times) == 0 {
+			return time.Time{}
+		}
+		return s.times[0].time
+	}
+	return s.times[i-1].time
+}
+
+// tcpConn is a tcp connection to the server port.
+type tcpConn struct {
+	client string
+	// the capture time of the last segment, such as the FIN.
+	last time.Time
+	// the streams from the client and from the server.
+	toServer, toClient tcpStream
+}
+
+// tcpAssembler groups the segments to and from a port by connection.
+type tcpAssembler struct {
+	port  int
+	open  map[string]*tcpConn // client address : connection
+	conns []*tcpConn
+}
+
+func newTCPAssembler(port int) *tcpAssembler {
+	return &tcpAssembler{port: port, open: make(map[string]*tcpConn)}
+}
+
+func (a *tcpAssembler) add(p *capturedPacket) {
+	seg, ok := decodeTCP(p)
+	if !ok {
+		return
+	}
+	var client string
+	toServer := seg.dstPort == a.port
+	if toServer {
+		client = seg.src
+	} else if seg.srcPort == a.port {
+		client = seg.dst
+	} else {
+		return
+	}
+	conn, ok := a.open[client]
+	if seg.syn && toServer && ok && len(conn.toServer.data) > 0 {
+		// the client port is reused by a new connection.
+		ok = false
+	}
+	if !ok {
+		conn = &tcpConn{client: client}
+		a.open[client] = conn
+		a.conns = append(a.conns, conn)
+	}
+	conn.last = p.time
+	if toServer {
+		conn.toServer.add(seg, p.time)
+	} else {
+		conn.toClient.add(seg, p.time)
+	}
+}
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// clientPluginAuthLenencData is the capability of a length encoded auth response.
+const clientPluginAuthLenencData = 1 << 21
+
+// PcapStats is the summary of a pcap conversion.
+type PcapStats struct {
+	Connections int
+	// Skipped is the number of connections which can not be decoded, such as
+	// the ones started before the capture, or using ssl or compression.
+	Skipped int
+	Records int
+}
+
+// ConvertPcap reads the mysql traffic to port from the pcap or pcapng
+// files, reassembles the tcp streams, decodes the commands and the responses
+// of every connection, and writes them to the session log in time order.
+func ConvertPcap(files []string, port int, w *Capture) (*PcapStats, error) {
+	a := newTCPAssembler(port)
+	for _, file := range files {
+		if err := readPcapFile(file, a); err != nil {
+			return nil, errors.Annotatef(err, "read %s", file)
+		}
+	}
+	stats := new(PcapStats)
+	var records []*CaptureRecord
+	for i, conn := range a.conns {
+		if len(conn.toServer.data) == 0 && len(conn.toClient.data) == 0 {
+			continue
+		}
+		stats.Connections++
+		recs, err := decodeMySQLConn(uint32(i+1), conn)
+		if err != nil {
+			log.Warningf("decode mysql connection from %s error %v", conn.client, err)
+		}
+		if len(recs) == 0 {
+			stats.Skipped++
+			continue
+		}
+		records = append(records, recs...)
+	}
+	sort.Stable(captureRecords(records))
+	for _, rec := range records {
+		w.Write(rec)
+	}
+	stats.Records = len(records)
+	return stats, nil
+}
+
+func readPcapFile(file string, a *tcpAssembler) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	pr, err := newPcapReader(f)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for {
+		p, err := pr.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			// a capture cut while writing ends with a truncated packet.
+			if errors.Cause(err) == io.ErrUnexpectedEOF {
+				log.Warningf("truncated capture file %s", file)
+				return nil
+			}
+			return errors.Trace(err)
+		}
+		a.add(p)
+	}
+}
+
+type captureRecords []*CaptureRecord
+
+func (rs captureRecords) Len() int           { return len(rs) }
+func (rs captureRecords) Less(i, j int) bool { return rs[i].Time.Before(rs[j].Time) }
+func (rs captureRecords) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+
+// streamConn reads a reassembled stream, the writes are dropped, so the
+// reading half of MysqlConn decodes the responses of a captured server.
+type streamConn struct {
+	net.Conn
+	data []byte
+	pos  int
+}
+
+func (sc *streamConn) Read(b []byte) (int, error) {
+	if sc.pos >= len(sc.data) {
+		return 0, io.EOF
+	}
+	n := copy(b, sc.data[sc.pos:])
+	sc.pos += n
+	return n, nil
+}
+
+func (sc *streamConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// offset returns the stream offset of the next packet p reads.
+func (sc *streamConn) offset(p *PacketIO) int {
+	return sc.pos - p.rb.Buffered()
+}
+
+// mysqlConnDecoder decodes the commands of a captured connection and the
+// responses of the server.
+type mysqlConnDecoder struct {
+	id     uint32
+	tcp    *tcpConn
+	client *PacketIO
+	cs     *streamConn
+	server *MysqlConn // the reading half decodes the responses
+	ss     *streamConn
+	// the parameter types of the statements, reused by the executes which do
+	// not bind new types.
+	paramTypes map[int][]byte
+}
+
+// decodeMySQLConn returns the records of a connection, the records decoded
+// before an error are returned with it.
+func decodeMySQLConn(id uint32, conn *tcpConn) (records []*CaptureRecord, err error) {
+	d := &mysqlConnDecoder{
+		id:         id,
+		tcp:        conn,
+		cs:         &streamConn{data: conn.toServer.data},
+		ss:         &streamConn{data: conn.toClient.data},
+		paramTypes: make(map[int][]byte),
+	}
+	d.client = NewPacketIO(d.cs)
+	d.server = &MysqlConn{pkg: NewPacketIO(d.ss), stmts: make(map[int]*MysqlStatement)}
+
+	connect, err := d.handshake()
+	if err != nil || connect == nil {
+		return nil, errors.Trace(err)
+	}
+	records = append(records, connect)
+	for {
+		rec, err := d.next()
+		if rec != nil {
+			records = append(records, rec)
+		}
+		if err == nil && rec.Cmd == CaptureQuit {
+			return records, nil
+		}
+		if err != nil {
+			// the connection ends without quit, or the capture ends.
+			records = append(records, &CaptureRecord{
+				Conn: id,
+				Time: conn.last,
+				Cmd:  CaptureDisconnect,
+			})
+			if cause := errors.Cause(err); cause != io.EOF && cause != io.ErrUnexpectedEOF {
+				return records, errors.Trace(err)
+			}
+			return records, nil
+		}
+	}
+}
+
+// handshake decodes the greeting, the handshake response and the auth
+// result, the connect record is nil if the handshake failed.
+func (d *mysqlConnDecoder) handshake() (*CaptureRecord, error) {
+	greeting, err := d.server.readPacket()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if greeting[0] < MinProtocolVersion {
+		return nil, errors.New("the connection started before the capture")
+	}
+	start := d.cs.offset(d.client)
+	d.client.Sequence = d.server.pkg.Sequence
+	data, err := d.client.ReadPacket()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rec, err := parseHandshakeResponse(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rec.Conn, rec.Time = d.id, d.tcp.toServer.timeAt(start)
+	d.server.capability = rec.Capability
+
+	for {
+		d.server.pkg.Sequence = d.client.Sequence
+		data, err = d.server.readPacket()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		switch {
+		case data[0] == OKHeader:
+			return rec, nil
+		case data[0] == ErrHeader:
+			// access denied, the client sends nothing else.
+			return nil, nil
+		case bytes.Equal(data, []byte{1, 3}):
+			// fast auth success, the ok packet follows.
+			d.client.Sequence = d.server.pkg.Sequence
+			continue
+		}
+		// auth switch or more auth data, the client answers.
+		d.client.Sequence = d.server.pkg.Sequence
+		if _, err = d.client.ReadPacket(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+}
+
+// parseHandshakeResponse decodes the user, the database and the
+// capabilities of a protocol 4.1 handshake response.
+func parseHandshakeResponse(data []byte) (*CaptureRecord, error) {
+	if len(data) < 32 {
+		return nil, errors.New("invalid handshake response")
+	}
+	capability := binary.LittleEndian.Uint32(data)
+	if capability&ClientProtocol41 == 0 {
+		return nil, errors.New("protocol before 4.1 is not supported")
+	}
+	if capability&ClientSSL > 0 {
+		return nil, errors.New("ssl connection can not be decoded")
+	}
+	if capability&ClientCompress > 0 {
+		return nil, errors.New("compressed protocol is not supported")
+	}
+	rec := &CaptureRecord{Cmd: CaptureConnect, Capability: capability, Collation: data[8]}
+	pos := 32
+	end := bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		return nil, errors.New("invalid handshake response user")
+	}
+	rec.User = string(data[pos : pos+end])
+	pos += end + 1
+	if pos < len(data) {
+		switch {
+		case capability&clientPluginAuthLenencData > 0:
+			n, _, size := parseLengthEncodedInt(data[pos:])
+			pos += size + int(n)
+		case capability&ClientSecureConnection > 0:
+			pos += 1 + int(data[pos])
+		default:
+			if end = bytes.IndexByte(data[pos:], 0); end >= 0 {
+				pos += end + 1
+			}
+		}
+	}
+	if capability&ClientConnectWithDB > 0 && pos < len(data) {
+		if end = bytes.IndexByte(data[pos:], 0); end >= 0 {
+			rec.DB = string(data[pos : pos+end])
+		} else {
+			rec.DB = string(data[pos:])
+		}
+	}
+	return rec, nil
+}
+
+// next decodes a command and its response.
+func (d *mysqlConnDecoder) next() (*CaptureRecord, error) {
+	start := d.cs.offset(d.client)
+	d.client.Sequence = 0
+	data, err := d.client.ReadPacket()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cmd := data[0]
+	rec := newCaptureRecord(d.id, cmd, data[1:])
+	rec.Time = d.tcp.toServer.timeAt(start)
+
+	mc := d.server
+	mc.pkg.Sequence = d.client.Sequence
+	var rs *ResultSet
+	switch cmd {
+	case ComQuit:
+		return rec, nil
+	case ComStmtClose:
+		delete(mc.stmts, rec.StmtID)
+		delete(d.paramTypes, rec.StmtID)
+		return rec, nil
+	case ComStmtSendLongData:
+		if stmt, ok := mc.stmts[rec.StmtID]; ok && len(data) >= 7 {
+			stmt.AppendParam(rec.Param, data[7:])
+		}
+		return rec, nil
+	case ComQuery:
+		rs, err = mc.readResult(false)
+	case ComInitDB, ComPing, ComStmtReset:
+		err = mc.readOK()
+	case ComFieldList:
+		// the table and the wildcard are sent again to the dropping writer.
+		args := strings.SplitN(rec.SQL, "\x00", 2)
+		args = append(args, "")
+		var columns []*ColumnInfo
+		if columns, err = mc.FieldList(args[0], args[1]); err == nil {
+			rec.Result = &CaptureResult{Kind: "fields", Rows: len(columns)}
+		}
+	case ComStmtPrepare:
+		var stmt IStatement
+		if stmt, _, _, err = mc.Prepare(rec.SQL); err == nil {
+			rec.StmtID = stmt.ID()
+			rec.Result = &CaptureResult{Kind: "ok"}
+		}
+	case ComStmtExecute:
+		if stmt, ok := mc.stmts[rec.StmtID]; ok {
+			args, err := d.executeArgs(stmt, data[1:])
+			if err != nil {
+				log.Warningf("decode execute arguments of statement %d error %v", rec.StmtID, err)
+			} else {
+				rec.Args = captureArgs(args)
+			}
+			stmt.Reset()
+		}
+		rs, err = mc.readResult(true)
+	default:
+		rs, err = mc.readResult(false)
+	}
+
+	if sqlErr, ok := errors.Cause(err).(*SQLError); ok {
+		rec.Result, err = errorResult(sqlErr), nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rec.Result == nil {
+		if rs != nil {
+			rec.Result = rowsResult(rs)
+		} else {
+			rec.Result = okResult(mc)
+		}
+	}
+	end := d.ss.offset(mc.pkg) - 1
+	rec.Duration = int64(d.tcp.toClient.timeAt(end).Sub(rec.Time) / time.Microsecond)
+	return rec, nil
+}
+
+// executeArgs decodes the arguments of an execute packet as handleStmtExecute does.
+func (d *mysqlConnDecoder) executeArgs(stmt *MysqlStatement, data []byte) ([]interface{}, error) {
+	numParams := stmt.NumParams()
+	args := make([]interface{}, numParams)
+	if numParams == 0 {
+		return args, nil
+	}
+	// stmt id, flag and iteration count
+	pos := 9
+	nullBitmapLen := (numParams + 7) >> 3
+	if len(data) < pos+nullBitmapLen+1 {
+		return nil, ErrMalformPacket
+	}
+	nullBitmaps := data[pos : pos+nullBitmapLen]
+	pos += nullBitmapLen
+	paramTypes := d.paramTypes[stmt.ID()]
+	var paramValues []byte
+	if data[pos] == 1 {
+		pos++
+		if len(data) < pos+(numParams<<1) {
+			return nil, ErrMalformPacket
+		}
+		paramTypes = data[pos : pos+(numParams<<1)]
+		d.paramTypes[stmt.ID()] = append([]byte(nil), paramTypes...)
+		pos += numParams << 1
+	} else {
+		pos++
+	}
+	paramValues = data[pos:]
+	if len(paramTypes) < numParams<<1 {
+		return nil, ErrMalformPacket
+	}
+	if err := parseStmtArgs(args, stmt.BoundParams(), nullBitmaps, paramTypes, paramValues); err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the string arguments refer to the packet.
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			args[i] = string(append([]byte(nil), s...))
+		}
+	}
+	return args, nil
+}
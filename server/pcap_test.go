@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testPcapSuite{})
+
+type testPcapSuite struct {
+}
+
+func (s *testPcapSuite) TestConvertPcap(c *C) {
+	for _, fixture := range []string{"testdata/mysql.pcap", "testdata/mysql.pcapng"} {
+		file := filepath.Join(c.MkDir(), "session.log")
+		capture, err := OpenCapture(etc.Capture{File: file})
+		c.Assert(err, IsNil)
+		stats, err := ConvertPcap([]string{fixture}, 3306, capture)
+		c.Assert(err, IsNil)
+		capture.Close()
+		// the connection started before the capture is skipped.
+		c.Assert(*stats, Equals, PcapStats{Connections: 3, Skipped: 1, Records: 11})
+
+		records := readCapture(c, file)
+		var cmds []string
+		for _, rec := range records {
+			cmds = append(cmds, fmt.Sprintf("%d %s", rec.Conn, rec.Cmd))
+		}
+		c.Assert(cmds, DeepEquals, []string{
+			"1 connect", "2 connect", "1 query", "1 query", "2 ping", "1 prepare",
+			"1 execute", "1 execute", "1 close_stmt", "1 quit", "2 disconnect",
+		}, Commentf("fixture %s", fixture))
+
+		c.Assert(records[0].User, Equals, "root")
+		c.Assert(records[0].DB, Equals, "test")
+		c.Assert(records[0].Time.Unix(), Equals, int64(1451606400))
+		one := &ResultSet{Columns: []*ColumnInfo{{Name: "1", Type: TypeLonglong}}, Rows: [][]interface{}{{int64(1)}}}
+		c.Assert(records[2].SQL, Equals, "select 1")
+		c.Assert(*records[2].Result, Equals, *rowsResult(one))
+		c.Assert(records[3].Result.Code, Equals, uint16(ErNoSuchTable))
+		c.Assert(records[5].StmtID, Equals, 1)
+		c.Assert(records[6].Args, DeepEquals, captureArgs([]interface{}{int64(5)}))
+		c.Assert(records[6].Result.Rows, Equals, 1)
+		// the second execute reuses the parameter types of the first.
+		c.Assert(records[7].Args, DeepEquals, captureArgs([]interface{}{int64(7)}))
+		c.Assert(records[6].Duration > 0, Equals, true)
+	}
+}
+
+func (s *testPcapSuite) TestDecodeMalformed(c *C) {
+	ip := make([]byte, 40)
+	ip[0], ip[9] = 0x45, 6
+	ip[2], ip[3] = 0, 40
+	for _, vihl := range []byte{0x41, 0x4f} {
+		// the header length is shorter than the fixed header or longer than the packet.
+		ip[0] = vihl
+		_, ok := decodeTCP(&capturedPacket{linkType: linkTypeRaw, data: ip})
+		c.Assert(ok, Equals, false, Commentf("version and ihl %#x", vihl))
+	}
+}
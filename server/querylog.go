@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// QueryLogEntry is a command of a client, written to the general log as a
+// json line, and to the slow log if it's a slow statement.
+type QueryLogEntry struct {
+	Time         time.Time `json:"time"`
+	Conn         uint32    `json:"conn"`
+	User         string    `json:"user"`
+	Host         string    `json:"host"`
+	DB           string    `json:"db"`
+	Cmd          string    `json:"cmd"`
+	SQL          string    `json:"sql,omitempty"`
+	Duration     int64     `json:"duration_us"`
+	RowsSent     int       `json:"rows_sent"`
+	RowsAffected uint64    `json:"rows_affected"`
+	ErrCode      uint16    `json:"err_code,omitempty"`
+}
+
+// QueryLog writes the general log and the slow log, either may be disabled.
+type QueryLog struct {
+	general       *logFile
+	slow          *logFile
+	longQueryTime time.Duration
+}
+
+// OpenQueryLog opens the configured log files, addr is the listening address
+// written in the header of the slow log.
+func OpenQueryLog(cfg etc.QueryLog, addr string) (*QueryLog, error) {
+	ql := &QueryLog{longQueryTime: time.Duration(cfg.LongQueryTime * float64(time.Second))}
+	var err error
+	if cfg.General != "" {
+		if ql.general, err = openLogFile(cfg.General, cfg.MaxSize, cfg.MaxFiles, nil); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if cfg.Slow != "" {
+		_, port, _ := net.SplitHostPort(addr)
+		header := func() []byte {
+			return []byte(fmt.Sprintf("%s, Version: %s (mp). started with:\nTcp port: %s  Unix socket: \nTime                 Id Command    Argument\n", os.Args[0], ServerVersion, port))
+		}
+		if ql.slow, err = openLogFile(cfg.Slow, cfg.MaxSize, cfg.MaxFiles, header); err != nil {
+			ql.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	return ql, nil
+}
+
+// Write logs an entry, the errors are logged, the query log never fails the client.
+func (ql *QueryLog) Write(e *QueryLogEntry) {
+	if ql == nil {
+		return
+	}
+	if ql.general != nil {
+		b, err := json.Marshal(e)
+		if err == nil {
+			err = ql.general.Write(append(b, '\n'))
+		}
+		if err != nil {
+			log.Warningf("write general log error %s", errors.ErrorStack(err))
+		}
+	}
+	if ql.slow != nil && (e.Cmd == CaptureQuery || e.Cmd == CaptureExecute) &&
+		time.Duration(e.Duration)*time.Microsecond >= ql.longQueryTime {
+		if err := ql.slow.Write(slowLogEntry(e)); err != nil {
+			log.Warningf("write slow log error %s", errors.ErrorStack(err))
+		}
+	}
+}
+
+// slowLogEntry formats an entry like the slow log of mysql, with the extra
+// attributes of percona server, so the tools parsing the slow log of mysql
+// such as pt-query-digest parse it. The rows examined are unknown to mp.
+func slowLogEntry(e *QueryLogEntry) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Time: %s\n", e.Time.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	fmt.Fprintf(&b, "# User@Host: %s[%s] @  [%s]  Id: %d\n", e.User, e.User, e.Host, e.Conn)
+	fmt.Fprintf(&b, "# Schema: %s  Last_errno: %d  Killed: 0\n", e.DB, e.ErrCode)
+	fmt.Fprintf(&b, "# Query_time: %.6f  Lock_time: 0.000000  Rows_sent: %d  Rows_examined: 0  Rows_affected: %d\n",
+		float64(e.Duration)/1e6, e.RowsSent, e.RowsAffected)
+	if e.DB != "" {
+		fmt.Fprintf(&b, "use %s;\n", e.DB)
+	}
+	fmt.Fprintf(&b, "SET timestamp=%d;\n", e.Time.Unix())
+	sql := strings.TrimRight(e.SQL, "; \t\r\n")
+	b.WriteString(sql)
+	b.WriteString(";\n")
+	return b.Bytes()
+}
+
+func (ql *QueryLog) Close() error {
+	if ql == nil {
+		return nil
+	}
+	var err error
+	for _, f := range []*logFile{ql.general, ql.slow} {
+		if f != nil {
+			if e := f.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	return errors.Trace(err)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testQueryLogSuite{})
+
+type testQueryLogSuite struct {
+}
+
+func (s *testQueryLogSuite) TestQueryLog(c *C) {
+	dir := c.MkDir()
+	general, slow := filepath.Join(dir, "general.log"), filepath.Join(dir, "slow.log")
+	ql, err := OpenQueryLog(etc.QueryLog{General: general, Slow: slow}, ":4000")
+	c.Assert(err, IsNil)
+	fc := newFakeContext()
+	cc := newCaptureConn(nil, fc)
+	cc.server.queryLog = ql
+	cc.user, cc.dbname = "root", "test"
+
+	fc.rs = &ResultSet{Columns: []*ColumnInfo{{Name: "a", Type: TypeLonglong}}, Rows: [][]interface{}{{int64(1)}, {int64(2)}}}
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select a from t;"...)), IsNil)
+	fc.rs, fc.err = nil, errors.Trace(NewError(ErNoSuchTable, "no such table"))
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "delete from t2"...)), NotNil)
+	fc.err = nil
+	c.Assert(cc.dispatch(append([]byte{ComStmtPrepare}, "insert into t values (?)"...)), IsNil)
+	c.Assert(cc.dispatch([]byte{ComStmtExecute, 1, 0, 0, 0, 0, 1, 0, 0, 0}), IsNil)
+	c.Assert(cc.dispatch([]byte{ComPing}), IsNil)
+	c.Assert(ql.Close(), IsNil)
+
+	data, err := ioutil.ReadFile(general)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(lines, HasLen, 5)
+	var entries []*QueryLogEntry
+	for _, line := range lines {
+		e := new(QueryLogEntry)
+		c.Assert(json.Unmarshal([]byte(line), e), IsNil)
+		entries = append(entries, e)
+	}
+	c.Assert(entries[0].Conn, Equals, uint32(7))
+	c.Assert(entries[0].User, Equals, "root")
+	c.Assert(entries[0].DB, Equals, "test")
+	c.Assert(entries[0].RowsSent, Equals, 2)
+	c.Assert(entries[1].ErrCode, Equals, uint16(ErNoSuchTable))
+	c.Assert(entries[3].Cmd, Equals, CaptureExecute)
+	c.Assert(entries[3].SQL, Equals, "insert into t values (?)")
+	c.Assert(entries[4].Cmd, Equals, CapturePing)
+
+	// every query and execute is slow with zero long query time.
+	data, err = ioutil.ReadFile(slow)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(data), os.Args[0]+", Version: "), Equals, true)
+	c.Assert(strings.Count(string(data), "# Query_time: "), Equals, 3)
+	c.Assert(string(data), Matches, `(?s).*# Schema: test  Last_errno: 0  Killed: 0\n# Query_time: \d+\.\d{6}  Lock_time: 0\.000000  Rows_sent: 2  Rows_examined: 0  Rows_affected: 0\nuse test;\nSET timestamp=\d+;\nselect a from t;\n.*`)
+	c.Assert(string(data), Matches, `(?s).*Last_errno: 1146 .*delete from t2;\n.*`)
+
+	e := &QueryLogEntry{Time: time.Unix(1451959200, 0), Conn: 8, User: "app", Host: "10.0.0.1", Cmd: CaptureQuery, SQL: "select sleep(1)", Duration: 1000123}
+	c.Assert(string(slowLogEntry(e)), Equals, "# Time: 2016-01-05T02:00:00.000000Z\n"+
+		"# User@Host: app[app] @  [10.0.0.1]  Id: 8\n"+
+		"# Schema:   Last_errno: 0  Killed: 0\n"+
+		"# Query_time: 1.000123  Lock_time: 0.000000  Rows_sent: 0  Rows_examined: 0  Rows_affected: 0\n"+
+		"SET timestamp=1451959200;\n"+
+		"select sleep(1);\n")
+}
+
+func (s *testQueryLogSuite) TestQueryLogUse(c *C) {
+	general := filepath.Join(c.MkDir(), "general.log")
+	ql, err := OpenQueryLog(etc.QueryLog{General: general}, ":4000")
+	c.Assert(err, IsNil)
+	fc := newFakeContext()
+	cc := newCaptureConn(nil, fc)
+	cc.server.queryLog = ql
+	cc.dbname = "test"
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "use `gotest`"...)), IsNil)
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select 1"...)), IsNil)
+	c.Assert(ql.Close(), IsNil)
+
+	data, err := ioutil.ReadFile(general)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(lines, HasLen, 2)
+	for _, line := range lines {
+		e := new(QueryLogEntry)
+		c.Assert(json.Unmarshal([]byte(line), e), IsNil)
+		c.Assert(e.DB, Equals, "gotest")
+	}
+}
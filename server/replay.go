@@ -0,0 +1,425 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+const (
+	defaultMaxRegressions = 100
+	defaultMaxQueued      = 100000
+)
+
+// ReplayConfig configures the replay of session logs.
+type ReplayConfig struct {
+	// Speed scales the original timing of the commands, 1 replays at the
+	// original timing, 2 twice as fast, zero as fast as possible.
+	Speed float64
+	// MaxRegressions is the max number of regressions listed in the report,
+	// zero means the default.
+	MaxRegressions int
+	// MaxQueued is the max number of records read ahead and queued by all the
+	// connections, zero means the default.
+	MaxQueued int
+}
+
+// ReplayRegression is a replayed command whose response differs from the recorded one.
+type ReplayRegression struct {
+	Conn     uint32         `json:"conn"`
+	Time     time.Time      `json:"time"`
+	Cmd      string         `json:"cmd"`
+	SQL      string         `json:"sql,omitempty"`
+	StmtID   int            `json:"stmt_id,omitempty"`
+	Msg      string         `json:"msg"`
+	Expected *CaptureResult `json:"expected,omitempty"`
+	Got      *CaptureResult `json:"got,omitempty"`
+}
+
+// ReplayReport is the summary of a replay.
+type ReplayReport struct {
+	Connections int                 `json:"connections"`
+	Commands    int                 `json:"commands"`
+	Compared    int                 `json:"compared"`
+	Regressions int                 `json:"regressions"`
+	Duration    time.Duration       `json:"duration"`
+	Listed      []*ReplayRegression `json:"listed"`
+}
+
+type replayer struct {
+	driver IDriver
+	cfg    ReplayConfig
+	// the time of the first record and the time the replay started, the
+	// commands are issued at the same offset scaled by the speed.
+	first  time.Time
+	start  time.Time
+	queued *replayLimit
+
+	mu     sync.Mutex
+	report ReplayReport
+}
+
+// Replay reads the session logs in order, and re-issues the commands of
+// every recorded connection on a connection of driver, the connections run
+// concurrently. The responses are compared with the recorded summaries, the
+// last insert ids are not compared, since ids are allocated differently by
+// each run. A MysqlDriver replays over the mysql protocol to its address.
+//
+// Every connection has its own queue, so a slow connection doesn't hold up the
+// others until MaxQueued records are queued by all of them, then the logs
+// are read as fast as the connections catch up. A connection waiting for a
+// command of another one which is not read yet, like a lock released by a
+// later COMMIT, waits until the backend times out.
+func Replay(driver IDriver, files []string, cfg ReplayConfig) (*ReplayReport, error) {
+	if cfg.MaxRegressions <= 0 {
+		cfg.MaxRegressions = defaultMaxRegressions
+	}
+	if cfg.MaxQueued <= 0 {
+		cfg.MaxQueued = defaultMaxQueued
+	}
+	r := &replayer{driver: driver, cfg: cfg, start: time.Now(), queued: newReplayLimit(cfg.MaxQueued)}
+	sessions := make(map[uint32]*replaySession)
+	var wg sync.WaitGroup
+	closeSession := func(conn uint32) {
+		if s, ok := sessions[conn]; ok {
+			s.records.close()
+			delete(sessions, conn)
+		}
+	}
+	var err error
+	for _, file := range files {
+		if err = r.readFile(file, func(rec *CaptureRecord) {
+			if r.first.IsZero() {
+				r.first = rec.Time
+			}
+			r.wait(rec.Time)
+			if rec.Cmd == CaptureConnect {
+				// a connection id is reused after mp restarts.
+				closeSession(rec.Conn)
+			}
+			s, ok := sessions[rec.Conn]
+			if !ok {
+				s = &replaySession{r: r, conn: rec.Conn, stmts: make(map[int]IStatement), records: newReplayQueue(r.queued)}
+				sessions[rec.Conn] = s
+				r.report.Connections++
+				wg.Add(1)
+				go func() {
+					s.run()
+					wg.Done()
+				}()
+			}
+			s.records.push(rec)
+			if rec.Cmd == CaptureQuit || rec.Cmd == CaptureDisconnect {
+				closeSession(rec.Conn)
+			}
+		}); err != nil {
+			break
+		}
+	}
+	for conn := range sessions {
+		closeSession(conn)
+	}
+	wg.Wait()
+	r.report.Duration = time.Since(r.start)
+	return &r.report, errors.Trace(err)
+}
+
+func (r *replayer) readFile(file string, handle func(rec *CaptureRecord)) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	cr, err := NewCaptureReader(f)
+	if err != nil {
+		return errors.Annotatef(err, "read %s", file)
+	}
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Annotatef(err, "read %s", file)
+		}
+		handle(rec)
+	}
+}
+
+// wait sleeps until the scaled offset of t from the first record.
+func (r *replayer) wait(t time.Time) {
+	if r.cfg.Speed <= 0 {
+		return
+	}
+	at := r.start.Add(time.Duration(float64(t.Sub(r.first)) / r.cfg.Speed))
+	if d := at.Sub(time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (r *replayer) regress(rec *CaptureRecord, msg string, got *CaptureResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.Regressions++
+	if len(r.report.Listed) < r.cfg.MaxRegressions {
+		r.report.Listed = append(r.report.Listed, &ReplayRegression{
+			Conn:     rec.Conn,
+			Time:     rec.Time,
+			Cmd:      rec.Cmd,
+			SQL:      rec.SQL,
+			StmtID:   rec.StmtID,
+			Msg:      msg,
+			Expected: rec.Result,
+			Got:      got,
+		})
+	}
+}
+
+func (r *replayer) count(compared bool) {
+	r.mu.Lock()
+	r.report.Commands++
+	if compared {
+		r.report.Compared++
+	}
+	r.mu.Unlock()
+}
+
+// replaySession replays the commands of a recorded connection.
+type replaySession struct {
+	r       *replayer
+	conn    uint32
+	ctx     IContext
+	broken  bool
+	stmts   map[int]IStatement // recorded statement id : replayed statement
+	records *replayQueue
+}
+
+// replayLimit bounds the records queued by all the connections.
+type replayLimit struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queued int
+	max    int
+}
+
+func newReplayLimit(max int) *replayLimit {
+	l := &replayLimit{max: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits until less than max records are queued and counts one more.
+func (l *replayLimit) acquire() {
+	l.mu.Lock()
+	for l.queued >= l.max {
+		l.cond.Wait()
+	}
+	l.queued++
+	l.mu.Unlock()
+}
+
+func (l *replayLimit) release() {
+	l.mu.Lock()
+	l.queued--
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+// replayQueue is the queue of the records of a connection, the records
+// queued by all the connections are bounded by limit.
+type replayQueue struct {
+	limit   *replayLimit
+	mu      sync.Mutex
+	cond    *sync.Cond
+	records []*CaptureRecord
+	closed  bool
+}
+
+func newReplayQueue(limit *replayLimit) *replayQueue {
+	q := &replayQueue{limit: limit}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues rec, it blocks while the limit is reached.
+func (q *replayQueue) push(rec *CaptureRecord) {
+	q.limit.acquire()
+	q.mu.Lock()
+	q.records = append(q.records, rec)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+func (q *replayQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop waits for the next record, ok is false once the queue is closed and empty.
+func (q *replayQueue) pop() (rec *CaptureRecord, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.records) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.records) == 0 {
+		return nil, false
+	}
+	rec = q.records[0]
+	q.records[0] = nil
+	q.records = q.records[1:]
+	q.limit.release()
+	return rec, true
+}
+
+func (s *replaySession) run() {
+	for {
+		rec, ok := s.records.pop()
+		if !ok {
+			break
+		}
+		if s.broken {
+			continue
+		}
+		s.r.wait(rec.Time)
+		s.replay(rec)
+	}
+	if s.ctx != nil {
+		s.ctx.Close()
+	}
+}
+
+func (s *replaySession) replay(rec *CaptureRecord) {
+	if s.ctx == nil {
+		// the log may start in the middle of a connection.
+		capability, collation := DefaultCapability, uint8(DefaultCollationID)
+		if rec.Cmd == CaptureConnect {
+			capability, collation = rec.Capability, rec.Collation
+		}
+		ctx, err := s.r.driver.OpenCtx(capability, collation, rec.DB)
+		if err != nil {
+			log.Warningf("replay connection %d open error %v", s.conn, err)
+			s.r.regress(rec, fmt.Sprintf("open connection error %v", err), nil)
+			s.broken = true
+			return
+		}
+		s.ctx = ctx
+	}
+	got, ok := s.execute(rec)
+	s.r.count(ok)
+	if !ok {
+		return
+	}
+	if msg := compareCaptureResults(rec.Result, got); msg != "" {
+		s.r.regress(rec, msg, got)
+	}
+}
+
+// execute issues the command of rec, ok is false if the response is not compared.
+func (s *replaySession) execute(rec *CaptureRecord) (got *CaptureResult, ok bool) {
+	var rs *ResultSet
+	var err error
+	switch rec.Cmd {
+	case CaptureQuery:
+		rs, err = s.ctx.Execute(rec.SQL)
+	case CaptureInitDB:
+		_, err = s.ctx.Execute("use " + rec.SQL)
+	case CapturePing:
+	case CaptureFieldList:
+		var columns []*ColumnInfo
+		if columns, err = s.ctx.FieldList(rec.SQL, ""); err == nil {
+			return &CaptureResult{Kind: "fields", Rows: len(columns)}, true
+		}
+	case CapturePrepare:
+		var stmt IStatement
+		if stmt, _, _, err = s.ctx.Prepare(rec.SQL); err == nil {
+			s.stmts[rec.StmtID] = stmt
+			return &CaptureResult{Kind: "ok"}, true
+		}
+	case CaptureExecute:
+		stmt, found := s.stmts[rec.StmtID]
+		if !found {
+			err = NewDefaultError(ErUnknownStmtHandler, strconv.Itoa(rec.StmtID), "stmt_execute")
+			break
+		}
+		args := make([]interface{}, len(rec.Args))
+		for i, v := range rec.Args {
+			if args[i], err = v.Interface(); err != nil {
+				return nil, false
+			}
+		}
+		rs, err = stmt.Execute(args...)
+	case CaptureLongData:
+		if stmt, found := s.stmts[rec.StmtID]; found && len(rec.Args) == 1 {
+			if data, err := rec.Args[0].Interface(); err == nil {
+				stmt.AppendParam(rec.Param, data.([]byte))
+			}
+		}
+		return nil, false
+	case CaptureResetStmt:
+		stmt, found := s.stmts[rec.StmtID]
+		if !found {
+			err = NewDefaultError(ErUnknownStmtHandler, strconv.Itoa(rec.StmtID), "stmt_reset")
+			break
+		}
+		stmt.Reset()
+	case CaptureCloseStmt:
+		if stmt, found := s.stmts[rec.StmtID]; found {
+			stmt.Close()
+			delete(s.stmts, rec.StmtID)
+		}
+		return nil, false
+	default:
+		// connect, quit and disconnect have no response.
+		return nil, false
+	}
+	if err != nil {
+		return errorResult(err), true
+	}
+	if rs != nil {
+		return rowsResult(rs), true
+	}
+	return okResult(s.ctx), true
+}
+
+// compareCaptureResults returns the difference of the recorded and the
+// replayed responses, empty if they match.
+func compareCaptureResults(expected, got *CaptureResult) string {
+	if expected == nil {
+		// nothing was recorded to compare with.
+		return ""
+	}
+	if expected.Kind != got.Kind {
+		msg := fmt.Sprintf("expect %s, got %s", expected.Kind, got.Kind)
+		if got.Kind == "error" {
+			msg += fmt.Sprintf(" %d %s", got.Code, got.Message)
+		}
+		return msg
+	}
+	switch expected.Kind {
+	case "error":
+		if expected.Code != got.Code {
+			return fmt.Sprintf("expect error %d, got %d %s", expected.Code, got.Code, got.Message)
+		}
+	case "ok":
+		if expected.AffectedRows != got.AffectedRows {
+			return fmt.Sprintf("expect affected rows %d, got %d", expected.AffectedRows, got.AffectedRows)
+		}
+	case "rows", "fields":
+		if expected.Rows != got.Rows {
+			return fmt.Sprintf("expect rows count %d, got %d", expected.Rows, got.Rows)
+		}
+		if expected.Digest != got.Digest {
+			return fmt.Sprintf("expect rows digest %s, got %s", expected.Digest, got.Digest)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testReplaySuite{})
+
+type testReplaySuite struct {
+}
+
+// replayDriver opens a scripted context per connection.
+type replayDriver struct {
+	mu      sync.Mutex
+	results map[string]*ResultSet
+	opened  []*scriptedContext
+}
+
+func (rd *replayDriver) OpenCtx(capability uint32, collation uint8, dbname string) (IContext, error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	ctx := &scriptedContext{fakeContext: newFakeContext(), results: rd.results}
+	rd.opened = append(rd.opened, ctx)
+	return ctx, nil
+}
+
+func (s *testReplaySuite) TestReplay(c *C) {
+	one := &ResultSet{Columns: []*ColumnInfo{{Name: "1", Type: TypeLonglong}}, Rows: [][]interface{}{{int64(1)}}}
+	file := filepath.Join(c.MkDir(), "session.log")
+	capture, err := OpenCapture(etc.Capture{File: file})
+	c.Assert(err, IsNil)
+	t0 := time.Now()
+	for _, rec := range []*CaptureRecord{
+		{Conn: 1, Cmd: CaptureConnect, DB: "test", Capability: DefaultCapability},
+		{Conn: 1, Cmd: CaptureQuery, SQL: "select 1", Result: rowsResult(one)},
+		{Conn: 2, Cmd: CaptureQuery, SQL: "delete from t", Result: &CaptureResult{Kind: "ok"}},
+		{Conn: 1, Cmd: CaptureQuery, SQL: "select 2", Result: &CaptureResult{Kind: "rows", Rows: 2}},
+		{Conn: 1, Cmd: CapturePrepare, SQL: "update t set a = ?", StmtID: 5, Result: &CaptureResult{Kind: "ok"}},
+		{Conn: 1, Cmd: CaptureExecute, StmtID: 5, Args: captureArgs([]interface{}{int64(1)}), Result: &CaptureResult{Kind: "ok"}},
+		{Conn: 2, Cmd: CaptureExecute, StmtID: 9, Result: &CaptureResult{Kind: "ok"}},
+		{Conn: 1, Cmd: CaptureCloseStmt, StmtID: 5},
+		{Conn: 1, Cmd: CaptureQuit},
+	} {
+		rec.Time = t0
+		if rec.Conn == 2 {
+			rec.Time = t0.Add(50 * time.Millisecond)
+		}
+		capture.Write(rec)
+	}
+	capture.Close()
+
+	driver := &replayDriver{results: map[string]*ResultSet{"select 1": one, "select 2": one}}
+	report, err := Replay(driver, []string{file}, ReplayConfig{Speed: 1, MaxQueued: 1})
+	c.Assert(err, IsNil)
+	c.Assert(report.Connections, Equals, 2)
+	c.Assert(report.Commands, Equals, 9)
+	c.Assert(report.Compared, Equals, 6)
+	c.Assert(report.Regressions, Equals, 2)
+	c.Assert(report.Duration >= 50*time.Millisecond, Equals, true)
+	c.Assert(driver.opened, HasLen, 2)
+
+	var msgs []string
+	for _, r := range report.Listed {
+		msgs = append(msgs, r.Msg)
+	}
+	sort.Strings(msgs)
+	c.Assert(msgs, HasLen, 2)
+	c.Assert(msgs[0], Matches, "expect ok, got error 1243 .*")
+	c.Assert(msgs[1], Equals, "expect rows count 2, got 1")
+
+	c.Assert(compareCaptureResults(&CaptureResult{Kind: "error", Code: 1146}, &CaptureResult{Kind: "error", Code: 1146, Message: "other"}), Equals, "")
+	c.Assert(compareCaptureResults(&CaptureResult{Kind: "ok", AffectedRows: 1}, &CaptureResult{Kind: "ok"}), Equals, "expect affected rows 1, got 0")
+}
+
+// stallDriver opens contexts on which "select sleep" blocks until "select 1"
+// is executed by another context.
+type stallDriver struct {
+	once sync.Once
+	gate chan struct{}
+}
+
+func (sd *stallDriver) OpenCtx(capability uint32, collation uint8, dbname string) (IContext, error) {
+	return &stallContext{fakeContext: newFakeContext(), driver: sd}, nil
+}
+
+type stallContext struct {
+	*fakeContext
+	driver *stallDriver
+}
+
+func (sc *stallContext) Execute(sql string) (*ResultSet, error) {
+	switch sql {
+	case "select sleep":
+		<-sc.driver.gate
+	case "select 1":
+		sc.driver.once.Do(func() { close(sc.driver.gate) })
+	}
+	return nil, nil
+}
+
+func (s *testReplaySuite) TestReplaySlowSession(c *C) {
+	file := filepath.Join(c.MkDir(), "session.log")
+	capture, err := OpenCapture(etc.Capture{File: file})
+	c.Assert(err, IsNil)
+	// the stalled connection has more records than a bounded queue holds.
+	for i := 0; i < 3000; i++ {
+		capture.Write(&CaptureRecord{Conn: 1, Time: time.Now(), Cmd: CaptureQuery, SQL: "select sleep"})
+	}
+	capture.Write(&CaptureRecord{Conn: 2, Time: time.Now(), Cmd: CaptureQuery, SQL: "select 1"})
+	capture.Close()
+
+	done := make(chan *ReplayReport)
+	go func() {
+		report, _ := Replay(&stallDriver{gate: make(chan struct{})}, []string{file}, ReplayConfig{})
+		done <- report
+	}()
+	select {
+	case report := <-done:
+		c.Assert(report.Commands, Equals, 3001)
+	case <-time.After(10 * time.Second):
+		c.Fatal("a slow connection holds up the others")
+	}
+}
+
+func (s *testReplaySuite) TestReplayLimit(c *C) {
+	q := newReplayQueue(newReplayLimit(2))
+	rec := &CaptureRecord{Conn: 1, Cmd: CaptureQuery, SQL: "select 1"}
+	q.push(rec)
+	q.push(rec)
+	pushed := make(chan struct{})
+	go func() {
+		q.push(rec)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		c.Fatal("queued beyond the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.pop()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the reader is not resumed")
+	}
+}
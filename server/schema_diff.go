@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// SchemaDiff is a difference of the schemas of mysql and tidb.
+type SchemaDiff struct {
+	Kind   string // Database, Table, Column or Index
+	Schema string
+	Table  string
+	Name   string // the column or index name
+	// Field is the differing attribute, such as Type, Default, Collation or
+	// Columns. It is Exists if the object only exists on one backend.
+	Field  string
+	Values [2]string // the values of mysql and tidb
+}
+
+// SchemaReport is the differences of the schemas of mysql and tidb.
+type SchemaReport struct {
+	Databases []string
+	Diffs     []*SchemaDiff
+}
+
+func (r *SchemaReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "schema diff of [%s], %d differences", strings.Join(r.Databases, ", "), len(r.Diffs))
+	for _, d := range r.Diffs {
+		name := d.Schema
+		for _, part := range []string{d.Table, d.Name} {
+			if part != "" {
+				name += "." + part
+			}
+		}
+		fmt.Fprintf(&buf, "\n%s %s %s: mysql %q, tidb %q", d.Kind, name, d.Field, d.Values[0], d.Values[1])
+	}
+	return buf.String()
+}
+
+// systemDatabases are never compared unless they are named.
+var systemDatabases = []string{"information_schema", "mysql", "performance_schema", "sys"}
+
+// schemaObject is a database, table, column or index with its attributes.
+type schemaObject struct {
+	kind   string
+	schema string
+	table  string
+	name   string
+	attrs  map[string]string
+}
+
+// schemaKinds orders the objects of a table, the table comes before its columns and indexes.
+var schemaKinds = map[string]string{"Database": "0", "Table": "1", "Column": "2", "Index": "3"}
+
+func (o *schemaObject) key() string {
+	return strings.Join([]string{o.schema, o.table, schemaKinds[o.kind], o.name}, "\x00")
+}
+
+// schemaQuery reads the objects of a kind from information_schema, the first
+// columns of the result are the schema, table and name of the object, the
+// following columns are its attributes.
+type schemaQuery struct {
+	kind  string
+	sql   string
+	attrs []string
+}
+
+var schemaQueries = []schemaQuery{
+	{"Database", "SELECT SCHEMA_NAME, '', '', DEFAULT_CHARACTER_SET_NAME, DEFAULT_COLLATION_NAME " +
+		"FROM information_schema.SCHEMATA WHERE SCHEMA_NAME %s", []string{"Charset", "Collation"}},
+	{"Table", "SELECT TABLE_SCHEMA, TABLE_NAME, '', TABLE_COLLATION " +
+		"FROM information_schema.TABLES WHERE TABLE_SCHEMA %s", []string{"Collation"}},
+	{"Column", "SELECT TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, ORDINAL_POSITION, COLUMN_TYPE, IS_NULLABLE, COLUMN_DEFAULT, COLLATION_NAME, EXTRA " +
+		"FROM information_schema.COLUMNS WHERE TABLE_SCHEMA %s", []string{"Position", "Type", "Nullable", "Default", "Collation", "Extra"}},
+}
+
+// indexQuery reads the index columns, they are grouped to the indexes.
+const indexQuery = "SELECT TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, NON_UNIQUE, COLUMN_NAME " +
+	"FROM information_schema.STATISTICS WHERE TABLE_SCHEMA %s ORDER BY TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX"
+
+// schemaFilter returns the condition on the schema name, all the databases
+// except the system ones if dbs is empty.
+func schemaFilter(dbs []string) string {
+	names := dbs
+	op := "IN"
+	if len(names) == 0 {
+		names, op = systemDatabases, "NOT IN"
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteString(name)
+	}
+	return fmt.Sprintf("%s (%s)", op, strings.Join(quoted, ", "))
+}
+
+func schemaValue(v interface{}) string {
+	if v == nil {
+		return "NULL"
+	}
+	return fmt.Sprint(valueString(v))
+}
+
+// loadSchema reads the objects of the databases from information_schema of ctx.
+func loadSchema(ctx IContext, dbs []string) (map[string]*schemaObject, error) {
+	objects := make(map[string]*schemaObject)
+	filter := schemaFilter(dbs)
+	for _, q := range schemaQueries {
+		rs, err := ctx.Execute(fmt.Sprintf(q.sql, filter))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if rs == nil {
+			continue
+		}
+		for _, row := range rs.Rows {
+			o := &schemaObject{kind: q.kind, schema: schemaValue(row[0]), attrs: make(map[string]string)}
+			if q.kind != "Database" {
+				o.table = schemaValue(row[1])
+			}
+			if q.kind == "Column" {
+				o.name = schemaValue(row[2])
+			}
+			for i, attr := range q.attrs {
+				o.attrs[attr] = schemaValue(row[3+i])
+			}
+			objects[o.key()] = o
+		}
+	}
+
+	rs, err := ctx.Execute(fmt.Sprintf(indexQuery, filter))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rs != nil {
+		for _, row := range rs.Rows {
+			o := &schemaObject{kind: "Index", schema: schemaValue(row[0]), table: schemaValue(row[1]), name: schemaValue(row[2])}
+			if prev, ok := objects[o.key()]; ok {
+				prev.attrs["Columns"] += ", " + schemaValue(row[4])
+				continue
+			}
+			o.attrs = map[string]string{"Unique": "YES", "Columns": schemaValue(row[4])}
+			if schemaValue(row[3]) != "0" {
+				o.attrs["Unique"] = "NO"
+			}
+			objects[o.key()] = o
+		}
+	}
+	return objects, nil
+}
+
+// DiffSchemas compares the schemas of the databases on mysql and tidb, all
+// the databases except the system ones are compared if dbs is empty.
+func DiffSchemas(mc, tc IContext, dbs []string) (*SchemaReport, error) {
+	mObjects, err := loadSchema(mc, dbs)
+	if err != nil {
+		return nil, errors.Annotate(err, "load mysql schema")
+	}
+	tObjects, err := loadSchema(tc, dbs)
+	if err != nil {
+		return nil, errors.Annotate(err, "load tidb schema")
+	}
+	return diffSchemaObjects(dbs, mObjects, tObjects), nil
+}
+
+func diffSchemaObjects(dbs []string, mObjects, tObjects map[string]*schemaObject) *SchemaReport {
+	var keys []string
+	for key := range mObjects {
+		keys = append(keys, key)
+	}
+	for key := range tObjects {
+		if _, ok := mObjects[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	report := &SchemaReport{Databases: dbs}
+	// the objects of a missing database or table are not reported.
+	missing := make(map[string]bool)
+	for _, key := range keys {
+		m, t := mObjects[key], tObjects[key]
+		o := m
+		if o == nil {
+			o = t
+		}
+		if missing[o.schema] || missing[o.schema+"."+o.table] {
+			continue
+		}
+		if m == nil || t == nil {
+			switch o.kind {
+			case "Database":
+				missing[o.schema] = true
+			case "Table":
+				missing[o.schema+"."+o.table] = true
+			}
+		}
+		add := func(field string, values [2]string) {
+			report.Diffs = append(report.Diffs, &SchemaDiff{
+				Kind: o.kind, Schema: o.schema, Table: o.table, Name: o.name, Field: field, Values: values,
+			})
+		}
+		if m == nil {
+			add("Exists", [2]string{"NO", "YES"})
+			continue
+		} else if t == nil {
+			add("Exists", [2]string{"YES", "NO"})
+			continue
+		}
+		var attrs []string
+		for attr := range m.attrs {
+			attrs = append(attrs, attr)
+		}
+		sort.Strings(attrs)
+		for _, attr := range attrs {
+			if !strings.EqualFold(m.attrs[attr], t.attrs[attr]) {
+				add(attr, [2]string{m.attrs[attr], t.attrs[attr]})
+			}
+		}
+	}
+	return report
+}
+
+// DiffSchemas compares the schemas of the databases on the backends of the
+// driver on new connections.
+func (cd *ComboDriver) DiffSchemas(dbs []string) (*SchemaReport, error) {
+	mc, err := cd.mysqlDriver.OpenCtx(DefaultCapability, DefaultCollationID, "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer mc.Close()
+	tc, err := cd.tidbDriver.OpenCtx(DefaultCapability, DefaultCollationID, "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer tc.Close()
+	return DiffSchemas(mc, tc, dbs)
+}
+
+func (r *SchemaReport) resultSet() *ResultSet {
+	rs := newAdminResultSet("kind", "schema", "table", "name", "field", "mysql", "tidb")
+	for _, d := range r.Diffs {
+		rs.AddRow(d.Kind, d.Schema, d.Table, d.Name, d.Field, d.Values[0], d.Values[1])
+	}
+	return rs
+}
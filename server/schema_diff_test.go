@@ -0,0 +1,51 @@
+package server
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testSchemaDiffSuite{})
+
+type testSchemaDiffSuite struct {
+}
+
+func (s *testSchemaDiffSuite) TestSchemaDiff(c *C) {
+	c.Assert(schemaFilter([]string{"test"}), Equals, "IN ('test')")
+	c.Assert(schemaFilter(nil), Equals, "NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys')")
+
+	objects := func(objs ...*schemaObject) map[string]*schemaObject {
+		m := make(map[string]*schemaObject)
+		for _, o := range objs {
+			m[o.key()] = o
+		}
+		return m
+	}
+	attrs := func(kv ...string) map[string]string {
+		m := make(map[string]string)
+		for i := 0; i < len(kv); i += 2 {
+			m[kv[i]] = kv[i+1]
+		}
+		return m
+	}
+	mObjects := objects(
+		&schemaObject{kind: "Table", schema: "test", table: "t", attrs: attrs("Collation", "utf8_general_ci")},
+		&schemaObject{kind: "Column", schema: "test", table: "t", name: "a", attrs: attrs("Type", "int(11)", "Default", "NULL")},
+		&schemaObject{kind: "Index", schema: "test", table: "t", name: "PRIMARY", attrs: attrs("Columns", "a")},
+		&schemaObject{kind: "Table", schema: "test", table: "t1", attrs: attrs("Collation", "utf8_general_ci")},
+		&schemaObject{kind: "Column", schema: "test", table: "t1", name: "a", attrs: attrs("Type", "int(11)")},
+	)
+	tObjects := objects(
+		&schemaObject{kind: "Table", schema: "test", table: "t", attrs: attrs("Collation", "UTF8_GENERAL_CI")},
+		&schemaObject{kind: "Column", schema: "test", table: "t", name: "a", attrs: attrs("Type", "bigint(20)", "Default", "NULL")},
+	)
+	report := diffSchemaObjects([]string{"test"}, mObjects, tObjects)
+	c.Assert(report.Diffs, DeepEquals, []*SchemaDiff{
+		{Kind: "Column", Schema: "test", Table: "t", Name: "a", Field: "Type", Values: [2]string{"int(11)", "bigint(20)"}},
+		{Kind: "Index", Schema: "test", Table: "t", Name: "PRIMARY", Field: "Exists", Values: [2]string{"YES", "NO"}},
+		{Kind: "Table", Schema: "test", Table: "t1", Field: "Exists", Values: [2]string{"YES", "NO"}},
+	})
+
+	name, args, _ := parseAdminStatement("show mp schemadiff test, `go test`")
+	c.Assert(name, Equals, "schemadiff")
+	c.Assert(args, DeepEquals, []string{"test", ",", "`go test`"})
+}
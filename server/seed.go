@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+const defaultSeedBatchSize = 500
+
+// seedState is the progress of copying a table.
+type seedState struct {
+	Done bool  `json:"done"`
+	Rows int64 `json:"rows"`
+	// LastKey is the primary key of the last copied row as sql literals.
+	LastKey []string `json:"last_key"`
+}
+
+type seeder struct {
+	cfg   *etc.Seed
+	src   IContext
+	dst   IContext
+	state map[string]*seedState // db.table : progress
+}
+
+// Seed copies the schemas and the rows of the configured databases from src
+// to dst, the tables are created if they do not exist and their rows are
+// replaced by the ones of src. The rows are copied in batches ordered by the
+// primary key, if a state file is configured, an interrupted seeding
+// continues after the last copied batch, the tables without a primary key are
+// copied again from scratch.
+func Seed(src, dst IDriver, cfg *etc.Seed) error {
+	s := &seeder{cfg: cfg, state: make(map[string]*seedState)}
+	if err := s.loadState(); err != nil {
+		return errors.Trace(err)
+	}
+	var err error
+	if s.src, err = src.OpenCtx(DefaultCapability, DefaultCollationID, ""); err != nil {
+		return errors.Trace(err)
+	}
+	defer s.src.Close()
+	if s.dst, err = dst.OpenCtx(DefaultCapability, DefaultCollationID, ""); err != nil {
+		return errors.Trace(err)
+	}
+	defer s.dst.Close()
+	for _, db := range cfg.Databases {
+		if err = s.seedDatabase(db); err != nil {
+			return errors.Annotatef(err, "seed database %s", db.Name)
+		}
+	}
+	return nil
+}
+
+func (s *seeder) loadState() error {
+	if s.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.cfg.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(json.Unmarshal(data, &s.state))
+}
+
+// saveState writes the state to a temporary file then renames it, so the
+// state file is never left half written.
+func (s *seeder) saveState() error {
+	if s.cfg.StateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.state, "", "\t")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := s.cfg.StateFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, s.cfg.StateFile))
+}
+
+func (s *seeder) seedDatabase(db *etc.SeedDatabase) error {
+	if _, err := s.dst.Execute("CREATE DATABASE IF NOT EXISTS " + quoteIdent(db.Name)); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := s.dst.Execute("USE " + quoteIdent(db.Name)); err != nil {
+		return errors.Trace(err)
+	}
+	options := make(map[string]*etc.SeedTable)
+	var tables []string
+	for _, t := range db.Tables {
+		options[t.Name] = t
+		if db.Only {
+			tables = append(tables, t.Name)
+		}
+	}
+	if !db.Only {
+		rs, err := s.src.Execute("SHOW FULL TABLES FROM " + quoteIdent(db.Name))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if rs == nil {
+			return errors.Errorf("no tables listed for database %s", db.Name)
+		}
+		for _, row := range rs.Rows {
+			// views are not copied.
+			if len(row) > 1 && schemaValue(row[1]) != "BASE TABLE" {
+				continue
+			}
+			tables = append(tables, schemaValue(row[0]))
+		}
+	}
+
+	for _, table := range tables {
+		opt := options[table]
+		if opt == nil {
+			opt = &etc.SeedTable{Name: table}
+		}
+		if opt.Skip {
+			continue
+		}
+		batchSize := opt.BatchSize
+		if batchSize <= 0 {
+			batchSize = db.BatchSize
+		}
+		if batchSize <= 0 {
+			batchSize = s.cfg.BatchSize
+		}
+		if batchSize <= 0 {
+			batchSize = defaultSeedBatchSize
+		}
+		if err := s.seedTable(db.Name, opt, batchSize); err != nil {
+			return errors.Annotatef(err, "seed table %s", table)
+		}
+	}
+	return nil
+}
+
+func (s *seeder) seedTable(db string, opt *etc.SeedTable, batchSize int) error {
+	name := db + "." + opt.Name
+	st := s.state[name]
+	if st != nil && st.Done {
+		log.Infof("seed %s already done, %d rows", name, st.Rows)
+		return nil
+	}
+	table := quoteIdent(db) + "." + quoteIdent(opt.Name)
+
+	rs, err := s.src.Execute("SHOW CREATE TABLE " + table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rs == nil || len(rs.Rows) == 0 || len(rs.Rows[0]) < 2 {
+		return errors.Errorf("no create table statement")
+	}
+	create := schemaValue(rs.Rows[0][1])
+	create = strings.Replace(create, "CREATE TABLE ", "CREATE TABLE IF NOT EXISTS ", 1)
+	if _, err = s.dst.Execute(create); err != nil {
+		return errors.Trace(err)
+	}
+
+	rs, err = s.src.Execute(fmt.Sprintf("SELECT * FROM %s LIMIT 0", table))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rs == nil {
+		return errors.Errorf("no columns")
+	}
+	var names, keyNames []string
+	var keyColumns []int
+	for i, col := range rs.Columns {
+		names = append(names, quoteIdent(col.Name))
+		if col.Flag&PriKeyFlag > 0 {
+			keyColumns = append(keyColumns, i)
+			keyNames = append(keyNames, quoteIdent(col.Name))
+		}
+	}
+
+	// without a primary key, or a progress, the table is copied from scratch.
+	if st == nil || len(keyColumns) == 0 || len(st.LastKey) != len(keyColumns) {
+		st = &seedState{}
+		_, err = s.dst.Execute("DELETE FROM " + table)
+	} else {
+		// remove the rows of a batch which was copied but not recorded.
+		_, err = s.dst.Execute(fmt.Sprintf("DELETE FROM %s WHERE %s", table, keyAfter(keyNames, st.LastKey)))
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.state[name] = st
+
+	if !opt.SchemaOnly {
+		if err = s.copyRows(st, table, opt.Where, names, keyNames, keyColumns, batchSize); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	st.Done = true
+	log.Infof("seed %s done, %d rows", name, st.Rows)
+	return errors.Trace(s.saveState())
+}
+
+func (s *seeder) copyRows(st *seedState, table, where string, names, keyNames []string, keyColumns []int, batchSize int) error {
+	orderBy := keyNames
+	if len(orderBy) == 0 {
+		orderBy = names
+	}
+	for {
+		var conds []string
+		if where != "" {
+			conds = append(conds, "("+where+")")
+		}
+		if len(keyColumns) > 0 && len(st.LastKey) > 0 {
+			conds = append(conds, keyAfter(keyNames, st.LastKey))
+		}
+		query := "SELECT * FROM " + table
+		if len(conds) > 0 {
+			query += " WHERE " + strings.Join(conds, " AND ")
+		}
+		query += fmt.Sprintf(" ORDER BY %s LIMIT %d", strings.Join(orderBy, ", "), batchSize)
+		if len(keyColumns) == 0 {
+			query += fmt.Sprintf(" OFFSET %d", st.Rows)
+		}
+		rs, err := s.src.Execute(query)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if rs == nil || len(rs.Rows) == 0 {
+			return nil
+		}
+
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "INSERT INTO %s (%s) VALUES ", table, strings.Join(names, ", "))
+		for i, row := range rs.Rows {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteByte('(')
+			for j, value := range row {
+				if j > 0 {
+					buf.WriteString(", ")
+				}
+				buf.WriteString(seedLiteral(rs.Columns[j], value))
+			}
+			buf.WriteByte(')')
+		}
+		if _, err = s.dst.Execute(buf.String()); err != nil {
+			return errors.Trace(err)
+		}
+
+		st.Rows += int64(len(rs.Rows))
+		if len(keyColumns) > 0 {
+			last := rs.Rows[len(rs.Rows)-1]
+			st.LastKey = st.LastKey[:0]
+			for _, i := range keyColumns {
+				st.LastKey = append(st.LastKey, seedLiteral(rs.Columns[i], last[i]))
+			}
+		}
+		if err = s.saveState(); err != nil {
+			return errors.Trace(err)
+		}
+		log.Debugf("seed %s copied %d rows", table, st.Rows)
+		if len(rs.Rows) < batchSize {
+			return nil
+		}
+	}
+}
+
+// keyAfter returns the condition of the keys greater than values, the row
+// comparison (a, b) > (1, 2) is expanded as a > 1 OR (a = 1 AND b > 2).
+func keyAfter(names, values []string) string {
+	var ors []string
+	for i := range names {
+		var ands []string
+		for j := 0; j < i; j++ {
+			ands = append(ands, names[j]+" = "+values[j])
+		}
+		ands = append(ands, names[i]+" > "+values[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	return "(" + strings.Join(ors, " OR ") + ")"
+}
+
+// seedLiteral formats a value read from src as a sql literal, binary values are written in hex.
+func seedLiteral(col *ColumnInfo, value interface{}) string {
+	if b, ok := value.([]byte); ok && col.Charset == uint16(CharsetIDs["binary"]) {
+		if len(b) == 0 {
+			return "''"
+		}
+		return "0x" + hex.EncodeToString(b)
+	}
+	return sqlLiteral(value)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testSeedSuite{})
+
+type testSeedSuite struct {
+}
+
+func (s *testSeedSuite) TestSeed(c *C) {
+	c.Assert(keyAfter([]string{"a", "b"}, []string{"1", "'x'"}), Equals, "((a > 1) OR (a = 1 AND b > 'x'))")
+	c.Assert(seedLiteral(&ColumnInfo{Charset: uint16(CharsetIDs["binary"])}, []byte{1, 0xff}), Equals, "0x01ff")
+	c.Assert(seedLiteral(&ColumnInfo{}, "a'b"), Equals, `'a\'b'`)
+
+	columns := []*ColumnInfo{{Name: "id", Type: TypeLonglong, Flag: PriKeyFlag}, {Name: "v", Type: TypeVarchar}}
+	src := &scriptedContext{fakeContext: newFakeContext(), results: map[string]*ResultSet{
+		"SHOW FULL TABLES FROM `test`":     {Rows: [][]interface{}{{"t", "BASE TABLE"}, {"v", "VIEW"}}},
+		"SHOW CREATE TABLE `test`.`t`":     {Rows: [][]interface{}{{"t", "CREATE TABLE `t` (`id` int PRIMARY KEY, `v` varchar(10))"}}},
+		"SELECT * FROM `test`.`t` LIMIT 0": {Columns: columns},
+		"SELECT * FROM `test`.`t` ORDER BY `id` LIMIT 2": {Columns: columns, Rows: [][]interface{}{
+			{int64(1), "a"}, {int64(2), nil},
+		}},
+		"SELECT * FROM `test`.`t` WHERE ((`id` > 2)) ORDER BY `id` LIMIT 2": {Columns: columns, Rows: [][]interface{}{
+			{int64(3), "c"},
+		}},
+	}}
+	dst := &scriptedContext{fakeContext: newFakeContext()}
+	cfg := &etc.Seed{BatchSize: 2, Databases: []*etc.SeedDatabase{{Name: "test"}}}
+	err := Seed(&scriptedDriver{src}, &scriptedDriver{dst}, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(dst.executed, DeepEquals, []string{
+		"CREATE DATABASE IF NOT EXISTS `test`",
+		"USE `test`",
+		"CREATE TABLE IF NOT EXISTS `t` (`id` int PRIMARY KEY, `v` varchar(10))",
+		"DELETE FROM `test`.`t`",
+		"INSERT INTO `test`.`t` (`id`, `v`) VALUES (1, 'a'), (2, NULL)",
+		"INSERT INTO `test`.`t` (`id`, `v`) VALUES (3, 'c')",
+	})
+
+	// a database whose tables are not listed fails instead of panicking.
+	src.results = map[string]*ResultSet{}
+	err = Seed(&scriptedDriver{src}, &scriptedDriver{dst}, &etc.Seed{Databases: []*etc.SeedDatabase{{Name: "test"}}})
+	c.Assert(err, ErrorMatches, ".*no tables listed for database test")
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/ngaut/arena"
@@ -26,6 +28,18 @@ type Server struct {
 	rwlock            *sync.RWMutex
 	concurrentLimiter *tokenlimiter.TokenLimiter
 	clients           map[uint32]*ClientConn
+	captureMu         sync.RWMutex
+	capture           *Capture
+	captureCfg        etc.Capture
+	tracer            *Tracer
+	digests           *DigestStats
+	queryLog          *QueryLog
+	audit             *Audit
+	mode              string // the mode label of the metrics
+	metricsListener   net.Listener
+	adminListener     net.Listener
+	adminMu           sync.Mutex
+	logLevel          string
 }
 
 func (s *Server) GetToken() *tokenlimiter.Token {
@@ -47,6 +61,7 @@ func (s *Server) newConn(conn net.Conn) (cc *ClientConn, err error) {
 		charset:      mysqldef.DefaultCharset,
 		alloc:        arena.NewArenaAllocator(32 * 1024),
 	}
+	cc.pkg.countBytes("client")
 	cc.salt = make([]byte, 20)
 	io.ReadFull(rand.Reader, cc.salt)
 	for i, b := range cc.salt {
@@ -69,6 +84,29 @@ func (s *Server) CfgGetPwd(user string) string {
 	return s.cfg.Password //TODO support multiple users
 }
 
+// errAdminRequired is returned to the clients running the admin statements
+// without the admin identity.
+var errAdminRequired = mysqldef.NewDefaultError(mysqldef.ErSpecificAccessDeniedError, "mp admin")
+
+// login checks auth, the password of user scrambled by salt, and returns
+// whether user is the admin user. The admin user only logs in with the admin
+// password, SkipAuth never makes an admin, and the admin password is never
+// accepted for the other users.
+func (s *Server) login(user string, salt, auth []byte) (admin bool, ok bool) {
+	cfg := s.cfg.Admin
+	if cfg.User == "" || cfg.Password == "" {
+		return false, s.SkipAuth() || bytes.Equal(auth, calcPassword(salt, []byte(s.CfgGetPwd(user))))
+	}
+	adminAuth := bytes.Equal(auth, calcPassword(salt, []byte(cfg.Password)))
+	if user == cfg.User {
+		return adminAuth, adminAuth
+	}
+	if adminAuth {
+		return false, false
+	}
+	return false, s.SkipAuth() || bytes.Equal(auth, calcPassword(salt, []byte(s.CfgGetPwd(user))))
+}
+
 func NewServer(cfg *etc.Config, driver IDriver) (*Server, error) {
 	log.Warningf("%#v", cfg)
 	s := &Server{
@@ -77,13 +115,63 @@ func NewServer(cfg *etc.Config, driver IDriver) (*Server, error) {
 		concurrentLimiter: tokenlimiter.NewTokenLimiter(100),
 		rwlock:            &sync.RWMutex{},
 		clients:           make(map[uint32]*ClientConn),
+		tracer:            NewTracer(cfg.Trace),
+		digests:           NewDigestStats(cfg.Digests),
+		mode:              driverMode(driver),
+		captureCfg:        cfg.Capture,
+		logLevel:          cfg.LogLevel,
+	}
+
+	if cfg.Admin.Password != "" && cfg.Admin.Password == cfg.Password {
+		return nil, errors.New("the admin password must differ from the password of the clients")
 	}
 
 	var err error
+	if cfg.Capture.File != "" {
+		if s.capture, err = OpenCapture(cfg.Capture); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if cfg.QueryLog.General != "" || cfg.QueryLog.Slow != "" {
+		if s.queryLog, err = OpenQueryLog(cfg.QueryLog, cfg.Addr); err != nil {
+			s.capture.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	if cfg.Audit.File != "" {
+		if s.audit, err = OpenAudit(cfg.Audit); err != nil {
+			s.capture.Close()
+			s.queryLog.Close()
+			return nil, errors.Trace(err)
+		}
+	}
 	s.listener, err = net.Listen("tcp", s.cfg.Addr)
 	if err != nil {
+		s.capture.Close()
+		s.queryLog.Close()
+		s.audit.Close()
 		return nil, errors.Trace(err)
 	}
+	if cfg.MetricsAddr != "" {
+		if s.metricsListener, err = net.Listen("tcp", cfg.MetricsAddr); err != nil {
+			s.Close()
+			return nil, errors.Trace(err)
+		}
+		go serveMetrics(s.metricsListener)
+		log.Infof("Server run metrics at http://%s/metrics", cfg.MetricsAddr)
+	}
+	if cfg.Admin.Addr != "" {
+		if cfg.Admin.User == "" || cfg.Admin.Password == "" {
+			s.Close()
+			return nil, errors.New("admin user and password are required by the admin api")
+		}
+		if s.adminListener, err = net.Listen("tcp", cfg.Admin.Addr); err != nil {
+			s.Close()
+			return nil, errors.Trace(err)
+		}
+		go s.serveAdmin(s.adminListener)
+		log.Infof("Server run admin api at http://%s/api/", cfg.Admin.Addr)
+	}
 
 	log.Infof("Server run MySql Protocol Listen at [%s]", s.cfg.Addr)
 	return s, nil
@@ -111,9 +199,21 @@ func (s *Server) Close() {
 		s.listener.Close()
 		s.listener = nil
 	}
+	if s.metricsListener != nil {
+		s.metricsListener.Close()
+		s.metricsListener = nil
+	}
+	if s.adminListener != nil {
+		s.adminListener.Close()
+		s.adminListener = nil
+	}
+	s.SetCapture(etc.Capture{})
+	s.queryLog.Close()
+	s.audit.Close()
 }
 
 func (s *Server) onConn(c net.Conn) {
+	metrics.ConnectionsTotal.Inc(s.mode)
 	conn, err := s.newConn(c)
 	if err != nil {
 		log.Errorf("newConn error %s", errors.ErrorStack(err))
@@ -121,15 +221,31 @@ func (s *Server) onConn(c net.Conn) {
 	}
 	if err := conn.Handshake(); err != nil {
 		log.Errorf("handshake error %s", errors.ErrorStack(err))
+		metrics.HandshakeFailures.Inc(handshakeFailure(err))
+		metrics.ConnectionsRefused.Inc(s.mode)
 		c.Close()
 		return
 	}
 	conn.ctx, err = s.driver.OpenCtx(conn.capability, uint8(conn.collation), conn.dbname)
 	if err != nil {
 		log.Errorf("open ctx error %s", errors.ErrorStack(err))
+		metrics.ConnectionsRefused.Inc(s.mode)
 		c.Close()
 		return
 	}
+	metrics.Connections.Inc(s.mode)
+	defer metrics.Connections.Add(-1, s.mode)
+	conn.setTrace(conn.pkg.trace != nil)
+
+	s.getCapture().Write(&CaptureRecord{
+		Conn:       conn.connectionId,
+		Time:       time.Now(),
+		Cmd:        CaptureConnect,
+		User:       conn.user,
+		DB:         conn.dbname,
+		Capability: conn.capability,
+		Collation:  conn.collation,
+	})
 
 	const key = "connections"
 
@@ -137,6 +253,16 @@ func (s *Server) onConn(c net.Conn) {
 		log.Infof("close %s", conn)
 	}()
 
+	now := time.Now()
+	conn.info = ClientInfo{
+		ID:        conn.connectionId,
+		User:      conn.user,
+		Host:      conn.remoteHost(),
+		DB:        conn.dbname,
+		Connected: now,
+		Command:   "sleep",
+		Since:     now,
+	}
 	s.rwlock.Lock()
 	s.clients[conn.connectionId] = conn
 	s.rwlock.Unlock()
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"strings"
+)
+
+type sqlTokenKind int
+
+const (
+	tokIdent sqlTokenKind = iota
+	tokQuotedIdent
+	tokString
+	tokNumber
+	tokOther
+)
+
+// sqlToken is a lexical token of a sql statement, white spaces and comments
+// are not returned as tokens, space is true if they precede the token.
+type sqlToken struct {
+	kind  sqlTokenKind
+	start int
+	end   int
+	space bool
+}
+
+func (t sqlToken) text(sql string) string {
+	return sql[t.start:t.end]
+}
+
+// lower returns the lower cased text of an identifier token.
+func (t sqlToken) lower(sql string) string {
+	return strings.ToLower(sql[t.start:t.end])
+}
+
+func (t sqlToken) is(sql string, s string) bool {
+	return t.end-t.start == len(s) && strings.EqualFold(sql[t.start:t.end], s)
+}
+
+// lexSQL splits sql into tokens. It is a light weight tokenizer which knows
+// quoting, comments and literals, it does not validate the statement.
+func lexSQL(sql string) []sqlToken {
+	var toks []sqlToken
+	space := false
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		tok := sqlToken{start: i, space: space}
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			i++
+			continue
+		case c == '#' || (c == '-' && i+2 < len(sql) && sql[i+1] == '-' && (sql[i+2] == ' ' || sql[i+2] == '\t')):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			space = true
+			continue
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+			space = true
+			continue
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i)
+			tok.kind = tokString
+		case c == '`':
+			i = skipQuoted(sql, i)
+			tok.kind = tokQuotedIdent
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			i = skipNumber(sql, i)
+			tok.kind = tokNumber
+		case isIdentChar(c):
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+			tok.kind = tokIdent
+		default:
+			i++
+			tok.kind = tokOther
+		}
+		tok.end = i
+		toks = append(toks, tok)
+		space = false
+	}
+	return toks
+}
+
+func skipQuoted(sql string, i int) int {
+	quote := sql[i]
+	i++
+	for i < len(sql) {
+		if sql[i] == '\\' && quote != '`' {
+			i += 2
+			continue
+		}
+		if sql[i] == quote {
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(sql)
+}
+
+func skipNumber(sql string, i int) int {
+	if sql[i] == '0' && i+1 < len(sql) && (sql[i+1] == 'x' || sql[i+1] == 'X' || sql[i+1] == 'b' || sql[i+1] == 'B') {
+		i += 2
+	}
+	for i < len(sql) {
+		c := sql[i]
+		if (c == 'e' || c == 'E') && i+1 < len(sql) && (sql[i+1] == '+' || sql[i+1] == '-') {
+			i += 2
+		} else if isDigit(c) || c == '.' || isHexLetter(c) {
+			i++
+		} else {
+			break
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexLetter(c byte) bool {
+	return (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || isDigit(c) || c == '_' || c == '$' || c == '@' || c >= 0x80
+}
+
+// parseTableName parses a possibly qualified table name starting at toks[i],
+// it returns the name with back quotes removed and the index after it.
+func parseTableName(sql string, toks []sqlToken, i int) (name string, next int) {
+	if i >= len(toks) || (toks[i].kind != tokIdent && toks[i].kind != tokQuotedIdent) {
+		return "", i
+	}
+	name = unquoteIdent(toks[i].text(sql))
+	i++
+	if i+1 < len(toks) && toks[i].is(sql, ".") && (toks[i+1].kind == tokIdent || toks[i+1].kind == tokQuotedIdent) {
+		name += "." + unquoteIdent(toks[i+1].text(sql))
+		i += 2
+	}
+	return name, i
+}
+
+func unquoteIdent(s string) string {
+	if len(s) >= 2 && s[0] == '`' && s[len(s)-1] == '`' {
+		return strings.Replace(s[1:len(s)-1], "``", "`", -1)
+	}
+	return s
+}
+
+// writeTable returns the table written by an INSERT, REPLACE, UPDATE or
+// DELETE statement, or empty string if sql is not such a statement. For
+// multiple table statements only the first table is returned.
+func writeTable(sql string) string {
+	toks := lexSQL(sql)
+	if len(toks) == 0 || toks[0].kind != tokIdent {
+		return ""
+	}
+	i := 1
+	skip := func(words ...string) {
+		for i < len(toks) {
+			matched := false
+			for _, w := range words {
+				if toks[i].is(sql, w) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return
+			}
+			i++
+		}
+	}
+	switch toks[0].lower(sql) {
+	case "insert", "replace":
+		skip("low_priority", "delayed", "high_priority", "ignore", "into")
+	case "update":
+		skip("low_priority", "ignore")
+	case "delete":
+		skip("low_priority", "quick", "ignore")
+		if i >= len(toks) || !toks[i].is(sql, "from") {
+			return ""
+		}
+		i++
+	default:
+		return ""
+	}
+	name, _ := parseTableName(sql, toks, i)
+	return name
+}
+
+// useDB returns the database of a USE statement.
+func useDB(sql string) string {
+	toks := lexSQL(sql)
+	if len(toks) < 2 || !toks[0].is(sql, "use") {
+		return ""
+	}
+	name, _ := parseTableName(sql, toks, 1)
+	return name
+}
+
+// tableKeywords are the keywords followed by a table name.
+var tableKeywords = map[string]bool{"from": true, "join": true, "into": true, "update": true, "table": true}
+
+// aliasEnd are the keywords which may follow a table name, so they are never an alias.
+var aliasEnd = map[string]bool{
+	"where": true, "join": true, "inner": true, "left": true, "right": true, "cross": true,
+	"natural": true, "straight_join": true, "on": true, "using": true, "group": true, "order": true,
+	"limit": true, "having": true, "set": true, "values": true, "value": true, "select": true,
+	"union": true, "for": true, "lock": true, "use": true, "force": true, "ignore": true,
+}
+
+// statementTables returns the tables referenced by sql, the table names
+// following FROM, JOIN, INTO, UPDATE and TABLE, the comma separated ones of a
+// FROM clause, and the table written by INSERT or REPLACE without INTO.
+// Subqueries are scanned as well.
+func statementTables(sql string) (tables []string) {
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			tables = append(tables, name)
+		}
+	}
+	add(writeTable(sql))
+	toks := lexSQL(sql)
+	for i := 0; i < len(toks); i++ {
+		if toks[i].kind != tokIdent || !tableKeywords[toks[i].lower(sql)] {
+			continue
+		}
+		// FOR UPDATE and ON DUPLICATE KEY UPDATE
+		if i > 0 && toks[i].is(sql, "update") && (toks[i-1].is(sql, "for") || toks[i-1].is(sql, "key")) {
+			continue
+		}
+		for next := i + 1; ; {
+			name, end := parseTableName(sql, toks, next)
+			if name == "" {
+				break
+			}
+			add(name)
+			// skip the alias.
+			if end < len(toks) && toks[end].is(sql, "as") {
+				end += 2
+			} else if end < len(toks) && (toks[end].kind == tokQuotedIdent ||
+				toks[end].kind == tokIdent && !aliasEnd[toks[end].lower(sql)]) {
+				end++
+			}
+			i = end - 1
+			if end >= len(toks) || !toks[end].is(sql, ",") {
+				break
+			}
+			next = end + 1
+		}
+	}
+	return
+}
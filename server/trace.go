@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+)
+
+// Tracer decides which client connections have the packet-level wire trace
+// on, it's switched at runtime. A traced connection logs every packet read
+// and written by its PacketIO, and by the PacketIO of its mysql backend
+// connections.
+type Tracer struct {
+	maxDump int
+
+	mu    sync.RWMutex
+	all   bool
+	conns map[uint32]bool
+	users map[string]bool
+}
+
+// NewTracer returns a tracer tracing the connections of the configured users.
+func NewTracer(cfg etc.Trace) *Tracer {
+	t := &Tracer{
+		maxDump: cfg.MaxDump,
+		conns:   make(map[uint32]bool),
+		users:   make(map[string]bool),
+	}
+	for _, user := range cfg.Users {
+		t.users[user] = true
+	}
+	return t
+}
+
+// SetAll switches the trace of all connections.
+func (t *Tracer) SetAll(on bool) {
+	t.mu.Lock()
+	t.all = on
+	t.mu.Unlock()
+}
+
+// SetConn switches the trace of a connection.
+func (t *Tracer) SetConn(conn uint32, on bool) {
+	t.mu.Lock()
+	if on {
+		t.conns[conn] = true
+	} else {
+		delete(t.conns, conn)
+	}
+	t.mu.Unlock()
+}
+
+// SetUser switches the trace of the connections of a user.
+func (t *Tracer) SetUser(user string, on bool) {
+	t.mu.Lock()
+	if on {
+		t.users[user] = true
+	} else {
+		delete(t.users, user)
+	}
+	t.mu.Unlock()
+}
+
+// Traced returns whether the connection of user is traced, a nil tracer
+// traces nothing.
+func (t *Tracer) Traced(conn uint32, user string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.all || t.conns[conn] || t.users[user]
+}
+
+// forgetConn drops the setting of a closed connection, the ids are never reused.
+func (t *Tracer) forgetConn(conn uint32) {
+	if t != nil {
+		t.SetConn(conn, false)
+	}
+}
+
+// TraceTarget is a traced target, all connections, a connection or the
+// connections of a user.
+type TraceTarget struct {
+	Target string `json:"target"`
+	Name   string `json:"name,omitempty"`
+}
+
+// targets lists what is traced.
+func (t *Tracer) targets() []TraceTarget {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	targets := []TraceTarget{}
+	if t.all {
+		targets = append(targets, TraceTarget{Target: "all"})
+	}
+	var conns []int
+	for conn := range t.conns {
+		conns = append(conns, int(conn))
+	}
+	sort.Ints(conns)
+	for _, conn := range conns {
+		targets = append(targets, TraceTarget{Target: "connection", Name: strconv.Itoa(conn)})
+	}
+	var users []string
+	for user := range t.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		targets = append(targets, TraceTarget{Target: "user", Name: user})
+	}
+	return targets
+}
+
+func (t *Tracer) resultSet() *ResultSet {
+	rs := newAdminResultSet("Target", "Name")
+	for _, target := range t.targets() {
+		rs.Rows = append(rs.Rows, []interface{}{target.Target, target.Name})
+	}
+	return rs
+}
+
+// admin handles the arguments of "SHOW MP TRACE", it lists what is traced
+// after switching the trace if asked:
+//
+//	SHOW MP TRACE                        list the traced targets
+//	SHOW MP TRACE ON|OFF ALL             switch all connections
+//	SHOW MP TRACE ON|OFF CONNECTION id   switch a connection
+//	SHOW MP TRACE ON|OFF USER name       switch the connections of a user
+func (t *Tracer) admin(args []string) (*ResultSet, error) {
+	if len(args) == 0 {
+		return t.resultSet(), nil
+	}
+	usage := errors.New("usage: SHOW MP TRACE [ON|OFF ALL|CONNECTION id|USER name]")
+	var on bool
+	switch strings.ToLower(args[0]) {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return nil, usage
+	}
+	switch {
+	case len(args) == 2 && strings.ToLower(args[1]) == "all":
+		t.SetAll(on)
+	case len(args) == 3 && strings.ToLower(args[1]) == "connection":
+		conn, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil {
+			return nil, usage
+		}
+		t.SetConn(uint32(conn), on)
+	case len(args) == 3 && strings.ToLower(args[1]) == "user":
+		user := unquoteIdent(args[2])
+		if len(user) >= 2 && (user[0] == '\'' || user[0] == '"') && user[len(user)-1] == user[0] {
+			user = user[1 : len(user)-1]
+		}
+		t.SetUser(user, on)
+	default:
+		return nil, usage
+	}
+	return t.resultSet(), nil
+}
+
+// packetTrace logs the packets of a PacketIO.
+type packetTrace struct {
+	name string
+	// backend is true for the connections to the backends, on which the
+	// commands are written rather than read.
+	backend bool
+	// maxDump is the max bytes of a packet in the hexdump.
+	maxDump int
+}
+
+// wireTracer is implemented by the contexts which talk the mysql protocol to
+// a backend, the trace is switched between commands.
+type wireTracer interface {
+	setTrace(t *packetTrace)
+}
+
+func (t *packetTrace) packet(write bool, sequence uint8, payload []byte) {
+	log.Info(t.format(write, sequence, payload))
+}
+
+// format returns the trace line of a packet. The handshake, the auth and
+// the change user packets are never dumped, they carry the salt and the
+// scrambled passwords, nor are the statements carrying passwords.
+func (t *packetTrace) format(write bool, sequence uint8, payload []byte) string {
+	direction := "read"
+	if write {
+		direction = "write"
+	}
+	kind := t.packetType(write, sequence, payload)
+	msg := fmt.Sprintf("trace %s %s seq %d len %d %s", t.name, direction, sequence, len(payload), kind)
+	secret := kind == "handshake" || kind == "auth" || (write == t.backend && sequence == 0 && secretCommand(payload))
+	if t.maxDump > 0 && len(payload) > 0 && !secret {
+		dump := payload
+		if len(dump) > t.maxDump {
+			dump = dump[:t.maxDump]
+		}
+		msg += "\n" + hex.Dump(dump)
+		if len(payload) > len(dump) {
+			msg += fmt.Sprintf("... %d more bytes", len(payload)-len(dump))
+		}
+	}
+	return msg
+}
+
+// secretCommand reports whether the command packet carries a password.
+func secretCommand(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch payload[0] {
+	case ComChangeUser:
+		return true
+	case ComQuery, ComStmtPrepare:
+		sql := string(payload[1:])
+		return redactPasswords(sql) != sql
+	}
+	return false
+}
+
+// packetType decodes the command of a command packet, or guesses the header
+// type of a response packet by its first byte.
+func (t *packetTrace) packetType(write bool, sequence uint8, payload []byte) string {
+	if len(payload) == 0 {
+		return "empty"
+	}
+	// the commands flow from the clients to the backends.
+	command := write == t.backend
+	if sequence == 0 {
+		if !command {
+			return "handshake"
+		}
+		return commandName(payload[0])
+	}
+	if command {
+		return "auth"
+	}
+	switch {
+	case payload[0] == ErrHeader:
+		return "err"
+	case payload[0] == EOFHeader && len(payload) < 9:
+		return "eof"
+	case payload[0] == OKHeader && sequence <= 2:
+		// a binary row starts with 0x00 too, but never follows a command
+		// or the auth packet directly.
+		return "ok"
+	case payload[0] == LocalInFileHeader && sequence == 1:
+		return "local_infile"
+	}
+	return "data"
+}
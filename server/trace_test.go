@@ -0,0 +1,117 @@
+package server
+
+import (
+	"github.com/pingcap/mp/etc"
+	. "github.com/pingcap/tidb/mysqldef"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&testTraceSuite{})
+
+type testTraceSuite struct {
+}
+
+func (s *testTraceSuite) TestTrace(c *C) {
+	fc := newFakeContext()
+	cc := newCaptureConn(nil, fc)
+	cc.user = "app"
+	cc.server.tracer = NewTracer(etc.Trace{Users: []string{"root"}, MaxDump: 16})
+	cc.updateTrace()
+	c.Assert(cc.pkg.trace, IsNil)
+
+	// only the admin user runs the admin statements.
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "show mp trace on all"...)), NotNil)
+	c.Assert(cc.server.tracer.Traced(7, "app"), Equals, false)
+	cc.admin = true
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "show mp trace on user 'app'"...)), IsNil)
+	c.Assert(fc.executed, HasLen, 0)
+	c.Assert(cc.server.tracer.resultSet().Rows, DeepEquals, [][]interface{}{{"user", "app"}, {"user", "root"}})
+	cc.updateTrace()
+	c.Assert(cc.pkg.trace, NotNil)
+	c.Assert(cc.pkg.trace.name, Equals, "conn 7 client")
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "select 1"...)), IsNil)
+
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "show mp trace off user app"...)), IsNil)
+	c.Assert(cc.dispatch(append([]byte{ComQuery}, "show mp trace on connection 7"...)), IsNil)
+	cc.updateTrace()
+	c.Assert(cc.pkg.trace, NotNil)
+	_, err := cc.server.tracer.admin([]string{"on", "connection", "x"})
+	c.Assert(err, NotNil)
+	cc.server.tracer.forgetConn(7)
+	cc.updateTrace()
+	c.Assert(cc.pkg.trace, IsNil)
+	cc.server.tracer.SetAll(true)
+	c.Assert(cc.server.tracer.Traced(8, ""), Equals, true)
+
+	client := &packetTrace{}
+	backend := &packetTrace{backend: true}
+	for _, t := range []struct {
+		trace    *packetTrace
+		write    bool
+		sequence uint8
+		payload  []byte
+		expected string
+	}{
+		{client, true, 0, []byte{10, '5'}, "handshake"},
+		{client, false, 1, []byte{0x85, 0xa6}, "auth"},
+		{client, false, 0, []byte{ComQuery, 's'}, "query"},
+		{client, false, 0, []byte{ComSleep}, "cmd_0"},
+		{client, true, 1, []byte{OKHeader, 0, 0}, "ok"},
+		{client, true, 1, []byte{1}, "data"},
+		{client, true, 3, []byte{EOFHeader, 0, 0, 2, 0}, "eof"},
+		{client, true, 4, []byte{OKHeader, 0, 1}, "data"},
+		{backend, false, 0, []byte{10, '5'}, "handshake"},
+		{backend, true, 0, []byte{ComStmtPrepare}, "prepare"},
+		{backend, false, 1, []byte{ErrHeader, 0x7a, 0x04}, "err"},
+		{backend, false, 1, nil, "empty"},
+	} {
+		c.Assert(t.trace.packetType(t.write, t.sequence, t.payload), Equals, t.expected, Commentf("%v", t))
+	}
+
+	dump := &packetTrace{name: "c", maxDump: 16}
+	c.Assert(dump.format(false, 0, []byte{ComQuery, '1'}), Equals,
+		"trace c read seq 0 len 2 query\n00000000  03 31                                             |.1|\n")
+	c.Assert(dump.format(false, 1, []byte{0x85, 0xa6}), Equals, "trace c read seq 1 len 2 auth")
+	c.Assert(dump.format(true, 0, []byte{10, '5'}), Equals, "trace c write seq 0 len 2 handshake")
+	c.Assert(dump.format(false, 0, []byte{ComChangeUser, 'u'}), Equals, "trace c read seq 0 len 2 cmd_17")
+	// the statements carrying passwords are never dumped.
+	query := append([]byte{ComQuery}, "SET PASSWORD = 'x'"...)
+	c.Assert(dump.format(false, 0, query), Equals, "trace c read seq 0 len 19 query")
+	prepare := append([]byte{ComStmtPrepare}, "create user u identified by 'x'"...)
+	c.Assert(dump.format(false, 0, prepare), Equals, "trace c read seq 0 len 32 prepare")
+	c.Assert(dump.format(false, 0, nil), Equals, "trace c read seq 0 len 0 empty")
+}
+
+func (s *testTraceSuite) TestAdminLogin(c *C) {
+	svr := &Server{cfg: &etc.Config{Password: "pw", Admin: etc.Admin{User: "admin", Password: "secret"}}}
+	salt := []byte("12345678901234567890")
+	login := func(user, password string) (bool, bool) {
+		return svr.login(user, salt, calcPassword(salt, []byte(password)))
+	}
+	admin, ok := login("admin", "secret")
+	c.Assert(admin && ok, Equals, true)
+	admin, ok = login("admin", "pw")
+	c.Assert(admin || ok, Equals, false)
+	admin, ok = login("root", "pw")
+	c.Assert(!admin && ok, Equals, true)
+	// the admin password is never accepted for the other users.
+	admin, ok = login("root", "secret")
+	c.Assert(admin || ok, Equals, false)
+	svr.cfg.SkipAuth = true
+	admin, ok = login("root", "secret")
+	c.Assert(admin || ok, Equals, false)
+	admin, ok = login("root", "any")
+	c.Assert(!admin && ok, Equals, true)
+	admin, ok = login("admin", "any")
+	c.Assert(admin || ok, Equals, false)
+
+	svr.cfg.Admin.Password = ""
+	admin, ok = svr.login("admin", salt, nil)
+	c.Assert(!admin && ok, Equals, true)
+	svr.cfg.Admin = etc.Admin{Password: "secret"}
+	admin, _ = login("", "secret")
+	c.Assert(admin, Equals, false)
+
+	_, err := NewServer(&etc.Config{Password: "pw", Admin: etc.Admin{User: "admin", Password: "pw"}}, nil)
+	c.Assert(err, ErrorMatches, "the admin password must differ from the password of the clients")
+}
@@ -8,3 +8,43 @@ var _ = Suite(&testUtilSuite{})
 
 type testUtilSuite struct {
 }
+
+func (s *testUtilSuite) TestNormalizeSQL(c *C) {
+	tbl := []struct {
+		sql    string
+		expect string
+	}{
+		{"SELECT * FROM t WHERE id = 1", "select * from t where id = ?"},
+		{"select  *\n from t1 where name='a''b' and id=0x1f", "select * from t1 where name=? and id=?"},
+		{"insert into t values (1, 'a'), (2, \"b\")", "insert into t values (...), (...)"},
+		{"select * from t where id in (1, 2, 3) -- comment", "select * from t where id in (...)"},
+		{"select /* hint */ `Col1` from t where f = 1.5e-3", "select `Col1` from t where f = ?"},
+	}
+	for _, t := range tbl {
+		c.Assert(normalizeSQL(t.sql), Equals, t.expect, Commentf("sql %s", t.sql))
+	}
+	c.Assert(sqlDigest(normalizeSQL("select 1")), Equals, sqlDigest(normalizeSQL("SELECT 2")))
+}
+
+func (s *testUtilSuite) TestReadOnlySQL(c *C) {
+	tbl := []struct {
+		sql      string
+		readOnly bool
+	}{
+		{"select * from t where a = 'for update'", true},
+		{"show tables", true},
+		{"select `into` from t", true},
+		{"select @v = 1", true},
+		{"select * from t for\n\tupdate", false},
+		{"select * from t FOR /* c */ UPDATE", false},
+		{"select * from t lock in share mode", false},
+		{"select * from t for share", false},
+		{"select a into @v from t", false},
+		{"select * from t into outfile '/tmp/t'", false},
+		{"select @v := 1", false},
+		{"insert into t values (1)", false},
+	}
+	for _, t := range tbl {
+		c.Assert(isReadOnlySQL(t.sql), Equals, t.readOnly, Commentf("sql %s", t.sql))
+	}
+}